@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACLReloadCheckInterval is how often acl files are checked for modification, on lookups.
+const ACLReloadCheckInterval = 10 * time.Second
+
+// ACL allows or denies clients by ip and CIDR. Denied clients are refused even if allowed, and only allowed
+// clients are served if any allow list or file is configured, so an empty allow file allows no client. Lists may
+// be loaded from files, which are reloaded when modified.
+type ACL struct {
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	allowFile string
+	denyFile  string
+	// allowListMode serves only allowed clients, set if any allow list or file is configured, even if empty.
+	allowListMode bool
+	// fileWatcher checks files on lookups.
+	fileWatcher
+
+	mu        sync.RWMutex
+	fileAllow []*net.IPNet
+	fileDeny  []*net.IPNet
+}
+
+// NewACL creates ACL of service, nil if no list is configured, which allows any client.
+func NewACL(conf *ACLConfigModel) (a *ACL, err error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 && conf.AllowFile == "" && conf.DenyFile == "" {
+		return nil, nil
+	}
+	a = &ACL{
+		allowFile:     conf.AllowFile,
+		denyFile:      conf.DenyFile,
+		allowListMode: len(conf.Allow) > 0 || conf.AllowFile != "",
+		fileWatcher: fileWatcher{files: []string{conf.AllowFile, conf.DenyFile},
+			CheckInterval: ACLReloadCheckInterval},
+	}
+	if a.allow, err = ParseIPNets(conf.Allow); err != nil {
+		return nil, fmt.Errorf("acl allow: %v", err)
+	}
+	if a.deny, err = ParseIPNets(conf.Deny); err != nil {
+		return nil, fmt.Errorf("acl deny: %v", err)
+	}
+	if err = a.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload loads lists from files, the current ones are kept if loading fails.
+func (a *ACL) Reload() error {
+	if err := a.load(func() error {
+		allow_, err := readACLFile(a.allowFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.allowFile, err)
+		}
+		deny_, err := readACLFile(a.denyFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.denyFile, err)
+		}
+		a.mu.Lock()
+		a.fileAllow, a.fileDeny = allow_, deny_
+		a.mu.Unlock()
+		return nil
+	}); err != nil {
+		return fmt.Errorf("load acl error: %v", err)
+	}
+	return nil
+}
+
+// readACLFile reads ips and CIDRs of file, one per line, # starts comments.
+func readACLFile(file string) (nets []*net.IPNet, err error) {
+	if file == "" {
+		return
+	}
+	f_, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f_.Close()
+	var list_ []string
+	scanner_ := bufio.NewScanner(f_)
+	for scanner_.Scan() {
+		line_, _, _ := strings.Cut(scanner_.Text(), "#")
+		list_ = append(list_, line_)
+	}
+	if err = scanner_.Err(); err != nil {
+		return
+	}
+	return ParseIPNets(list_)
+}
+
+// reloadIfModified reloads files if modified since checked CheckInterval ago.
+func (a *ACL) reloadIfModified() {
+	if (a.allowFile == "" && a.denyFile == "") || !a.modified() {
+		return
+	}
+	if err := a.Reload(); err != nil {
+		log.Errorf("acl reloading error: %v", err)
+	} else {
+		log.Infof("acl reloaded from %s", strings.Trim(a.allowFile+" "+a.denyFile, " "))
+	}
+}
+
+// Allowed tells if client ip may be served, any client is allowed by nil ACL.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	a.reloadIfModified()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if ip == nil {
+		return !a.allowListMode
+	}
+	if ipNetsContain(a.deny, ip) || ipNetsContain(a.fileDeny, ip) {
+		return false
+	}
+	if !a.allowListMode {
+		return true
+	}
+	return ipNetsContain(a.allow, ip) || ipNetsContain(a.fileAllow, ip)
+}
+
+func ipNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, net_ := range nets {
+		if net_.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestACL_Allowed(t *testing.T) {
+	for name, tc := range map[string]struct {
+		conf    ACLConfigModel
+		allowed map[string]bool
+	}{
+		"allow list": {conf: ACLConfigModel{Allow: []string{"192.0.2.0/24", "2001:db8::1"}},
+			allowed: map[string]bool{"192.0.2.7": true, "2001:db8::1": true, "198.51.100.1": false, "2001:db8::2": false}},
+		"deny list": {conf: ACLConfigModel{Deny: []string{"198.51.100.0/24"}},
+			allowed: map[string]bool{"192.0.2.7": true, "198.51.100.1": false}},
+		"deny overrides allow": {conf: ACLConfigModel{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25"}},
+			allowed: map[string]bool{"192.0.2.7": true, "192.0.2.200": false, "198.51.100.1": false}},
+	} {
+		acl_, err := NewACL(&tc.conf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for ip, allowed := range tc.allowed {
+			if acl_.Allowed(net.ParseIP(ip)) != allowed {
+				t.Errorf("%s: Allowed(%s) = %v", name, ip, !allowed)
+			}
+		}
+	}
+
+	acl_, err := NewACL(&ACLConfigModel{})
+	if err != nil || acl_ != nil || !acl_.Allowed(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("acl without lists: %v, %v", acl_, err)
+	}
+	if _, err = NewACL(&ACLConfigModel{Allow: []string{"192.0.2.0/33"}}); err == nil {
+		t.Fatal("invalid CIDR accepted")
+	}
+}
+
+func TestACL_ReloadFile(t *testing.T) {
+	file_ := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(file_, []byte("# local clients\n192.0.2.0/24\n\n198.51.100.7 # a host\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	acl_, err := NewACL(&ACLConfigModel{AllowFile: file_})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl_.CheckInterval = 0
+	if !acl_.Allowed(net.ParseIP("192.0.2.1")) || !acl_.Allowed(net.ParseIP("198.51.100.7")) ||
+		acl_.Allowed(net.ParseIP("203.0.113.1")) {
+		t.Fatal("allow file not applied")
+	}
+
+	// Invalid file is not applied.
+	if err = os.WriteFile(file_, []byte("203.0.113.0/33\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(file_, time.Now(), time.Now().Add(time.Second))
+	if !acl_.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Fatal("invalid allow file applied")
+	}
+
+	if err = os.WriteFile(file_, []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(file_, time.Now(), time.Now().Add(2*time.Second))
+	if acl_.Allowed(net.ParseIP("192.0.2.1")) || !acl_.Allowed(net.ParseIP("203.0.113.1")) {
+		t.Fatal("modified allow file not reloaded")
+	}
+
+	if _, err = NewACL(&ACLConfigModel{DenyFile: filepath.Join(t.TempDir(), "missing.txt")}); err == nil {
+		t.Fatal("missing deny file accepted")
+	}
+}
+
+func TestACL_EmptyAllowFile(t *testing.T) {
+	file_ := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(file_, []byte("# no client yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	acl_, err := NewACL(&ACLConfigModel{AllowFile: file_})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl_.CheckInterval = 0
+	if acl_.Allowed(net.ParseIP("192.0.2.1")) || acl_.Allowed(nil) {
+		t.Fatal("client allowed by empty allow file")
+	}
+
+	if err = os.WriteFile(file_, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(file_, time.Now(), time.Now().Add(time.Second))
+	if !acl_.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Fatal("allow file not reloaded")
+	}
+
+	// Cleared allow file allows no client again.
+	if err = os.WriteFile(file_, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(file_, time.Now(), time.Now().Add(2*time.Second))
+	if acl_.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Fatal("client allowed by cleared allow file")
+	}
+}
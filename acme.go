@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultACMECacheDir = "acme-cache"
+)
+
+// NewACMEManager creates manager issuing and renewing certificates of the configured domains, challenges
+// are answered by TLS-ALPN-01 on tls listeners on port 443, and by HTTP-01 if http_listen is configured.
+func NewACMEManager(conf *ACMEConfigModel) (m *autocert.Manager, err error) {
+	if len(conf.Domains) == 0 {
+		return nil, fmt.Errorf("acme domains must be specified")
+	}
+	m = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(FirstNonZero(conf.CacheDir, DefaultACMECacheDir)),
+		HostPolicy: autocert.HostWhitelist(conf.Domains...),
+		Email:      conf.Email,
+	}
+	if conf.DirectoryURL != "" || conf.CAFile != "" {
+		m.Client = &acme.Client{DirectoryURL: FirstNonZero(conf.DirectoryURL, autocert.DefaultACMEDirectory)}
+	}
+	if conf.CAFile != "" {
+		tlsConfig_, err := NewUpstreamTLSConfig(&UpstreamTLSConfigModel{CAFile: conf.CAFile})
+		if err != nil {
+			return nil, err
+		}
+		m.Client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig_, Proxy: http.ProxyFromEnvironment},
+			Timeout:   30 * time.Second,
+		}
+	}
+	return
+}
+
+// NewACMETLSConfig creates tls config of a listener serving certificates by m, the acme-tls/1 protocol is
+// negotiated for TLS-ALPN-01 challenges.
+func NewACMETLSConfig(m *autocert.Manager, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     append(append([]string{}, nextProtos...), acme.ALPNProto),
+	}
+}
+
+// NewACMEHTTPServer creates server answering HTTP-01 challenges on addr, other requests are redirected to
+// https.
+func NewACMEHTTPServer(m *autocert.Manager, addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	if _, err := NewACMEManager(&ACMEConfigModel{}); err == nil {
+		t.Error("expected error without domains")
+	}
+	pki_ := newTestPKI(t)
+	m_, err := NewACMEManager(&ACMEConfigModel{
+		Domains:      []string{"doh.example"},
+		DirectoryURL: "https://127.0.0.1:14000/dir",
+		CAFile:       pki_.caFile,
+		CacheDir:     t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m_.Client == nil || m_.Client.DirectoryURL != "https://127.0.0.1:14000/dir" {
+		t.Fatalf("acme client not configured: %+v", m_.Client)
+	}
+
+	// TLS-ALPN-01.
+	tlsConfig_ := NewACMETLSConfig(m_, DoTALPN)
+	if len(tlsConfig_.NextProtos) != 2 || tlsConfig_.NextProtos[0] != DoTALPN ||
+		tlsConfig_.NextProtos[1] != acme.ALPNProto {
+		t.Errorf("next protos = %v", tlsConfig_.NextProtos)
+	}
+	if _, err = tlsConfig_.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Error("expected error for domain not configured")
+	}
+
+	// HTTP-01.
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/.well-known/acme-challenge/unknown-token", http.StatusNotFound},
+		{"/dns-query", http.StatusFound},
+	} {
+		rec_ := httptest.NewRecorder()
+		m_.HTTPHandler(nil).ServeHTTP(rec_, httptest.NewRequest(http.MethodGet, "http://doh.example"+tc.path, nil))
+		if rec_.Code != tc.status {
+			t.Errorf("%s status = %d, want %d", tc.path, rec_.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	AdminReloadPath  = "/reload"
+	AdminMetricsPath = "/metrics"
+)
+
+type AdminReloadRsp struct {
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// NewAdminHandler serves administration endpoints, which should only be reachable from trusted hosts.
+func NewAdminHandler(reloader *ConfigReloader, metrics *MetricsRegistry) http.Handler {
+	mux_ := http.NewServeMux()
+	mux_.HandleFunc(AdminReloadPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rsp_, status_ := AdminReloadRsp{Changes: []string{}}, http.StatusOK
+		changes_, err := reloader.Reload()
+		if err != nil {
+			rsp_.Error, status_ = err.Error(), http.StatusInternalServerError
+		} else if changes_ != nil {
+			rsp_.Changes = changes_
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status_)
+		_ = json.NewEncoder(w).Encode(rsp_)
+	})
+	mux_.HandleFunc(AdminMetricsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", MetricsContentType)
+		_ = metrics.Write(w)
+	})
+	return mux_
+}
@@ -14,3 +14,10 @@ type Cache interface {
 	Get(key string) (val interface{}, ok bool)
 	Set(key string, val interface{}, ttl uint32)
 }
+
+// closeCache releases resources of cache if it holds any, cache may be nil.
+func closeCache(cache Cache) {
+	if closer_, ok := cache.(interface{ Close() }); ok {
+		closer_.Close()
+	}
+}
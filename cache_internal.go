@@ -24,3 +24,7 @@ func (cache *CacheInternal) Get(key string) (val interface{}, ok bool) {
 func (cache *CacheInternal) Set(key string, val interface{}, ttl uint32) {
 	cache.cacher.SetWithTTL(key, val, time.Second*time.Duration(ttl))
 }
+
+func (cache *CacheInternal) Close() {
+	cache.cacher.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ClientECSMapping maps clients in a private subnet to a public ECS subnet.
+type ClientECSMapping struct {
+	Client *net.IPNet
+	ECS    *net.IPNet
+}
+
+// ClientECS derives ECS ip of queries from the client address, like the DoH service's use_client_ip.
+type ClientECS struct {
+	PrefixV4 int
+	PrefixV6 int
+	Mappings []ClientECSMapping
+}
+
+// NewClientECS creates ClientECS of dns53 service, nil if use_client_ip is not enabled.
+func NewClientECS(conf *Dns53ConfigModel) (c *ClientECS, err error) {
+	if !conf.UseClientIP {
+		return nil, nil
+	}
+	c = &ClientECS{
+		PrefixV4: FirstNonZero(conf.ClientECSPrefixV4, ECSIPv4Mask),
+		PrefixV6: FirstNonZero(conf.ClientECSPrefixV6, ECSIPv6Mask),
+	}
+	// Prefixes longer than the default ECS source prefix would tell more of clients than other queries do.
+	if c.PrefixV4 < 0 || c.PrefixV4 > ECSIPv4Mask {
+		return nil, fmt.Errorf("client_ecs_prefix_v4 must be within 1-%d: %d", ECSIPv4Mask, c.PrefixV4)
+	}
+	if c.PrefixV6 < 0 || c.PrefixV6 > ECSIPv6Mask {
+		return nil, fmt.Errorf("client_ecs_prefix_v6 must be within 1-%d: %d", ECSIPv6Mask, c.PrefixV6)
+	}
+	for _, m := range conf.ClientECSMap {
+		_, client_, err := net.ParseCIDR(strings.TrimSpace(m.Client))
+		if err != nil {
+			return nil, fmt.Errorf("client_ecs_map client invalid: %s", m.Client)
+		}
+		_, ecs_, err := net.ParseCIDR(strings.TrimSpace(m.ECS))
+		if err != nil || IsPrivateIP(ecs_.IP) {
+			return nil, fmt.Errorf("client_ecs_map ecs invalid: %s", m.ECS)
+		}
+		c.Mappings = append(c.Mappings, ClientECSMapping{Client: client_, ECS: ecs_})
+	}
+	return
+}
+
+// ECS returns ECS subnet of client, which is of the prefix, or of the first mapping the client is in. Nil for
+// private clients not mapped.
+func (c *ClientECS) ECS(client net.IP) *net.IPNet {
+	if client == nil {
+		return nil
+	}
+	for _, m := range c.Mappings {
+		if m.Client.Contains(client) {
+			return m.ECS
+		}
+	}
+	if IsPrivateIP(client) {
+		return nil
+	}
+	if ip4_ := client.To4(); ip4_ != nil {
+		mask_ := net.CIDRMask(c.PrefixV4, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4_.Mask(mask_), Mask: mask_}
+	}
+	mask_ := net.CIDRMask(c.PrefixV6, 8*net.IPv6len)
+	return &net.IPNet{IP: client.To16().Mask(mask_), Mask: mask_}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var (
@@ -38,12 +40,16 @@ var (
 	}
 
 	NamesInJailConfig = map[string][]*regexp.Regexp{}
+	namesInJailMu     sync.RWMutex
 )
 
 const (
-	RelayUpstreamProtoDoh   = "doh"
-	RelayUpstreamProtoJson  = "doh_json"
-	RelayUpstreamProtoDns53 = "dns53"
+	RelayUpstreamProtoDoh       = "doh"
+	RelayUpstreamProtoJson      = "doh_json"
+	RelayUpstreamProtoDns53     = "dns53"
+	RelayUpstreamProtoODoh      = "odoh"
+	RelayUpstreamProtoDNSCrypt  = "dnscrypt"
+	RelayUpstreamProtoRecursive = "recursive"
 )
 
 type UpstreamType string
@@ -54,8 +60,77 @@ type NameInJailConfigModel struct {
 }
 
 type FixedResolvingConfigModel struct {
-	NameRegex string `yaml:"name_regex"`
-	Server    string `yaml:"server"`
+	NameRegex string                  `yaml:"name_regex"`
+	Server    string                  `yaml:"server"`
+	Proxy     string                  `yaml:"proxy"`
+	TLS       *UpstreamTLSConfigModel `yaml:"tls"`
+}
+
+// ClientECSMapConfigModel maps clients in a private subnet to a public ECS subnet, like 192.168.0.0/16 to
+// 203.0.113.0/24.
+type ClientECSMapConfigModel struct {
+	Client string `yaml:"client"`
+	ECS    string `yaml:"ecs"`
+}
+
+// ACLConfigModel lists ips and CIDRs of clients allowed or denied, inline or in files of one per line.
+type ACLConfigModel struct {
+	Allow     []string `yaml:"allow"`
+	Deny      []string `yaml:"deny"`
+	AllowFile string   `yaml:"allow_file"`
+	DenyFile  string   `yaml:"deny_file"`
+}
+
+// RateLimitConfigModel limits queries of every client subnet by a token bucket, not limited if rate is 0.
+type RateLimitConfigModel struct {
+	// Rate is queries per second refilling the bucket of burst queries, burst defaults to rate.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// PrefixV4 and PrefixV6 group clients by subnet, default to single addresses.
+	PrefixV4 int `yaml:"prefix_v4"`
+	PrefixV6 int `yaml:"prefix_v6"`
+}
+
+// RRLConfigModel is Response Rate Limiting of udp replies like BIND's, not limited if all rates are 0. Rates of
+// nodata, nxdomains and errors default to responses_per_second.
+type RRLConfigModel struct {
+	ResponsesPerSecond int `yaml:"responses_per_second"`
+	NodataPerSecond    int `yaml:"nodata_per_second"`
+	NxdomainsPerSecond int `yaml:"nxdomains_per_second"`
+	ErrorsPerSecond    int `yaml:"errors_per_second"`
+	Window             int `yaml:"window"`
+	// Slip sends every slip-th response over limit as truncated reply and drops others, 0 drops all, default 2.
+	Slip *int `yaml:"slip"`
+	// PrefixV4 and PrefixV6 group clients by subnet, default to 24 and 56.
+	PrefixV4 int `yaml:"prefix_v4"`
+	PrefixV6 int `yaml:"prefix_v6"`
+}
+
+type ACMEConfigModel struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	DirectoryURL string   `yaml:"directory_url"`
+	// CAFile to trust the directory server, for testing against a local CA.
+	CAFile     string `yaml:"ca_file"`
+	CacheDir   string `yaml:"cache_dir"`
+	HTTPListen string `yaml:"http_listen"`
+}
+
+type ODoHServiceConfigModel struct {
+	Target         bool     `yaml:"target"`
+	KeyRotation    int      `yaml:"key_rotation"`
+	Proxy          bool     `yaml:"proxy"`
+	ProxyPath      string   `yaml:"proxy_path"`
+	AllowedTargets []string `yaml:"allowed_targets"`
+}
+
+type UpstreamTLSConfigModel struct {
+	CAFile     string   `yaml:"ca_file"`
+	CertFile   string   `yaml:"cert_file"`
+	KeyFile    string   `yaml:"key_file"`
+	ServerName string   `yaml:"server_name"`
+	SPKIPins   []string `yaml:"spki_pins"`
+	MinVersion string   `yaml:"min_version"`
 }
 
 type Dns53ConfigModel struct {
@@ -64,10 +139,38 @@ type Dns53ConfigModel struct {
 	Upstream         string                      `yaml:"upstream"`
 	UpstreamFallback string                      `yaml:"upstream_fallback"`
 	UpstreamProto    string                      `yaml:"upstream_proto"`
+	UpstreamProxy    string                      `yaml:"upstream_proxy"`
+	UpstreamTLS      *UpstreamTLSConfigModel     `yaml:"upstream_tls"`
 	EcsIP1st         string                      `yaml:"1st_ecs_ip"`
 	EcsIP2nd         string                      `yaml:"2nd_ecs_ip"`
 	UseClientIP      bool                        `yaml:"use_client_ip"`
 	FixedResolving   []FixedResolvingConfigModel `yaml:"fixed_resolving"`
+	TLSCertFile      string                      `yaml:"tls_cert_file"`
+	TLSKeyFile       string                      `yaml:"tls_key_file"`
+	IdleTimeout      int                         `yaml:"idle_timeout"`
+	DNSCrypt         DNSCryptServiceConfigModel  `yaml:"dnscrypt"`
+	// ClientECSPrefixV4 and ClientECSPrefixV6 truncate client addresses used as ECS if use_client_ip.
+	ClientECSPrefixV4 int                       `yaml:"client_ecs_prefix_v4"`
+	ClientECSPrefixV6 int                       `yaml:"client_ecs_prefix_v6"`
+	ClientECSMap      []ClientECSMapConfigModel `yaml:"client_ecs_map"`
+	// ProxyProtocol enables PROXY protocol from trusted proxies on udp (v2), tcp and tls listeners.
+	ProxyProtocol  bool     `yaml:"proxy_protocol"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// MaxUDPSize caps EDNS udp buffer size of clients, replies over it are truncated.
+	MaxUDPSize int `yaml:"max_udp_size"`
+	// ACL of clients, refused if not allowed.
+	ACL       ACLConfigModel       `yaml:"acl"`
+	RateLimit RateLimitConfigModel `yaml:"rate_limit"`
+	RRL       RRLConfigModel       `yaml:"rrl"`
+}
+
+type DNSCryptServiceConfigModel struct {
+	ProviderName    string `yaml:"provider_name"`
+	ProviderKeyFile string `yaml:"provider_key_file"`
+	// Possible value: xsalsa20poly1305, xchacha20poly1305
+	EsVersion string `yaml:"es_version"`
+	CertTTL   int    `yaml:"cert_ttl"`
+	StampAddr string `yaml:"stamp_addr"`
 }
 
 type DohConfigModel struct {
@@ -76,14 +179,55 @@ type DohConfigModel struct {
 	Upstream         string                      `yaml:"upstream"`
 	UpstreamFallback string                      `yaml:"upstream_fallback"`
 	UpstreamProto    string                      `yaml:"upstream_proto"`
+	UpstreamProxy    string                      `yaml:"upstream_proxy"`
+	UpstreamTLS      *UpstreamTLSConfigModel     `yaml:"upstream_tls"`
 	Path             string                      `yaml:"path"`
 	EcsIP1st         string                      `yaml:"1st_ecs_ip"`
 	EcsIP2nd         string                      `yaml:"2nd_ecs_ip"`
 	UseTls           bool                        `yaml:"use_tls"`
 	TLSCertFile      string                      `yaml:"tls_cert_file"`
 	TLSKeyFile       string                      `yaml:"tls_key_file"`
+	HTTP3            bool                        `yaml:"http3"`
+	ODoH             ODoHServiceConfigModel      `yaml:"odoh"`
 	UseClientIP      bool                        `yaml:"use_client_ip"`
 	FixedResolving   []FixedResolvingConfigModel `yaml:"fixed_resolving"`
+	// MaxBodySize limits query messages in bytes, default to 65535.
+	MaxBodySize int `yaml:"max_body_size"`
+	// CORSAllowedOrigins are origins of browser clients allowed to query, "*" for any.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	// ProxyProtocol enables PROXY protocol from trusted proxies on listeners.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// TrustedProxies are ips and CIDRs of proxies, of which PROXY protocol headers and client ip headers are
+	// trusted.
+	TrustedProxies  []string `yaml:"trusted_proxies"`
+	ClientIPHeaders []string `yaml:"client_ip_headers"`
+	// ACL of clients, answered 403 if not allowed.
+	ACL       ACLConfigModel       `yaml:"acl"`
+	RateLimit RateLimitConfigModel `yaml:"rate_limit"`
+	// Auth authenticates clients by tokens, each mapped to a profile.
+	Auth DohAuthConfigModel `yaml:"auth"`
+}
+
+// DohAuthConfigModel authenticates DoH clients by bearer tokens, or tokens embedded in the path.
+type DohAuthConfigModel struct {
+	// Required answers 401 to queries without token, otherwise they are served as without auth.
+	Required bool                    `yaml:"required"`
+	Profiles []DohProfileConfigModel `yaml:"profiles"`
+}
+
+// DohProfileConfigModel is what queries with any of its tokens are served with, upstreams and ecs ips default to
+// the doh service's. Its acl and rate limit apply besides the service's.
+type DohProfileConfigModel struct {
+	Name             string                      `yaml:"name"`
+	Tokens           []string                    `yaml:"tokens"`
+	Upstream         string                      `yaml:"upstream"`
+	UpstreamFallback string                      `yaml:"upstream_fallback"`
+	UpstreamProto    string                      `yaml:"upstream_proto"`
+	FixedResolving   []FixedResolvingConfigModel `yaml:"fixed_resolving"`
+	EcsIP1st         string                      `yaml:"1st_ecs_ip"`
+	EcsIP2nd         string                      `yaml:"2nd_ecs_ip"`
+	ACL              ACLConfigModel              `yaml:"acl"`
+	RateLimit        RateLimitConfigModel        `yaml:"rate_limit"`
 }
 
 type ConfigModel struct {
@@ -97,24 +241,51 @@ type ConfigModel struct {
 	IPv6Answer           bool                    `yaml:"ipv6_answer"`
 	NamesInJail          []NameInJailConfigModel `yaml:"names_in_jail"`
 	UpstreamHostResolver string                  `yaml:"upstream_host_resolver"`
+	UpstreamProxy        string                  `yaml:"upstream_proxy"`
+	UpstreamTLS          *UpstreamTLSConfigModel `yaml:"upstream_tls"`
+	ForwardEdns0Options  []uint16                `yaml:"forward_edns0_options"`
+	ACME                 ACMEConfigModel         `yaml:"acme"`
+	// ShutdownTimeout is how many seconds queries in flight are waited for on shutdown.
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	// AdminListen is where admin endpoints are served, not served if empty.
+	AdminListen string `yaml:"admin_listen"`
 }
 
 func ReadConfigFromFile(path string) (config ConfigModel) {
-	file, err := os.ReadFile(path)
+	config, err := LoadConfigFromFile(path)
 	if err != nil {
-		fmt.Println("Read file error:", err)
+		fmt.Println(err)
 		panic(err)
 	}
-	err = yaml.Unmarshal(file, &config)
+	ExecConfig = config
+	namesInJail_, err := NewNamesInJailConfig(ExecConfig.NamesInJail)
 	if err != nil {
-		fmt.Println("Unmarshal config file error:", err)
-		panic(err)
+		fmt.Println("Compile regex error:", err)
 	}
-	ExecConfig = config
-	for _, nameInJail := range ExecConfig.NamesInJail {
-		regexp_, err := regexp.Compile(nameInJail.NameRegex)
-		if err != nil {
-			fmt.Println("Compile regex error:", err)
+	SetNamesInJailConfig(namesInJail_)
+	return
+}
+
+// LoadConfigFromFile reads config file without applying it.
+func LoadConfigFromFile(path string) (config ConfigModel, err error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("read file error: %v", err)
+	}
+	if err = yaml.Unmarshal(file, &config); err != nil {
+		return config, fmt.Errorf("unmarshal config file error: %v", err)
+	}
+	return
+}
+
+// NewNamesInJailConfig groups name regexes by country code, names with invalid regex are skipped and reported
+// by err.
+func NewNamesInJailConfig(conf []NameInJailConfigModel) (namesInJail map[string][]*regexp.Regexp, err error) {
+	namesInJail = map[string][]*regexp.Regexp{}
+	for _, nameInJail := range conf {
+		regexp_, errCompile := regexp.Compile(nameInJail.NameRegex)
+		if errCompile != nil {
+			err = errCompile
 			continue
 		}
 		countryCodes_ := strings.Split(nameInJail.CountryCodes, ",")
@@ -123,17 +294,91 @@ func ReadConfigFromFile(path string) (config ConfigModel) {
 			if countryCode == "" {
 				continue
 			}
-			if _, ok := NamesInJailConfig[countryCode]; !ok {
-				NamesInJailConfig[countryCode] = []*regexp.Regexp{}
-			}
-			NamesInJailConfig[countryCode] = append(NamesInJailConfig[countryCode], regexp_)
+			namesInJail[countryCode] = append(namesInJail[countryCode], regexp_)
 		}
 	}
 	return
 }
 
+// SetNamesInJailConfig swaps in names in jail, checks in progress finish on the previous ones.
+func SetNamesInJailConfig(namesInJail map[string][]*regexp.Regexp) {
+	namesInJailMu.Lock()
+	defer namesInJailMu.Unlock()
+	NamesInJailConfig = namesInJail
+}
+
+// ValidateConfig checks settings which are reloadable, so that a broken config file is not applied.
+func ValidateConfig(config *ConfigModel) error {
+	if _, err := NewNamesInJailConfig(config.NamesInJail); err != nil {
+		return fmt.Errorf("names_in_jail: %v", err)
+	}
+	if _, err := NewClientECS(&config.Dns53Config); err != nil {
+		return fmt.Errorf("dns53: %v", err)
+	}
+	if _, err := NewRRL(&config.Dns53Config.RRL); err != nil {
+		return fmt.Errorf("dns53: %v", err)
+	}
+	if size_ := config.Dns53Config.MaxUDPSize; size_ != 0 && (size_ < dns.MinMsgSize || size_ > dns.MaxMsgSize) {
+		return fmt.Errorf("dns53.max_udp_size must be within %d-%d: %d", dns.MinMsgSize, dns.MaxMsgSize, size_)
+	}
+	if _, err := NewDohAuth(&config.DohConfig.Auth, nil); err != nil {
+		return fmt.Errorf("doh: %v", err)
+	}
+	type svcConfig struct {
+		upstreamProto  string
+		ecsIPs         []string
+		fixedResolving []FixedResolvingConfigModel
+		trustedProxies []string
+		acl            *ACLConfigModel
+		rateLimit      *RateLimitConfigModel
+	}
+	svcConfigs_ := map[string]svcConfig{
+		"dns53": {config.Dns53Config.UpstreamProto, []string{config.Dns53Config.EcsIP1st, config.Dns53Config.EcsIP2nd},
+			config.Dns53Config.FixedResolving, config.Dns53Config.TrustedProxies, &config.Dns53Config.ACL,
+			&config.Dns53Config.RateLimit},
+		"doh": {config.DohConfig.UpstreamProto, []string{config.DohConfig.EcsIP1st, config.DohConfig.EcsIP2nd},
+			config.DohConfig.FixedResolving, config.DohConfig.TrustedProxies, &config.DohConfig.ACL,
+			&config.DohConfig.RateLimit},
+	}
+	for i := range config.DohConfig.Auth.Profiles {
+		profile_ := &config.DohConfig.Auth.Profiles[i]
+		svcConfigs_["doh.auth profile "+profile_.Name] = svcConfig{profile_.UpstreamProto,
+			[]string{profile_.EcsIP1st, profile_.EcsIP2nd}, profile_.FixedResolving, nil, &profile_.ACL,
+			&profile_.RateLimit}
+	}
+	for svc, conf := range svcConfigs_ {
+		if conf.upstreamProto != "" && !SliceContains([]string{RelayUpstreamProtoDoh, RelayUpstreamProtoJson,
+			RelayUpstreamProtoDns53, RelayUpstreamProtoODoh, RelayUpstreamProtoDNSCrypt,
+			RelayUpstreamProtoRecursive}, conf.upstreamProto) {
+			return fmt.Errorf("%s.upstream_proto invalid: %s", svc, conf.upstreamProto)
+		}
+		for _, ip := range strings.Split(strings.Join(conf.ecsIPs, ","), ",") {
+			if ip = strings.TrimSpace(ip); ip != "" && ObtainIPFromString(ip) == nil {
+				return fmt.Errorf("%s ecs ip invalid: %s", svc, ip)
+			}
+		}
+		if _, err := ParseIPNets(conf.trustedProxies); err != nil {
+			return fmt.Errorf("%s.trusted_proxies: %v", svc, err)
+		}
+		if _, err := NewACL(conf.acl); err != nil {
+			return fmt.Errorf("%s: %v", svc, err)
+		}
+		if _, err := NewRateLimiter(conf.rateLimit); err != nil {
+			return fmt.Errorf("%s: %v", svc, err)
+		}
+		for _, f := range conf.fixedResolving {
+			if _, err := regexp.Compile(f.NameRegex); err != nil {
+				return fmt.Errorf("%s.fixed_resolving name_regex invalid: %v", svc, err)
+			}
+		}
+	}
+	return nil
+}
+
 func IsNameInJailOfCountry(name, countryCode string) bool {
+	namesInJailMu.RLock()
 	regexps_, ok := NamesInJailConfig[countryCode]
+	namesInJailMu.RUnlock()
 	if !ok {
 		return false
 	}
@@ -3,10 +3,25 @@ package main
 import (
 	"github.com/miekg/dns"
 	"strings"
+	"sync"
 )
 
+// DefaultDns53MaxUDPSize is the max udp reply size by default, as recommended by DNS flag day 2020.
+const DefaultDns53MaxUDPSize = 1232
+
 type Dns53Handler struct {
 	DefaultECSIPs []string
+	// ClientECS derives ECS from client addresses, not derived if nil.
+	ClientECS *ClientECS
+	// MaxUDPSize caps EDNS udp buffer size of clients, DefaultDns53MaxUDPSize if 0.
+	MaxUDPSize uint16
+	// ACL of clients, any client is allowed if nil.
+	ACL *ACL
+	// RateLimiter limits queries of clients, not limited if nil.
+	RateLimiter *RateLimiter
+	// RRL limits udp responses to clients, not limited if nil.
+	RRL *RRL
+	mu  sync.RWMutex
 }
 
 func NewDns53Handler() (h *Dns53Handler) {
@@ -17,6 +32,8 @@ func NewDns53Handler() (h *Dns53Handler) {
 }
 
 func (h *Dns53Handler) AppendDefaultECSIPStr(ipStr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if ip := ObtainIPFromString(ipStr); ip != nil &&
 		!SliceContains(h.DefaultECSIPs, ip.String()) &&
 		!IsPrivateIP(ip) {
@@ -26,6 +43,8 @@ func (h *Dns53Handler) AppendDefaultECSIPStr(ipStr string) {
 }
 
 func (h *Dns53Handler) InsertDefaultECSIPStr(ipStr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if ip := ObtainIPFromString(ipStr); ip != nil &&
 		!SliceContains(h.DefaultECSIPs, ip.String()) &&
 		!IsPrivateIP(ip) {
@@ -34,17 +53,141 @@ func (h *Dns53Handler) InsertDefaultECSIPStr(ipStr string) {
 	}
 }
 
+// SetDefaultECSIPs replaces default ECS ips, queries in progress keep the previous ones.
+func (h *Dns53Handler) SetDefaultECSIPs(ips []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.DefaultECSIPs = ips
+}
+
+func (h *Dns53Handler) defaultECSIPs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.DefaultECSIPs
+}
+
+// SetClientECS replaces how ECS is derived from client addresses, nil to not derive.
+func (h *Dns53Handler) SetClientECS(c *ClientECS) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ClientECS = c
+}
+
+func (h *Dns53Handler) clientECS() *ClientECS {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ClientECS
+}
+
+// SetACL replaces ACL of clients, nil to allow any client.
+func (h *Dns53Handler) SetACL(acl *ACL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ACL = acl
+}
+
+func (h *Dns53Handler) acl() *ACL {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ACL
+}
+
+// SetRateLimiter replaces rate limiter of client queries, nil to not limit.
+func (h *Dns53Handler) SetRateLimiter(l *RateLimiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.RateLimiter = l
+}
+
+func (h *Dns53Handler) rateLimiter() *RateLimiter {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.RateLimiter
+}
+
+// SetRRL replaces response rate limiting of udp responses, nil to not limit.
+func (h *Dns53Handler) SetRRL(r *RRL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.RRL = r
+}
+
+func (h *Dns53Handler) rrl() *RRL {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.RRL
+}
+
+func (h *Dns53Handler) maxUDPSize() uint16 {
+	return FirstNonZero(h.MaxUDPSize, DefaultDns53MaxUDPSize)
+}
+
+// responseEmpty writes reply of rCode without records, options of the query are not echoed.
 func (h *Dns53Handler) responseEmpty(w dns.ResponseWriter, msgReq *dns.Msg, rCode int) {
-	msgReq.Response = true
-	msgReq.Rcode = rCode
-	err := w.WriteMsg(msgReq)
-	if err != nil {
-		return
+	h.writeRsp(w, msgReq, new(dns.Msg).SetRcode(msgReq, rCode))
+}
+
+// writeRsp writes reply to msgReq with OPT record for EDNS clients only. Replies on udp are limited by RRL and
+// truncated to the client's buffer size.
+func (h *Dns53Handler) writeRsp(w dns.ResponseWriter, msgReq, msgRsp *dns.Msg) {
+	udp_ := isUDPResponseWriter(w)
+	if udp_ {
+		switch action_, class_ := h.rrl().Check(AddrIP(w.RemoteAddr()), msgRsp); action_ {
+		case RRLDrop:
+			rrlCounter(class_, "drop").Inc()
+			return
+		case RRLSlip:
+			rrlCounter(class_, "slip").Inc()
+			msgRsp = new(dns.Msg).SetReply(msgReq)
+			msgRsp.Truncated = true
+		}
 	}
-	return
+	optReq_ := msgReq.IsEdns0()
+	SetReplyOPT(msgRsp, optReq_, h.maxUDPSize())
+	if udp_ {
+		msgRsp.Truncate(UDPReplySize(optReq_, h.maxUDPSize()))
+	}
+	if err := w.WriteMsg(msgRsp); err != nil {
+		log.Error(err)
+	}
+}
+
+// checkQuery returns FORMERR for queries without exactly one question or with multiple OPT records, BADVERS for
+// EDNS versions other than 0.
+func (h *Dns53Handler) checkQuery(msgReq *dns.Msg) (rCode int) {
+	optCount_ := 0
+	for _, rr := range msgReq.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			optCount_++
+		}
+	}
+	if len(msgReq.Question) != 1 || optCount_ > 1 {
+		return dns.RcodeFormatError
+	}
+	if opt_ := msgReq.IsEdns0(); opt_ != nil && opt_.Version() != 0 {
+		return dns.RcodeBadVers
+	}
+	return dns.RcodeSuccess
 }
 
 func (h *Dns53Handler) ServeDNS(w dns.ResponseWriter, msgReq *dns.Msg) {
+	if !h.acl().Allowed(AddrIP(w.RemoteAddr())) {
+		log.Debugf("dns53 query from %s refused by acl", w.RemoteAddr())
+		h.responseEmpty(w, msgReq, dns.RcodeRefused)
+		return
+	}
+	// Queries over limit are dropped on udp, so that replies are not reflected.
+	if !h.rateLimiter().Allow(AddrIP(w.RemoteAddr())) {
+		rateLimitedCounter("dns53").Inc()
+		if !isUDPResponseWriter(w) {
+			h.responseEmpty(w, msgReq, dns.RcodeRefused)
+		}
+		return
+	}
+	if rCode_ := h.checkQuery(msgReq); rCode_ != dns.RcodeSuccess {
+		h.responseEmpty(w, msgReq, rCode_)
+		return
+	}
 	// Ignore AAAA Question when configured to not answer
 	if len(msgReq.Question) > 0 && msgReq.Question[0].Qtype == dns.TypeAAAA && !ExecConfig.IPv6Answer {
 		h.responseEmpty(w, msgReq, dns.RcodeSuccess)
@@ -59,24 +202,81 @@ func (h *Dns53Handler) ServeDNS(w dns.ResponseWriter, msgReq *dns.Msg) {
 	if ecs_ != nil && ecs_.Address != nil && !IsPrivateIP(ecs_.Address) {
 		tryEcsIPs_ = append(tryEcsIPs_, ecs_.Address.String())
 	}
-	tryEcsIPs_ = append(tryEcsIPs_, h.DefaultECSIPs...)
+	// Client address.
+	if clientECS_ := h.clientECS(); clientECS_ != nil {
+		if subnet := clientECS_.ECS(AddrIP(w.RemoteAddr())); subnet != nil {
+			tryEcsIPs_ = append(tryEcsIPs_, subnet.String())
+		}
+	}
+	tryEcsIPs_ = append(tryEcsIPs_, h.defaultECSIPs()...)
 
-	msgRsp_, err := Dns53Answerer.Answer(msgReq, strings.Join(tryEcsIPs_, ","))
+	msgRsp_, err := CurrentDns53Answerer().Answer(msgReq, strings.Join(tryEcsIPs_, ","))
 	defer func() { msgRsp_ = nil }()
 	if err != nil || msgRsp_ == nil {
 		log.Errorf("error when resolving %+v: %+v", msgReq.Question, err)
-		h.responseEmpty(w, msgReq, dns.RcodeRefused)
+		h.responseEmpty(w, msgReq, dns.RcodeServerFailure)
 		return
 	}
 	// Restore request ECS.
 	if ecs_ == nil {
 		RemoveECSInDnsMsg(msgRsp_)
 	} else {
-		ChangeECSInDnsMsg(msgRsp_, &ecs_.Address)
+		ChangeECSInDnsMsg(msgRsp_, SubnetOfECS(ecs_))
 	}
-	err = w.WriteMsg(msgRsp_)
-	if err != nil {
-		log.Error(err)
+	h.writeRsp(w, msgReq, msgRsp_)
+}
+
+// isUDPResponseWriter tells if replies are written to udp, DNSCrypt over udp included so that its replies are
+// limited by RRL too. DNS-over-QUIC streams are not.
+func isUDPResponseWriter(w dns.ResponseWriter) bool {
+	switch w_ := w.(type) {
+	case *doqResponseWriter:
+		return false
+	case *dnscryptResponseWriter:
+		return w_.udp
+	}
+	return w.LocalAddr() != nil && w.LocalAddr().Network() == "udp"
+}
+
+// UDPReplySize returns size of udp replies to clients advertising optReq, 512 for clients without EDNS.
+func UDPReplySize(optReq *dns.OPT, maxUDPSize uint16) int {
+	if optReq == nil {
+		return dns.MinMsgSize
+	}
+	size_ := int(optReq.UDPSize())
+	if size_ < dns.MinMsgSize {
+		size_ = dns.MinMsgSize
+	}
+	if size_ > int(maxUDPSize) {
+		size_ = int(maxUDPSize)
+	}
+	return size_
+}
+
+// SetReplyOPT replaces OPT records of reply msg by one of our own for EDNS clients advertising optReq, carrying
+// options of the reply, which NewReplyOPT has filtered, and DO of the query, or removes them for other clients.
+func SetReplyOPT(msg *dns.Msg, optReq *dns.OPT, maxUDPSize uint16) {
+	var options_ []dns.EDNS0
+	extra_ := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		opt_, ok := rr.(*dns.OPT)
+		if !ok {
+			extra_ = append(extra_, rr)
+			continue
+		}
+		options_ = opt_.Option
+	}
+	msg.Extra = extra_
+	if optReq == nil {
+		// Extended rcodes can't be sent without OPT.
+		if msg.Rcode > 0xf {
+			msg.Rcode = dns.RcodeServerFailure
+		}
 		return
 	}
+	opt_ := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt_.SetUDPSize(maxUDPSize)
+	opt_.SetDo(optReq.Do())
+	opt_.Option = options_
+	msg.Extra = append(msg.Extra, opt_)
 }
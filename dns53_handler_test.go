@@ -0,0 +1,369 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDns53Server serves Dns53Handler on a local udp port.
+func newTestDns53Server(t *testing.T, h *Dns53Handler) (addr string) {
+	pc_, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ := &dns.Server{PacketConn: pc_, Handler: dns.HandlerFunc(h.ServeDNS)}
+	go func() { _ = server_.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server_.Shutdown() })
+	return pc_.LocalAddr().String()
+}
+
+func TestDns53Handler_Rcode(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, rcodeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+	addr_ := newTestDns53Server(t, NewDns53Handler())
+
+	for name, rCode := range rcodeTestNames {
+		t.Run(name, func(t *testing.T) {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			msgReq_.SetEdns0(1232, false)
+			msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Rcode != rCode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[msgRsp_.Rcode], dns.RcodeToString[rCode])
+			}
+		})
+	}
+
+	// Extended RCODE can't reach non-EDNS clients.
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("badcookie.test.", dns.TypeA)
+	msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgRsp_.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[msgRsp_.Rcode])
+	}
+}
+
+func TestClientECS_ECS(t *testing.T) {
+	clientECS_, err := NewClientECS(&Dns53ConfigModel{UseClientIP: true, ClientECSPrefixV4: 16,
+		ClientECSMap: []ClientECSMapConfigModel{{Client: "192.168.0.0/16", ECS: "203.0.113.0/24"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, ecs := range map[string]string{
+		"198.51.100.7":    "198.51.0.0/16",
+		"2001:db8:1:2::7": "2001:db8:1::/56",
+		"192.168.1.7":     "203.0.113.0/24",
+		"10.0.0.7":        "<nil>",
+	} {
+		if subnet_ := clientECS_.ECS(net.ParseIP(client)); subnet_.String() != ecs {
+			t.Errorf("ECS(%s) = %v, want %s", client, subnet_, ecs)
+		}
+	}
+
+	for _, conf := range []Dns53ConfigModel{
+		{UseClientIP: true, ClientECSPrefixV4: 32},
+		{UseClientIP: true, ClientECSMap: []ClientECSMapConfigModel{{Client: "10.0.0.0/8", ECS: "192.168.0.0/24"}}},
+		{UseClientIP: true, ClientECSMap: []ClientECSMapConfigModel{{Client: "10.0.0.0", ECS: "203.0.113.0/24"}}},
+	} {
+		if _, err = NewClientECS(&conf); err == nil {
+			t.Errorf("config accepted: %+v", conf)
+		}
+	}
+}
+
+func TestDns53Handler_ClientECS(t *testing.T) {
+	InitGeoipReader("")
+	upstreamECS_ := make(chan string, 1)
+	dohSrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		ecs_ := "<nil>"
+		if e := ObtainECS(msgReq); e != nil {
+			ecs_ = SubnetOfECS(e).String()
+		}
+		select {
+		case upstreamECS_ <- ecs_:
+		default:
+		}
+		return fakeAnswer(msgReq)
+	})
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		nil, nil), nil, nil)
+	h_ := NewDns53Handler()
+	addr_ := newTestDns53Server(t, h_)
+	exchange_ := func(name string) string {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion(name, dns.TypeA)
+		if _, _, err := new(dns.Client).Exchange(msgReq_, addr_); err != nil {
+			t.Fatal(err)
+		}
+		return <-upstreamECS_
+	}
+
+	// Loopback client is private, ECS is derived only if mapped.
+	if ecs_ := exchange_("a.example."); ecs_ != "<nil>" {
+		t.Fatalf("ecs of private client: %s", ecs_)
+	}
+	// Source prefix length of the mapped subnet is sent upstream.
+	clientECS_, err := NewClientECS(&Dns53ConfigModel{UseClientIP: true,
+		ClientECSMap: []ClientECSMapConfigModel{{Client: "127.0.0.0/8", ECS: "203.0.112.0/20"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h_.SetClientECS(clientECS_)
+	if ecs_ := exchange_("b.example."); ecs_ != "203.0.112.0/20" {
+		t.Fatalf("ecs of mapped client: %s", ecs_)
+	}
+}
+
+func TestDns53Handler_UDPSize(t *testing.T) {
+	txtAnswer_ := func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := new(dns.Msg)
+		msgRsp_.SetReply(msgReq)
+		for i := 0; i < 20; i++ {
+			msgRsp_.Answer = append(msgRsp_.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: msgReq.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat(strconv.Itoa(i%10), 100)},
+			})
+		}
+		return msgRsp_
+	}
+	dohSrv_ := newFakeDohUpstream(t, txtAnswer_)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	addr_ := newTestDns53Server(t, NewDns53Handler())
+	largeHandler_ := NewDns53Handler()
+	largeHandler_.MaxUDPSize = 4096
+	largeAddr_ := newTestDns53Server(t, largeHandler_)
+	tcpListener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer_ := &dns.Server{Listener: tcpListener_, Handler: dns.HandlerFunc(NewDns53Handler().ServeDNS)}
+	go func() { _ = tcpServer_.ActivateAndServe() }()
+	t.Cleanup(func() { _ = tcpServer_.Shutdown() })
+
+	tests := []struct {
+		name      string
+		addr      string
+		net       string
+		ednsSize  uint16
+		wantTC    bool
+		wantSize  int
+		wantOptSz uint16
+	}{
+		{name: "no edns", addr: addr_, wantTC: true, wantSize: dns.MinMsgSize},
+		{name: "edns capped", addr: addr_, ednsSize: 4096, wantTC: true, wantSize: 1232, wantOptSz: 1232},
+		{name: "edns small", addr: largeAddr_, ednsSize: 1024, wantTC: true, wantSize: 1024, wantOptSz: 4096},
+		{name: "edns fits", addr: largeAddr_, ednsSize: 4096, wantSize: 4096, wantOptSz: 4096},
+		{name: "tcp", addr: tcpListener_.Addr().String(), net: "tcp", ednsSize: 512, wantSize: dns.MaxMsgSize,
+			wantOptSz: 1232},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion("large.test.", dns.TypeTXT)
+			if tt.ednsSize != 0 {
+				msgReq_.SetEdns0(tt.ednsSize, true)
+			}
+			msgRsp_, _, err := (&dns.Client{Net: tt.net}).Exchange(msgReq_, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Truncated != tt.wantTC {
+				t.Errorf("truncated = %v, want %v", msgRsp_.Truncated, tt.wantTC)
+			}
+			if tt.wantTC && len(msgRsp_.Answer) == 20 || !tt.wantTC && len(msgRsp_.Answer) != 20 {
+				t.Errorf("answers: %d", len(msgRsp_.Answer))
+			}
+			msgRsp_.Compress = true
+			if msgRsp_.Len() > tt.wantSize {
+				t.Errorf("size = %d, want at most %d", msgRsp_.Len(), tt.wantSize)
+			}
+			opt_ := msgRsp_.IsEdns0()
+			if tt.wantOptSz == 0 && opt_ != nil {
+				t.Errorf("opt in reply to non-EDNS client: %v", opt_)
+			}
+			if tt.wantOptSz != 0 && (opt_ == nil || opt_.UDPSize() != tt.wantOptSz || !opt_.Do()) {
+				t.Errorf("opt = %v, want udp size %d with DO", opt_, tt.wantOptSz)
+			}
+		})
+	}
+}
+
+func TestDns53Handler_EDNSErrors(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	addr_ := newTestDns53Server(t, NewDns53Handler())
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReq_.SetEdns0(1232, false)
+	msgReq_.IsEdns0().SetVersion(1)
+	msgReq_.IsEdns0().Option = append(msgReq_.IsEdns0().Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgRsp_.Rcode != dns.RcodeBadVers || msgRsp_.IsEdns0() == nil || msgRsp_.IsEdns0().Version() != 0 {
+		t.Errorf("unsupported edns version: rcode %s, opt %v", dns.RcodeToString[msgRsp_.Rcode], msgRsp_.IsEdns0())
+	}
+	// Options of the query, like the client cookie, are not echoed.
+	if opt_ := msgRsp_.IsEdns0(); opt_ != nil && len(opt_.Option) > 0 {
+		t.Errorf("unsupported edns version: reply options %v", opt_.Option)
+	}
+
+	msgReq_ = new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReq_.SetEdns0(1232, false)
+	msgReq_.SetEdns0(1232, false)
+	if msgRsp_, _, err = new(dns.Client).Exchange(msgReq_, addr_); err != nil {
+		t.Fatal(err)
+	}
+	if msgRsp_.Rcode != dns.RcodeFormatError {
+		t.Errorf("multiple opt: rcode %s, want FORMERR", dns.RcodeToString[msgRsp_.Rcode])
+	}
+}
+
+func TestDns53Handler_ReplyOptions(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := fakeAnswer(msgReq)
+		msgRsp_.SetEdns0(4096, false)
+		msgRsp_.IsEdns0().Option = append(msgRsp_.IsEdns0().Option,
+			&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer, ExtraText: "stale"})
+		return msgRsp_
+	})
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	addr_ := newTestDns53Server(t, NewDns53Handler())
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReq_.SetEdns0(1232, true)
+	msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt_ := msgRsp_.IsEdns0()
+	if opt_ == nil || !opt_.Do() || opt_.UDPSize() != DefaultDns53MaxUDPSize {
+		t.Fatalf("reply opt = %v, want DO and udp size %d", opt_, DefaultDns53MaxUDPSize)
+	}
+	var ede_ *dns.EDNS0_EDE
+	for _, o := range opt_.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			ede_ = e
+		}
+	}
+	if ede_ == nil || ede_.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("extended dns error of upstream not replied: %v", opt_)
+	}
+
+	msgReq_ = new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	if msgRsp_, _, err = new(dns.Client).Exchange(msgReq_, addr_); err != nil {
+		t.Fatal(err)
+	}
+	if msgRsp_.IsEdns0() != nil {
+		t.Errorf("opt replied to client without edns: %v", msgRsp_.IsEdns0())
+	}
+}
+
+func TestDns53Handler_ACL(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	handler_ := NewDns53Handler()
+	addr_ := newTestDns53Server(t, handler_)
+	query_ := func() int {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.test.", dns.TypeA)
+		msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgRsp_.Rcode
+	}
+
+	acl_, _ := NewACL(&ACLConfigModel{Deny: []string{"127.0.0.0/8"}})
+	handler_.SetACL(acl_)
+	if rCode_ := query_(); rCode_ != dns.RcodeRefused {
+		t.Fatalf("denied client: rcode %s, want REFUSED", dns.RcodeToString[rCode_])
+	}
+	acl_, _ = NewACL(&ACLConfigModel{Allow: []string{"127.0.0.1"}})
+	handler_.SetACL(acl_)
+	if rCode_ := query_(); rCode_ != dns.RcodeSuccess {
+		t.Fatalf("allowed client: rcode %s, want NOERROR", dns.RcodeToString[rCode_])
+	}
+}
+
+func TestDns53Handler_RateLimit(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	handler_ := NewDns53Handler()
+	rateLimiter_, _ := NewRateLimiter(&RateLimitConfigModel{Rate: 0.001, Burst: 1})
+	handler_.SetRateLimiter(rateLimiter_)
+	udpAddr_ := newTestDns53Server(t, handler_)
+	tcpListener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer_ := &dns.Server{Listener: tcpListener_, Handler: dns.HandlerFunc(handler_.ServeDNS)}
+	go func() { _ = tcpServer_.ActivateAndServe() }()
+	t.Cleanup(func() { _ = tcpServer_.Shutdown() })
+
+	client_ := &dns.Client{Timeout: 300 * time.Millisecond}
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	if msgRsp_, _, err := client_.Exchange(msgReq_, udpAddr_); err != nil || msgRsp_.Rcode != dns.RcodeSuccess {
+		t.Fatalf("query within burst: %v, %v", msgRsp_, err)
+	}
+	// Dropped on udp, refused on tcp.
+	if _, _, err = client_.Exchange(msgReq_, udpAddr_); err == nil {
+		t.Fatal("query over limit answered on udp")
+	}
+	client_.Net = "tcp"
+	if msgRsp_, _, err := client_.Exchange(msgReq_, tcpListener_.Addr().String()); err != nil ||
+		msgRsp_.Rcode != dns.RcodeRefused {
+		t.Fatalf("query over limit on tcp: %v, %v", msgRsp_, err)
+	}
+}
+
+func TestDns53Handler_RRL(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	handler_ := NewDns53Handler()
+	slip_ := 1
+	rrl_, _ := NewRRL(&RRLConfigModel{ResponsesPerSecond: 1, Slip: &slip_})
+	rrl_.now = func() time.Time { return time.Unix(1700000000, 0) }
+	handler_.SetRRL(rrl_)
+	addr_ := newTestDns53Server(t, handler_)
+	slipped_ := rrlCounter(RRLClassResponses, "slip").Value()
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReq_.SetEdns0(1232, false)
+	msgRsp_, _, err := new(dns.Client).Exchange(msgReq_, addr_)
+	if err != nil || msgRsp_.Truncated || len(msgRsp_.Answer) != 1 {
+		t.Fatalf("response within limit: %v, %v", msgRsp_, err)
+	}
+	if msgRsp_, _, err = new(dns.Client).Exchange(msgReq_, addr_); err != nil || !msgRsp_.Truncated ||
+		len(msgRsp_.Answer) != 0 || msgRsp_.IsEdns0() == nil {
+		t.Fatalf("response over limit not slipped: %v, %v", msgRsp_, err)
+	}
+	if rrlCounter(RRLClassResponses, "slip").Value() != slipped_+1 {
+		t.Fatal("slip not counted")
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDNSCryptProviderName = "2.dnscrypt-cert.doh-relay"
+	// DefaultDNSCryptCertTTL is the validity of short-term certificates, which are rotated at half of it.
+	DefaultDNSCryptCertTTL = 24 * time.Hour
+	// dnscryptUDPSize is the read buffer size of udp queries, which dnscrypt clients pad up to.
+	dnscryptUDPSize = 1252
+	// dnscryptClientMagicSize is the size of client magic which encrypted queries start with.
+	dnscryptClientMagicSize = 8
+)
+
+// DNSCryptServer serves DNSCrypt v2 on udp and tcp listeners, queries are decrypted and handed to Handler.
+// Queries are decrypted with the certificate of their client magic, so that clients keep using the previous
+// short-term certificate after rotation until it expires.
+type DNSCryptServer struct {
+	ProviderName string
+	ProviderKey  ed25519.PrivateKey
+	EsVersion    dnscrypt.CryptoConstruction
+	CertTTL      time.Duration
+	// Handler to invoke, dns.DefaultServeMux if nil.
+	Handler     dns.Handler
+	IdleTimeout func() time.Duration
+
+	mu sync.Mutex
+	// certs are certificates not expired yet, the newest first.
+	certs     []*dnscrypt.Cert
+	closed    bool
+	udpConns  map[*net.UDPConn]struct{}
+	listeners map[net.Listener]struct{}
+	tcpConns  map[net.Conn]struct{}
+	// wg counts listeners being served and queries in flight.
+	wg sync.WaitGroup
+}
+
+// NewDNSCryptServer creates server with its first certificate, a new provider key is generated if
+// providerKey is nil.
+func NewDNSCryptServer(providerName string, providerKey ed25519.PrivateKey, esVersion dnscrypt.CryptoConstruction,
+	certTTL time.Duration, handler dns.Handler) (srv *DNSCryptServer, err error) {
+
+	if providerKey == nil {
+		if _, providerKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return
+		}
+	}
+	if esVersion == dnscrypt.UndefinedConstruction {
+		esVersion = dnscrypt.XSalsa20Poly1305
+	}
+	if certTTL <= 0 {
+		certTTL = DefaultDNSCryptCertTTL
+	}
+	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") {
+		providerName = "2.dnscrypt-cert." + providerName
+	}
+	srv = &DNSCryptServer{
+		ProviderName: providerName,
+		ProviderKey:  providerKey,
+		EsVersion:    esVersion,
+		CertTTL:      certTTL,
+		Handler:      handler,
+	}
+	if err = srv.RotateCert(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// LoadDNSCryptProviderKey reads the hex encoded provider key from file, the key is generated and saved to
+// file if it doesn't exist, so that the stamp is kept across restarts.
+func LoadDNSCryptProviderKey(path string) (key ed25519.PrivateKey, err error) {
+	if PathExists(path) {
+		buf_, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err = hex.DecodeString(strings.TrimSpace(string(buf_)))
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("dnscrypt provider key invalid in %s", path)
+		}
+		return key, nil
+	}
+	if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		return
+	}
+	if err = os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("dnscrypt provider key generated and saved to %s", path)
+	return
+}
+
+// resolverConfig returns the config of a new short-term key pair signed by the provider key.
+func (srv *DNSCryptServer) resolverConfig() (rc dnscrypt.ResolverConfig, err error) {
+	rc, err = dnscrypt.GenerateResolverConfig(srv.ProviderName, srv.ProviderKey)
+	if err != nil {
+		return
+	}
+	rc.EsVersion = srv.EsVersion
+	rc.CertificateTTL = srv.CertTTL
+	return
+}
+
+// Stamp returns the sdns:// stamp of the server reachable at addr.
+func (srv *DNSCryptServer) Stamp(addr string) (string, error) {
+	rc_, err := srv.resolverConfig()
+	if err != nil {
+		return "", err
+	}
+	stamp_, err := rc_.CreateStamp(addr)
+	if err != nil {
+		return "", err
+	}
+	return stamp_.String(), nil
+}
+
+// RotateCert generates a new short-term key pair and certificate, which is served to clients fetching
+// certificates from now on. Previous certificates are kept until they expire.
+func (srv *DNSCryptServer) RotateCert() error {
+	rc_, err := srv.resolverConfig()
+	if err != nil {
+		return err
+	}
+	cert_, err := rc_.CreateCert()
+	if err != nil {
+		return err
+	}
+	// Client magic is left zero by dnscrypt, it's the first octets of the public key to tell certificates apart.
+	copy(cert_.ClientMagic[:], cert_.ResolverPk[:dnscryptClientMagicSize])
+	cert_.Sign(srv.ProviderKey)
+	srv.mu.Lock()
+	certs_ := []*dnscrypt.Cert{cert_}
+	for _, c := range srv.certs {
+		if c.VerifyDate() {
+			certs_ = append(certs_, c)
+		}
+	}
+	srv.certs = certs_
+	srv.mu.Unlock()
+	log.Infof("dnscrypt certificate of %s: serial %d, %s, valid until %s", srv.ProviderName, cert_.Serial,
+		cert_.EsVersion, time.Unix(int64(cert_.NotAfter), 0).Format(time.RFC3339))
+	return nil
+}
+
+// RotateCertEvery rotates certificate periodically until server is shut down.
+func (srv *DNSCryptServer) RotateCertEvery(interval time.Duration) {
+	ticker_ := time.NewTicker(interval)
+	defer ticker_.Stop()
+	for range ticker_.C {
+		if srv.isClosed() {
+			return
+		}
+		if err := srv.RotateCert(); err != nil {
+			log.Errorf("dnscrypt certificate rotation error: %v", err)
+		}
+	}
+}
+
+func (srv *DNSCryptServer) handler() dns.Handler {
+	if srv.Handler == nil {
+		return dns.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+func (srv *DNSCryptServer) idleTimeout() time.Duration {
+	if srv.IdleTimeout == nil {
+		return DefaultDns53IdleTimeout
+	}
+	return srv.IdleTimeout()
+}
+
+// currentCert returns the newest certificate.
+func (srv *DNSCryptServer) currentCert() *dnscrypt.Cert {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.certs[0]
+}
+
+// certOf returns the certificate not expired of clientMagic, nil if none.
+func (srv *DNSCryptServer) certOf(clientMagic []byte) *dnscrypt.Cert {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.certs {
+		if bytes.Equal(c.ClientMagic[:], clientMagic) && c.VerifyDate() {
+			return c
+		}
+	}
+	return nil
+}
+
+func (srv *DNSCryptServer) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// track adds a listener or connection being served, false if server is shut down.
+func (srv *DNSCryptServer) track(add func()) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if srv.udpConns == nil {
+		srv.udpConns = make(map[*net.UDPConn]struct{})
+		srv.listeners = make(map[net.Listener]struct{})
+		srv.tcpConns = make(map[net.Conn]struct{})
+	}
+	add()
+	srv.wg.Add(1)
+	return true
+}
+
+func (srv *DNSCryptServer) untrack(del func()) {
+	srv.mu.Lock()
+	del()
+	srv.mu.Unlock()
+	srv.wg.Done()
+}
+
+// ServeUDP serves conn until it's closed or server is shut down.
+func (srv *DNSCryptServer) ServeUDP(conn *net.UDPConn) error {
+	if !srv.track(func() { srv.udpConns[conn] = struct{}{} }) {
+		return nil
+	}
+	defer srv.untrack(func() { delete(srv.udpConns, conn) })
+	for {
+		buf_ := make([]byte, dnscryptUDPSize)
+		n_, addr_, err := conn.ReadFromUDP(buf_)
+		if err != nil {
+			if srv.isClosed() {
+				return nil
+			}
+			return err
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			w_ := &dnscryptResponseWriter{localAddr: conn.LocalAddr(), remoteAddr: addr_, udp: true,
+				write: func(buf []byte) error {
+					_, err := conn.WriteToUDP(buf, addr_)
+					return err
+				}}
+			if err := srv.serveMsg(w_, buf_[:n_]); err != nil {
+				log.Debugf("dnscrypt query from %s error: %v", addr_, err)
+			}
+		}()
+	}
+}
+
+// ServeTCP serves listener until it's closed or server is shut down.
+func (srv *DNSCryptServer) ServeTCP(listener net.Listener) error {
+	if !srv.track(func() { srv.listeners[listener] = struct{}{} }) {
+		return nil
+	}
+	defer srv.untrack(func() { delete(srv.listeners, listener) })
+	for {
+		conn_, err := listener.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go srv.serveTCPConn(conn_)
+	}
+}
+
+// serveTCPConn answers 2-octet length prefixed queries on conn one by one until it's idle.
+func (srv *DNSCryptServer) serveTCPConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	if !srv.track(func() { srv.tcpConns[conn] = struct{}{} }) {
+		return
+	}
+	defer srv.untrack(func() { delete(srv.tcpConns, conn) })
+	w_ := &dnscryptResponseWriter{localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr(),
+		write: func(buf []byte) error {
+			_, err := conn.Write(append(appendUint16(nil, uint16(len(buf))), buf...))
+			return err
+		}}
+	var lenBuf_ [2]byte
+	for !srv.isClosed() {
+		_ = conn.SetReadDeadline(time.Now().Add(srv.idleTimeout()))
+		if _, err := io.ReadFull(conn, lenBuf_[:]); err != nil {
+			return
+		}
+		buf_ := make([]byte, binary.BigEndian.Uint16(lenBuf_[:]))
+		if _, err := io.ReadFull(conn, buf_); err != nil {
+			return
+		}
+		if err := srv.serveMsg(w_, buf_); err != nil {
+			log.Debugf("dnscrypt query from %s error: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// serveMsg answers an encrypted query, or the current certificate to a plain query of it.
+func (srv *DNSCryptServer) serveMsg(w *dnscryptResponseWriter, buf []byte) error {
+	var cert_ *dnscrypt.Cert
+	if len(buf) >= dnscryptClientMagicSize {
+		cert_ = srv.certOf(buf[:dnscryptClientMagicSize])
+	}
+	if cert_ == nil {
+		reply_, err := srv.certReply(buf)
+		if err != nil {
+			return err
+		}
+		return w.write(reply_)
+	}
+	w.cert, w.msgReq, w.written, w.err = cert_, new(dns.Msg), false, nil
+	w.query = dnscrypt.EncryptedQuery{EsVersion: cert_.EsVersion, ClientMagic: cert_.ClientMagic}
+	packet_, err := w.query.Decrypt(buf, cert_.ResolverSk)
+	if err != nil {
+		return err
+	}
+	if err = w.msgReq.Unpack(packet_); err != nil {
+		return err
+	}
+	if len(w.msgReq.Question) != 1 || w.msgReq.Response {
+		return fmt.Errorf("dnscrypt query invalid")
+	}
+	srv.handler().ServeDNS(w, w.msgReq)
+	// Queries not answered on udp are dropped, like those over rate limits.
+	if !w.written && !w.udp {
+		return w.WriteMsg(new(dns.Msg).SetRcode(w.msgReq, dns.RcodeServerFailure))
+	}
+	return w.err
+}
+
+// certReply answers the TXT query of provider name with the current certificate.
+func (srv *DNSCryptServer) certReply(buf []byte) ([]byte, error) {
+	msgReq_ := new(dns.Msg)
+	if err := msgReq_.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if len(msgReq_.Question) != 1 || msgReq_.Response || msgReq_.Question[0].Qtype != dns.TypeTXT ||
+		!strings.EqualFold(msgReq_.Question[0].Name, dns.Fqdn(srv.ProviderName)) {
+
+		return nil, fmt.Errorf("dnscrypt plain query not of certificate")
+	}
+	certBuf_, err := srv.currentCert().Serialize()
+	if err != nil {
+		return nil, err
+	}
+	msgRsp_ := new(dns.Msg).SetReply(msgReq_)
+	msgRsp_.Authoritative, msgRsp_.RecursionAvailable = true, true
+	msgRsp_.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: msgReq_.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{txtString(certBuf_)},
+	}}
+	return msgRsp_.Pack()
+}
+
+// txtString escapes bytes of buf in the presentation format of TXT strings.
+func txtString(buf []byte) string {
+	var b_ strings.Builder
+	for _, c := range buf {
+		switch {
+		case c == '"' || c == '\\':
+			b_.WriteByte('\\')
+			b_.WriteByte(c)
+		case c < ' ' || c > '~':
+			_, _ = fmt.Fprintf(&b_, "\\%03d", c)
+		default:
+			b_.WriteByte(c)
+		}
+	}
+	return b_.String()
+}
+
+// Shutdown stops serving and waits for queries in flight. Reads are unblocked, so that replies are still written.
+func (srv *DNSCryptServer) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closed = true
+	for conn := range srv.udpConns {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	for listener := range srv.listeners {
+		_ = listener.Close()
+	}
+	for conn := range srv.tcpConns {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	srv.mu.Unlock()
+	done_ := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done_)
+	}()
+	select {
+	case <-done_:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dnscryptSharedKey computes the key of replies to client of query.
+func dnscryptSharedKey(cert *dnscrypt.Cert, query *dnscrypt.EncryptedQuery) (key [32]byte, err error) {
+	if cert.EsVersion == dnscrypt.XChacha20Poly1305 {
+		return xsecretbox.SharedKey(cert.ResolverSk, query.ClientPk)
+	}
+	box.Precompute(&key, &query.ClientPk, &cert.ResolverSk)
+	return
+}
+
+// dnscryptResponseWriter encrypts replies with the certificate the query is encrypted with.
+type dnscryptResponseWriter struct {
+	localAddr, remoteAddr net.Addr
+	udp                   bool
+	write                 func(buf []byte) error
+	cert                  *dnscrypt.Cert
+	query                 dnscrypt.EncryptedQuery
+	msgReq                *dns.Msg
+	written               bool
+	err                   error
+}
+
+func (w *dnscryptResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dnscryptResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dnscryptResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.written = true
+	if w.udp {
+		// Encryption takes up to 64 octets of the udp size, answers are removed from truncated replies.
+		size_ := dns.MinMsgSize
+		if opt_ := w.msgReq.IsEdns0(); opt_ != nil && int(opt_.UDPSize()) > size_ {
+			size_ = int(opt_.UDPSize())
+		}
+		if msg.Truncate(size_ - 64); msg.Truncated {
+			msg.Answer = nil
+		}
+	}
+	w.err = w.writeMsg(msg)
+	return w.err
+}
+
+func (w *dnscryptResponseWriter) writeMsg(msg *dns.Msg) error {
+	packet_, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	key_, err := dnscryptSharedKey(w.cert, &w.query)
+	if err != nil {
+		return err
+	}
+	rsp_ := dnscrypt.EncryptedResponse{EsVersion: w.query.EsVersion, Nonce: w.query.Nonce}
+	buf_, err := rsp_.Encrypt(packet_, key_)
+	if err != nil {
+		return err
+	}
+	return w.write(buf_)
+}
+
+func (w *dnscryptResponseWriter) Write(buf []byte) (int, error) {
+	msg_ := new(dns.Msg)
+	if err := msg_.Unpack(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), w.WriteMsg(msg_)
+}
+
+func (w *dnscryptResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dnscryptResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dnscryptResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dnscryptResponseWriter) Hijack() {}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDNSCryptServer starts DNSCryptServer of h on udp and tcp of the same local port, returning its stamp.
+func newTestDNSCryptServer(t *testing.T, h *Dns53Handler) (server *DNSCryptServer, stamp string) {
+	server, err := NewDNSCryptServer("test.doh-relay", nil, dnscrypt.XChacha20Poly1305, time.Hour,
+		dns.HandlerFunc(h.ServeDNS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn_, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr_ := conn_.LocalAddr().String()
+	listener_, err := net.Listen("tcp", addr_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.ServeUDP(conn_) }()
+	go func() { _ = server.ServeTCP(listener_) }()
+	t.Cleanup(func() {
+		ctx_, cancel_ := context.WithTimeout(context.Background(), time.Second)
+		defer cancel_()
+		_ = server.Shutdown(ctx_)
+		_ = conn_.Close()
+		_ = listener_.Close()
+	})
+	stamp, err = server.Stamp(addr_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDNSCryptServer(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+
+	server_, stamp_ := newTestDNSCryptServer(t, NewDns53Handler())
+	if server_.ProviderName != "2.dnscrypt-cert.test.doh-relay" {
+		t.Fatalf("provider name: %s", server_.ProviderName)
+	}
+
+	resolverInfos_ := make(map[string]*dnscrypt.ResolverInfo)
+	exchange_ := func(network string, resolverInfo *dnscrypt.ResolverInfo) *dnscrypt.Cert {
+		client_ := &dnscrypt.Client{Net: network, Timeout: 2 * time.Second}
+		if resolverInfo == nil {
+			var err error
+			if resolverInfo, err = client_.Dial(stamp_); err != nil {
+				t.Fatalf("%s dial: %v", network, err)
+			}
+			resolverInfos_[network] = resolverInfo
+		}
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.example.", dns.TypeA)
+		msgRsp_, err := client_.Exchange(msgReq_, resolverInfo)
+		if err != nil {
+			t.Fatalf("%s exchange: %v", network, err)
+		}
+		if msgRsp_.Id != msgReq_.Id || len(msgRsp_.Answer) != 1 {
+			t.Fatalf("%s reply: %v", network, msgRsp_)
+		}
+		return resolverInfo.ResolverCert
+	}
+
+	certUDP_ := exchange_("udp", nil)
+	certTCP_ := exchange_("tcp", nil)
+	if certUDP_.EsVersion != dnscrypt.XChacha20Poly1305 || certUDP_.Serial != certTCP_.Serial {
+		t.Fatalf("certificates: %v, %v", certUDP_, certTCP_)
+	}
+
+	// Listeners serve the new certificate after rotation, queries with the previous one are still answered.
+	if err := server_.RotateCert(); err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		exchange_(network, resolverInfos_[network])
+		cert_ := exchange_(network, nil)
+		if bytes.Equal(cert_.ResolverPk[:], certUDP_.ResolverPk[:]) {
+			t.Fatalf("%s certificate not rotated", network)
+		}
+	}
+}
+
+func TestLoadDNSCryptProviderKey(t *testing.T) {
+	path_ := filepath.Join(t.TempDir(), "provider.key")
+	key_, err := LoadDNSCryptProviderKey(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedKey_, err := LoadDNSCryptProviderKey(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key_.Equal(loadedKey_) {
+		t.Fatal("provider key changed after reloading")
+	}
+}
+
+func TestDNSCryptServer_RRL(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	handler_ := NewDns53Handler()
+	slip_ := 0
+	rrl_, _ := NewRRL(&RRLConfigModel{ResponsesPerSecond: 1, Slip: &slip_})
+	rrl_.now = func() time.Time { return time.Unix(1700000000, 0) }
+	handler_.SetRRL(rrl_)
+	_, stamp_ := newTestDNSCryptServer(t, handler_)
+	dropped_ := rrlCounter(RRLClassResponses, "drop").Value()
+
+	exchange_ := func(network string) (*dns.Msg, error) {
+		client_ := &dnscrypt.Client{Net: network, Timeout: 500 * time.Millisecond}
+		resolverInfo_, err := client_.Dial(stamp_)
+		if err != nil {
+			t.Fatalf("%s dial: %v", network, err)
+		}
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.test.", dns.TypeA)
+		return client_.Exchange(msgReq_, resolverInfo_)
+	}
+	if msgRsp_, err := exchange_("udp"); err != nil || len(msgRsp_.Answer) != 1 {
+		t.Fatalf("udp response within limit: %v, %v", msgRsp_, err)
+	}
+	if msgRsp_, err := exchange_("udp"); err == nil {
+		t.Fatalf("udp response over limit not dropped: %v", msgRsp_)
+	}
+	if rrlCounter(RRLClassResponses, "drop").Value() != dropped_+1 {
+		t.Fatal("drop not counted")
+	}
+	// Replies on tcp are not limited.
+	if msgRsp_, err := exchange_("tcp"); err != nil || len(msgRsp_.Answer) != 1 {
+		t.Fatalf("tcp response over limit: %v, %v", msgRsp_, err)
+	}
+}
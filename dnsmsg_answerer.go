@@ -20,6 +20,19 @@ func NewDnsMsgAnswerer(rsv, fallback Resolver, fixedResolvers map[*regexp.Regexp
 	}
 }
 
+// Close closes all resolvers of the answerer.
+func (dma *DnsMsgAnswerer) Close() {
+	resolvers_ := []Resolver{dma.Resolver, dma.FallbackResolver}
+	for _, rsv := range dma.FixedResolvers {
+		resolvers_ = append(resolvers_, rsv)
+	}
+	for _, rsv := range resolvers_ {
+		if rsv != nil {
+			rsv.Close()
+		}
+	}
+}
+
 func (dma *DnsMsgAnswerer) Answer(dnsReq *dns.Msg, ecsIPs string) (dnsRsp *dns.Msg, err error) {
 	var question_ dns.Question
 	if len(dnsReq.Question) > 0 {
@@ -27,12 +40,20 @@ func (dma *DnsMsgAnswerer) Answer(dnsReq *dns.Msg, ecsIPs string) (dnsRsp *dns.M
 	} else {
 		return nil, fmt.Errorf("no question in request")
 	}
+	// Only one question in IN class is supported.
+	if len(dnsReq.Question) > 1 {
+		return dma.rejectedReply(dnsReq, dns.RcodeFormatError), nil
+	}
+	if question_.Qclass != dns.ClassINET {
+		return dma.rejectedReply(dnsReq, dns.RcodeNotImplemented), nil
+	}
+	queryOpts_ := NewQueryOptionsFromMsg(dnsReq, ForwardEdns0Options())
 
 	usingFixedResolver := false
 	var rsvRsp_ ResolverRsp
 	for n, r := range dma.FixedResolvers {
 		if n.Match([]byte(question_.Name)) {
-			rsvRsp_, err = r.Query(question_.Name, question_.Qtype, "")
+			rsvRsp_, err = r.Query(question_.Name, question_.Qtype, "", queryOpts_)
 			if err != nil || rsvRsp_ == nil {
 				return nil, fmt.Errorf("query error: %v", err)
 			}
@@ -40,14 +61,16 @@ func (dma *DnsMsgAnswerer) Answer(dnsReq *dns.Msg, ecsIPs string) (dnsRsp *dns.M
 		}
 	}
 	if !usingFixedResolver {
-		rsvRsp_, err = dma.Resolver.Query(question_.Name, question_.Qtype, ecsIPs)
-		if err != nil || rsvRsp_ == nil {
+		rsvRsp_, err = dma.Resolver.Query(question_.Name, question_.Qtype, ecsIPs, queryOpts_)
+		failed_ := err != nil || rsvRsp_ == nil
+		if failed_ || rsvRsp_.StatusV() == dns.RcodeServerFailure {
 			if dma.FallbackResolver != nil {
 				log.Infof("using fallback resolver for %+v", question_)
-				rsvRspFb_, errFb_ := dma.FallbackResolver.Query(question_.Name, question_.Qtype, ecsIPs)
-				if errFb_ == nil && rsvRspFb_ != nil {
+				rsvRspFb_, errFb_ := dma.FallbackResolver.Query(question_.Name, question_.Qtype, ecsIPs,
+					queryOpts_)
+				if errFb_ == nil && rsvRspFb_ != nil && (failed_ || rsvRspFb_.StatusV() != dns.RcodeServerFailure) {
 					rsvRsp_, err = rsvRspFb_, errFb_
-				} else {
+				} else if failed_ {
 					rsvRsp_, err = nil, fmt.Errorf("query error: %v", rsvRspFb_)
 				}
 			}
@@ -67,13 +90,37 @@ func (dma *DnsMsgAnswerer) Answer(dnsReq *dns.Msg, ecsIPs string) (dnsRsp *dns.M
 	tmpDnsRsp_ := new(dns.Msg)
 	defer func() { tmpDnsRsp_ = nil }()
 	tmpDnsRsp_.SetReply(dnsReq)
+	tmpDnsRsp_.Rcode = rsvRsp_.StatusV()
 	tmpDnsRsp_.Truncated = rsvRsp_.TruncatedV()
 	tmpDnsRsp_.RecursionAvailable = rsvRsp_.RecursionAvailableV()
 	tmpDnsRsp_.AuthenticatedData = rsvRsp_.AuthenticDataV()
 	tmpDnsRsp_.Answer = rsvRsp_.AnswerV()
 	tmpDnsRsp_.Ns = rsvRsp_.NsV()
-	tmpDnsRsp_.Extra = rsvRsp_.ExtraV()
+	for _, rr := range rsvRsp_.ExtraV() {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			tmpDnsRsp_.Extra = append(tmpDnsRsp_.Extra, rr)
+		}
+	}
+	// Reply OPT record only to EDNS clients.
+	if reqOpt_ := dnsReq.IsEdns0(); reqOpt_ != nil {
+		tmpDnsRsp_.Extra = append(tmpDnsRsp_.Extra, NewReplyOPT(reqOpt_, rsvRsp_.OptV(), ForwardEdns0Options()))
+	} else if tmpDnsRsp_.Rcode > 0xF {
+		// Extended RCODE can't be represented without OPT record.
+		log.Warnf("extended rcode %s for non-EDNS client, replying SERVFAIL", dns.RcodeToString[tmpDnsRsp_.Rcode])
+		tmpDnsRsp_.Rcode = dns.RcodeServerFailure
+	}
 	dnsRsp = tmpDnsRsp_.Copy()
 	AdjustDnsMsgTtl(dnsRsp, rsvRsp_.UnixTSOfArrival())
 	return
 }
+
+// rejectedReply replies the request with rCode without querying upstreams.
+func (dma *DnsMsgAnswerer) rejectedReply(dnsReq *dns.Msg, rCode int) (dnsRsp *dns.Msg) {
+	dnsRsp = new(dns.Msg)
+	dnsRsp.SetRcode(dnsReq, rCode)
+	dnsRsp.RecursionAvailable = true
+	if reqOpt_ := dnsReq.IsEdns0(); reqOpt_ != nil {
+		dnsRsp.Extra = append(dnsRsp.Extra, NewReplyOPT(reqOpt_, nil, nil))
+	}
+	return
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// recordingUpstream answers with fakeAnswer and keeps the last received query.
+type recordingUpstream struct {
+	mu      sync.Mutex
+	lastReq *dns.Msg
+	extra   func(msgRsp *dns.Msg)
+}
+
+func (u *recordingUpstream) answer(msgReq *dns.Msg) *dns.Msg {
+	u.mu.Lock()
+	u.lastReq = msgReq.Copy()
+	u.mu.Unlock()
+	msgRsp_ := fakeAnswer(msgReq)
+	if opt_ := msgReq.IsEdns0(); opt_ != nil {
+		msgRsp_.SetEdns0(4096, opt_.Do())
+	}
+	if u.extra != nil {
+		u.extra(msgRsp_)
+	}
+	return msgRsp_
+}
+
+func (u *recordingUpstream) LastReq() *dns.Msg {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastReq
+}
+
+func TestDnsMsgAnswerer_ForwardQuerySemantics(t *testing.T) {
+	upstream_ := &recordingUpstream{
+		extra: func(msgRsp *dns.Msg) {
+			opt_ := msgRsp.IsEdns0()
+			opt_.Option = append(opt_.Option,
+				&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer, ExtraText: "stale"},
+				&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73"},
+				&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+			)
+		},
+	}
+	dohSrv_ := newFakeDohUpstream(t, upstream_.answer)
+	rsv_ := NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil)
+	answerer_ := NewDnsMsgAnswerer(rsv_, nil, nil)
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("example.com.", dns.TypeA)
+	msgReq_.CheckingDisabled = true
+	msgReq_.SetEdns0(1232, true)
+	msgReq_.IsEdns0().Option = append(msgReq_.IsEdns0().Option,
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+	)
+	msgRsp_, err := answerer_.Answer(msgReq_, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamReq_ := upstream_.LastReq()
+	if !upstreamReq_.CheckingDisabled {
+		t.Errorf("CD bit not forwarded to upstream")
+	}
+	upstreamOpt_ := upstreamReq_.IsEdns0()
+	if upstreamOpt_ == nil || !upstreamOpt_.Do() {
+		t.Fatalf("DO bit not forwarded to upstream: %v", upstreamOpt_)
+	}
+	var forwardedCodes_ []uint16
+	for _, o := range upstreamOpt_.Option {
+		forwardedCodes_ = append(forwardedCodes_, o.Option())
+	}
+	if !SliceContains(forwardedCodes_, dns.EDNS0NSID) || SliceContains(forwardedCodes_, dns.EDNS0COOKIE) {
+		t.Errorf("forwarded EDNS0 options = %v, want NSID but not COOKIE", forwardedCodes_)
+	}
+
+	if !msgRsp_.CheckingDisabled {
+		t.Errorf("CD bit not set in reply")
+	}
+	rspOpt_ := msgRsp_.IsEdns0()
+	if rspOpt_ == nil || !rspOpt_.Do() {
+		t.Fatalf("reply OPT with DO bit missing: %v", rspOpt_)
+	}
+	var rspCodes_ []uint16
+	for _, o := range rspOpt_.Option {
+		rspCodes_ = append(rspCodes_, o.Option())
+	}
+	if !SliceContains(rspCodes_, dns.EDNS0EDE) || !SliceContains(rspCodes_, dns.EDNS0NSID) ||
+		SliceContains(rspCodes_, dns.EDNS0PADDING) {
+
+		t.Errorf("reply EDNS0 options = %v, want EDE and NSID but not PADDING", rspCodes_)
+	}
+	if n_ := len(msgRsp_.Extra); n_ != 1 {
+		t.Errorf("reply has %d additional records, want only OPT", n_)
+	}
+}
+
+func TestDnsMsgAnswerer_NoOPTForNonEdnsClient(t *testing.T) {
+	upstream_ := &recordingUpstream{}
+	dohSrv_ := newFakeDohUpstream(t, upstream_.answer)
+	rsv_ := NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil)
+	answerer_ := NewDnsMsgAnswerer(rsv_, nil, nil)
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("example.com.", dns.TypeA)
+	msgRsp_, err := answerer_.Answer(msgReq_, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream_.LastReq().CheckingDisabled {
+		t.Errorf("CD bit set in upstream query")
+	}
+	if msgRsp_.IsEdns0() != nil {
+		t.Errorf("reply to non-EDNS client has OPT record")
+	}
+	if len(msgRsp_.Answer) != 1 {
+		t.Errorf("reply answers = %v, want 1", msgRsp_.Answer)
+	}
+}
+
+func TestDnsMsgAnswerer_RejectedQueries(t *testing.T) {
+	answerer_ := NewDnsMsgAnswerer(nil, nil, nil)
+
+	multiQ_ := new(dns.Msg)
+	multiQ_.SetQuestion("example.com.", dns.TypeA)
+	multiQ_.Question = append(multiQ_.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA,
+		Qclass: dns.ClassINET})
+
+	chaosQ_ := new(dns.Msg)
+	chaosQ_.SetQuestion("version.bind.", dns.TypeTXT)
+	chaosQ_.Question[0].Qclass = dns.ClassCHAOS
+
+	tests := []struct {
+		name  string
+		msg   *dns.Msg
+		rCode int
+	}{
+		{name: "multiple questions", msg: multiQ_, rCode: dns.RcodeFormatError},
+		{name: "chaos class", msg: chaosQ_, rCode: dns.RcodeNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgRsp_, err := answerer_.Answer(tt.msg, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Rcode != tt.rCode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[msgRsp_.Rcode], dns.RcodeToString[tt.rCode])
+			}
+		})
+	}
+}
+
+func TestDohJsonResolver_ForwardFlags(t *testing.T) {
+	var query_ string
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query_ = r.URL.RawQuery
+		fakeDohHandler(fakeAnswer).ServeHTTP(w, r)
+	}))
+	defer srv_.Close()
+	rsv_ := NewDohJsonResolver([]string{srv_.URL + "/resolve"}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+
+	if _, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if params_, _ := url.ParseQuery(query_); params_.Get("do") != "" || params_.Get("cd") != "" {
+		t.Errorf("unexpected do/cd params in %s", query_)
+	}
+	if _, err := rsv_.Resolve("example.com", dns.TypeA, nil,
+		&QueryOptions{DnssecOK: true, CheckingDisabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if params_, _ := url.ParseQuery(query_); params_.Get("do") != "1" || params_.Get("cd") != "1" {
+		t.Errorf("do/cd params missing in %s", query_)
+	}
+}
+
+func TestQueryOptions_CacheKey(t *testing.T) {
+	keys_ := map[string]bool{}
+	for _, opts := range []*QueryOptions{
+		nil,
+		{Edns0: true},
+		{Edns0: true, DnssecOK: true},
+		{CheckingDisabled: true},
+		{Edns0: true, DnssecOK: true, Edns0Options: []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}},
+	} {
+		key_ := opts.CacheKey()
+		if keys_[key_] {
+			t.Errorf("duplicated cache key %q for %+v", key_, opts)
+		}
+		keys_[key_] = true
+	}
+}
+
+func TestDnsMsgAnswerer_RcodeCache(t *testing.T) {
+	var mu_ sync.Mutex
+	hits_ := map[string]int{}
+	dohSrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		mu_.Lock()
+		hits_[msgReq.Question[0].Name]++
+		mu_.Unlock()
+		return rcodeAnswer(msgReq)
+	})
+	rsv_ := NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, true,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil)
+	answerer_ := NewDnsMsgAnswerer(rsv_, nil, nil)
+
+	wantHits_ := map[string]int{
+		"noerror.test.":  1,
+		"nxdomain.test.": 1,
+		"servfail.test.": 1,
+		"refused.test.":  2,
+	}
+	for name, want := range wantHits_ {
+		for i := 0; i < 2; i++ {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			msgRsp_, err := answerer_.Answer(msgReq_, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Rcode != rcodeTestNames[name] {
+				t.Errorf("%s rcode = %s, want %s", name, dns.RcodeToString[msgRsp_.Rcode],
+					dns.RcodeToString[rcodeTestNames[name]])
+			}
+		}
+		mu_.Lock()
+		if hits_[name] != want {
+			t.Errorf("%s upstream hits = %d, want %d", name, hits_[name], want)
+		}
+		mu_.Unlock()
+	}
+}
+
+func TestDnsMsgAnswerer_FallbackOnServFail(t *testing.T) {
+	primarySrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := new(dns.Msg)
+		return msgRsp_.SetRcode(msgReq, dns.RcodeServerFailure)
+	})
+	fallbackSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	cacheOptions_ := &CacheOptions{cacheType: CacheTypeInternal}
+	answerer_ := NewDnsMsgAnswerer(
+		NewDohDnsMsgResolver([]string{primarySrv_.URL + "/dns-query"}, false, cacheOptions_, nil),
+		NewDohDnsMsgResolver([]string{fallbackSrv_.URL + "/dns-query"}, false, cacheOptions_, nil),
+		nil,
+	)
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("example.com.", dns.TypeA)
+	msgRsp_, err := answerer_.Answer(msgReq_, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgRsp_.Rcode != dns.RcodeSuccess || len(msgRsp_.Answer) != 1 {
+		t.Errorf("reply = %v, want answer from fallback", msgRsp_)
+	}
+}
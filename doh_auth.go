@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DohTokenParam is the path param of tokens embedded in the DoH path, like /dns-query/{token}.
+	DohTokenParam = "token"
+	// dohPathTokenKey and dohProfileKey are gin context keys of the path token and the authenticated profile.
+	dohPathTokenKey = "doh_path_token"
+	dohProfileKey   = "doh_profile"
+)
+
+// DohProfile is what queries authenticated by its tokens are served with.
+type DohProfile struct {
+	Name string
+	// Answerer answers queries, RelayAnswerer if nil.
+	Answerer *DnsMsgAnswerer
+	// DefaultECSIPs replace the service's if not empty.
+	DefaultECSIPs []string
+	// ACL and RateLimiter apply besides the service's.
+	ACL         *ACL
+	RateLimiter *RateLimiter
+}
+
+// answerer returns answerer of queries of profile, RelayAnswerer if nil.
+func (p *DohProfile) answerer() *DnsMsgAnswerer {
+	if p == nil || p.Answerer == nil {
+		return CurrentRelayAnswerer()
+	}
+	return p.Answerer
+}
+
+// DohAuth maps tokens to profiles. Tokens are looked up by sha256 digests, so lookups take no time dependent on
+// how much of a token is guessed.
+type DohAuth struct {
+	// Required refuses queries without token, otherwise they are served without profile.
+	Required bool
+	profiles map[[sha256.Size]byte]*DohProfile
+}
+
+// NewDohAuth creates DohAuth of the doh service, nil if no profile is configured. newAnswerer creates answerers
+// of profiles with own upstreams, answerers are not created if it's nil.
+func NewDohAuth(conf *DohAuthConfigModel, newAnswerer func(profile *DohProfileConfigModel) *DnsMsgAnswerer) (
+	a *DohAuth, err error) {
+
+	if len(conf.Profiles) == 0 {
+		if conf.Required {
+			return nil, fmt.Errorf("auth required without profiles")
+		}
+		return nil, nil
+	}
+	a = &DohAuth{Required: conf.Required, profiles: make(map[[sha256.Size]byte]*DohProfile)}
+	defer func() {
+		if err != nil {
+			a.Close()
+			a = nil
+		}
+	}()
+	names_ := make(map[string]bool)
+	for i := range conf.Profiles {
+		profileConf_ := &conf.Profiles[i]
+		if profileConf_.Name == "" || names_[profileConf_.Name] {
+			return a, fmt.Errorf("auth profile name empty or duplicated: %q", profileConf_.Name)
+		}
+		names_[profileConf_.Name] = true
+		profile_ := &DohProfile{
+			Name:          profileConf_.Name,
+			DefaultECSIPs: defaultECSIPs(profileConf_.EcsIP1st, profileConf_.EcsIP2nd),
+		}
+		if profile_.ACL, err = NewACL(&profileConf_.ACL); err != nil {
+			return a, fmt.Errorf("auth profile %s: %v", profile_.Name, err)
+		}
+		if profile_.RateLimiter, err = NewRateLimiter(&profileConf_.RateLimit); err != nil {
+			return a, fmt.Errorf("auth profile %s: %v", profile_.Name, err)
+		}
+		if len(profileConf_.Tokens) == 0 {
+			return a, fmt.Errorf("auth profile %s has no token", profile_.Name)
+		}
+		for _, token := range profileConf_.Tokens {
+			if token == "" || strings.ContainsAny(token, "/ ") {
+				return a, fmt.Errorf("auth profile %s has token empty or containing '/' or space", profile_.Name)
+			}
+			digest_ := sha256.Sum256([]byte(token))
+			if _, ok := a.profiles[digest_]; ok {
+				return a, fmt.Errorf("auth profile %s has token duplicated", profile_.Name)
+			}
+			a.profiles[digest_] = profile_
+		}
+		if newAnswerer != nil {
+			profile_.Answerer = newAnswerer(profileConf_)
+		}
+	}
+	return
+}
+
+// Profile returns profile of token, nil if token is invalid.
+func (a *DohAuth) Profile(token string) *DohProfile {
+	if a == nil {
+		return nil
+	}
+	return a.profiles[sha256.Sum256([]byte(token))]
+}
+
+// Close closes answerers of profiles.
+func (a *DohAuth) Close() {
+	if a == nil {
+		return
+	}
+	closed_ := make(map[*DnsMsgAnswerer]bool)
+	for _, profile := range a.profiles {
+		if profile.Answerer != nil && !closed_[profile.Answerer] {
+			closed_[profile.Answerer] = true
+			profile.Answerer.Close()
+		}
+	}
+}
+
+func dohUnauthorizedCounter() *Counter {
+	return Metrics.Counter("doh_unauthorized_queries_total", "DoH queries without valid token.")
+}
+
+func dohProfileQueriesCounter(profile string) *Counter {
+	return Metrics.Counter("doh_profile_queries_total", "DoH queries authenticated by profile.",
+		"profile", profile)
+}
+
+// SetAuth replaces authentication of clients, nil to serve any client without profile. Answerers of the previous
+// one are closed after ReloadCloseDelay.
+func (h *DohHandler) SetAuth(a *DohAuth) {
+	h.mu.Lock()
+	prev_ := h.Auth
+	h.Auth = a
+	h.mu.Unlock()
+	if prev_ != nil {
+		time.AfterFunc(ReloadCloseDelay, prev_.Close)
+	}
+}
+
+func (h *DohHandler) auth() *DohAuth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Auth
+}
+
+// DohPathTokenMiddleware takes tokens embedded in the DoH path off the request path, so that they are not
+// logged. It's used before the logger.
+func DohPathTokenMiddleware(c *gin.Context) {
+	if token_ := c.Param(DohTokenParam); token_ != "" {
+		c.Set(dohPathTokenKey, token_)
+		c.Request.URL.Path = strings.TrimSuffix(c.Request.URL.Path, token_) + "-"
+		c.Request.URL.RawPath = ""
+	}
+	c.Next()
+}
+
+// dohToken returns token of query in the Authorization bearer header, or embedded in the DoH path.
+func dohToken(c *gin.Context) string {
+	if scheme_, token_, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme_,
+		"Bearer") {
+
+		return strings.TrimSpace(token_)
+	}
+	return c.GetString(dohPathTokenKey)
+}
+
+// AuthMiddleware authenticates queries by tokens, answering 401 to invalid tokens or to queries without token if
+// required. Acl and rate limit of the profile are applied like the service's.
+func (h *DohHandler) AuthMiddleware(c *gin.Context) {
+	auth_, token_ := h.auth(), dohToken(c)
+	if auth_ == nil {
+		if c.GetString(dohPathTokenKey) != "" {
+			// No path is a DoH endpoint but the DoH path without auth.
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Next()
+		return
+	}
+	if token_ == "" && !auth_.Required {
+		c.Next()
+		return
+	}
+	profile_ := auth_.Profile(token_)
+	if profile_ == nil {
+		log.Debugf("doh query from %s without valid token", c.ClientIP())
+		dohUnauthorizedCounter().Inc()
+		c.Header("WWW-Authenticate", `Bearer realm="doh-relay"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	ip_ := net.ParseIP(c.ClientIP())
+	if !profile_.ACL.Allowed(ip_) {
+		log.Debugf("doh query from %s refused by acl of profile %s", c.ClientIP(), profile_.Name)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if !profile_.RateLimiter.Allow(ip_) {
+		rateLimitedCounter("doh").Inc()
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+	dohProfileQueriesCounter(profile_.Name).Inc()
+	c.Set(dohProfileKey, profile_)
+	c.Next()
+}
+
+// DohProfileOf returns profile query of c is authenticated by, nil if none.
+func DohProfileOf(c *gin.Context) *DohProfile {
+	if v_, ok := c.Get(dohProfileKey); ok {
+		return v_.(*DohProfile)
+	}
+	return nil
+}
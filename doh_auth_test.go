@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewDohAuth(t *testing.T) {
+	for _, conf := range []DohAuthConfigModel{
+		{Required: true},
+		{Profiles: []DohProfileConfigModel{{Tokens: []string{"t1"}}}},
+		{Profiles: []DohProfileConfigModel{{Name: "a"}}},
+		{Profiles: []DohProfileConfigModel{{Name: "a", Tokens: []string{"t/1"}}}},
+		{Profiles: []DohProfileConfigModel{{Name: "a", Tokens: []string{"t1"}}, {Name: "a", Tokens: []string{"t2"}}}},
+		{Profiles: []DohProfileConfigModel{{Name: "a", Tokens: []string{"t1"}}, {Name: "b", Tokens: []string{"t1"}}}},
+		{Profiles: []DohProfileConfigModel{{Name: "a", Tokens: []string{"t1"},
+			ACL: ACLConfigModel{Allow: []string{"x"}}}}},
+	} {
+		if _, err := NewDohAuth(&conf, nil); err == nil {
+			t.Errorf("no error of %+v", conf)
+		}
+	}
+	auth_, err := NewDohAuth(&DohAuthConfigModel{}, nil)
+	if err != nil || auth_ != nil {
+		t.Fatalf("auth without profiles = %v, %v", auth_, err)
+	}
+	auth_, err = NewDohAuth(&DohAuthConfigModel{Profiles: []DohProfileConfigModel{
+		{Name: "a", Tokens: []string{"t1", "t2"}, EcsIP1st: "203.0.113.9"},
+		{Name: "b", Tokens: []string{"t3"}},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]string{"t1": "a", "t2": "a", "t3": "b"} {
+		if profile_ := auth_.Profile(token); profile_ == nil || profile_.Name != want {
+			t.Errorf("profile of %s = %+v, want %s", token, profile_, want)
+		}
+	}
+	if profile_ := auth_.Profile("t4"); profile_ != nil {
+		t.Errorf("profile of invalid token = %+v", profile_)
+	}
+	if ips_ := auth_.Profile("t1").DefaultECSIPs; len(ips_) != 1 || ips_[0] != "203.0.113.9" {
+		t.Errorf("profile ecs ips = %v", ips_)
+	}
+}
+
+func TestDohHandler_Auth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	profileSrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := fakeAnswer(msgReq)
+		msgRsp_.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+		return msgRsp_
+	})
+	dohHandler_ := NewDohHandler()
+	auth_, err := NewDohAuth(&DohAuthConfigModel{Profiles: []DohProfileConfigModel{
+		{Name: "team-a", Tokens: []string{"token-a"}},
+		{Name: "team-b", Tokens: []string{"token-b"}, ACL: ACLConfigModel{Allow: []string{"198.51.100.0/24"}}},
+	}}, func(profile *DohProfileConfigModel) *DnsMsgAnswerer {
+		if profile.Name != "team-a" {
+			return nil
+		}
+		return NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{profileSrv_.URL + "/dns-query"}, false, nil, nil),
+			nil, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth_.Close()
+	dohHandler_.SetAuth(auth_)
+	var loggedPaths_ []string
+	router_ := gin.New()
+	router_.Use(DohPathTokenMiddleware, func(c *gin.Context) {
+		loggedPaths_ = append(loggedPaths_, c.Request.URL.Path)
+	})
+	for _, path := range []string{"/dns-query", "/dns-query/:" + DohTokenParam} {
+		router_.GET(path, dohHandler_.AuthMiddleware, dohHandler_.DohGetHandler)
+	}
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReqBytes_, _ := msgReq_.Pack()
+	query_ := func(path, token string) (int, *dns.Msg) {
+		httpReq_ := httptest.NewRequest(http.MethodGet,
+			path+"?dns="+base64.RawURLEncoding.EncodeToString(msgReqBytes_), nil)
+		httpReq_.RemoteAddr = "192.0.2.7:5353"
+		if token != "" {
+			httpReq_.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder_ := httptest.NewRecorder()
+		router_.ServeHTTP(recorder_, httpReq_)
+		if recorder_.Code != http.StatusOK {
+			return recorder_.Code, nil
+		}
+		msgRsp_ := new(dns.Msg)
+		if err := msgRsp_.Unpack(recorder_.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return recorder_.Code, msgRsp_
+	}
+	answerOf_ := func(msgRsp *dns.Msg) string {
+		if msgRsp == nil || len(msgRsp.Answer) == 0 {
+			return ""
+		}
+		return msgRsp.Answer[0].(*dns.A).A.String()
+	}
+
+	for _, c := range []struct {
+		path, token string
+		code        int
+		answer      string
+	}{
+		{"/dns-query", "", http.StatusOK, "192.0.2.1"},
+		{"/dns-query", "token-a", http.StatusOK, "192.0.2.2"},
+		{"/dns-query/token-a", "", http.StatusOK, "192.0.2.2"},
+		{"/dns-query", "invalid", http.StatusUnauthorized, ""},
+		{"/dns-query/invalid", "", http.StatusUnauthorized, ""},
+		// Not allowed by acl of the profile.
+		{"/dns-query/token-b", "", http.StatusForbidden, ""},
+	} {
+		code_, msgRsp_ := query_(c.path, c.token)
+		if code_ != c.code || answerOf_(msgRsp_) != c.answer {
+			t.Errorf("%s with token %q: http status = %d, answer = %s, want %d, %s", c.path, c.token, code_,
+				answerOf_(msgRsp_), c.code, c.answer)
+		}
+	}
+	for _, path := range loggedPaths_ {
+		if strings.Contains(path, "token-") || strings.Contains(path, "invalid") {
+			t.Errorf("token in request path %s", path)
+		}
+	}
+
+	auth_.Required = true
+	if code_, _ := query_("/dns-query", ""); code_ != http.StatusUnauthorized {
+		t.Errorf("query without token when required: http status = %d", code_)
+	}
+	dohHandler_.Auth = nil
+	if code_, _ := query_("/dns-query/token-a", ""); code_ != http.StatusNotFound {
+		t.Errorf("path token without auth: http status = %d", code_)
+	}
+	if code_, _ := query_("/dns-query", ""); code_ != http.StatusOK {
+		t.Errorf("query without auth: http status = %d", code_)
+	}
+}
+
+func TestNewDohProfileAnswerer(t *testing.T) {
+	dohSrv_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := fakeAnswer(msgReq)
+		msgRsp_.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.9")
+		return msgRsp_
+	})
+	conf_ := &ConfigModel{DohConfig: DohConfigModel{Upstream: dohSrv_.URL + "/dns-query",
+		UpstreamProto: RelayUpstreamProtoDoh}}
+	if answerer_ := newDohProfileAnswerer(conf_, &DohProfileConfigModel{Name: "a"}); answerer_ != nil {
+		t.Fatal("answerer created for profile without own upstream")
+	}
+
+	// Profile of only upstream_proto uses upstreams of the doh service.
+	answerer_ := newDohProfileAnswerer(conf_, &DohProfileConfigModel{Name: "a",
+		UpstreamProto: RelayUpstreamProtoDoh})
+	if answerer_ == nil {
+		t.Fatal("no answerer of profile with upstream_proto")
+	}
+	defer answerer_.Close()
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgRsp_, err := answerer_.Answer(msgReq_, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgRsp_.Answer) == 0 || msgRsp_.Answer[0].(*dns.A).A.String() != "192.0.2.9" {
+		t.Errorf("profile answer = %v, want one of the doh service's upstream", msgRsp_.Answer)
+	}
+
+	answerOf_ := func(answerer *DnsMsgAnswerer) string {
+		defer answerer.Close()
+		msgRsp_, err := answerer.Answer(msgReq_, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgRsp_.Answer) == 0 {
+			return ""
+		}
+		return msgRsp_.Answer[0].(*dns.A).A.String()
+	}
+	dns53Answer_ := func(ip string) func(*dns.Msg) *dns.Msg {
+		return func(msgReq *dns.Msg) *dns.Msg {
+			msgRsp_ := fakeAnswer(msgReq)
+			msgRsp_.Answer[0].(*dns.A).A = net.ParseIP(ip)
+			return msgRsp_
+		}
+	}
+	// Profile of only upstream_proto of another protocol uses its default upstreams.
+	defaultDns53Endpoints_ := Quad9Dns53Endpoints
+	defer func() { Quad9Dns53Endpoints = defaultDns53Endpoints_ }()
+	Quad9Dns53Endpoints = []string{"tcp://" + newFakeDns53Upstream(t, dns53Answer_("192.0.2.53"))}
+	if ip_ := answerOf_(newDohProfileAnswerer(conf_, &DohProfileConfigModel{Name: "a",
+		UpstreamProto: RelayUpstreamProtoDns53})); ip_ != "192.0.2.53" {
+
+		t.Errorf("answer of profile with upstream_proto dns53 = %s, want one of the default dns53 upstream", ip_)
+	}
+
+	// Profile of only upstream uses upstream_proto of the doh service.
+	conf_.DohConfig.Upstream = "tcp://" + newFakeDns53Upstream(t, dns53Answer_("192.0.2.54"))
+	conf_.DohConfig.UpstreamProto = RelayUpstreamProtoDns53
+	if ip_ := answerOf_(newDohProfileAnswerer(conf_, &DohProfileConfigModel{Name: "a",
+		Upstream: "tcp://" + newFakeDns53Upstream(t, dns53Answer_("192.0.2.55"))})); ip_ != "192.0.2.55" {
+
+		t.Errorf("answer of profile with upstream = %s, want one of its dns53 upstream", ip_)
+	}
+}
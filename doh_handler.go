@@ -2,14 +2,39 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/miekg/dns"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+)
+
+const (
+	// DohJsonPath is where json api queries are served, besides the DoH path.
+	DohJsonPath = "/resolve"
+	// DefaultDohMaxBodySize limits query messages if max_body_size is not configured, the max of dns messages.
+	DefaultDohMaxBodySize = dns.MaxMsgSize
+	// DohCORSMaxAge is how long browsers may cache preflight responses in seconds.
+	DohCORSMaxAge = 86400
 )
 
 type DohHandler struct {
 	DefaultECSIPs []string
+	// MaxBodySize limits query messages in POST bodies and GET params, DefaultDohMaxBodySize if 0.
+	MaxBodySize int
+	// ACL of clients, any client is allowed if nil.
+	ACL *ACL
+	// RateLimiter limits queries of clients, not limited if nil.
+	RateLimiter *RateLimiter
+	// Auth authenticates clients by tokens, any client is served without profile if nil.
+	Auth *DohAuth
+	mu   sync.RWMutex
 }
 
 func NewDohHandler() (h *DohHandler) {
@@ -20,6 +45,8 @@ func NewDohHandler() (h *DohHandler) {
 }
 
 func (h *DohHandler) AppendDefaultECSIPStr(ipStr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if ip := ObtainIPFromString(ipStr); ip != nil &&
 		!SliceContains(h.DefaultECSIPs, ip.String()) &&
 		!IsPrivateIP(ip) {
@@ -29,6 +56,8 @@ func (h *DohHandler) AppendDefaultECSIPStr(ipStr string) {
 }
 
 func (h *DohHandler) InsertDefaultECSIPStr(ipStr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if ip := ObtainIPFromString(ipStr); ip != nil &&
 		!SliceContains(h.DefaultECSIPs, ip.String()) &&
 		!IsPrivateIP(ip) {
@@ -37,55 +66,370 @@ func (h *DohHandler) InsertDefaultECSIPStr(ipStr string) {
 	}
 }
 
+// SetDefaultECSIPs replaces default ECS ips, queries in progress keep the previous ones.
+func (h *DohHandler) SetDefaultECSIPs(ips []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.DefaultECSIPs = ips
+}
+
+func (h *DohHandler) defaultECSIPs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.DefaultECSIPs
+}
+
+// SetACL replaces ACL of clients, nil to allow any client.
+func (h *DohHandler) SetACL(acl *ACL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ACL = acl
+}
+
+func (h *DohHandler) acl() *ACL {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ACL
+}
+
+// ACLMiddleware answers 403 to clients not allowed by ACL, client ip is taken from headers of trusted proxies.
+func (h *DohHandler) ACLMiddleware(c *gin.Context) {
+	if !h.acl().Allowed(net.ParseIP(c.ClientIP())) {
+		log.Debugf("doh query from %s refused by acl", c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Next()
+}
+
+// SetRateLimiter replaces rate limiter of client queries, nil to not limit.
+func (h *DohHandler) SetRateLimiter(l *RateLimiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.RateLimiter = l
+}
+
+func (h *DohHandler) rateLimiter() *RateLimiter {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.RateLimiter
+}
+
+// RateLimitMiddleware answers 429 to clients over rate limit.
+func (h *DohHandler) RateLimitMiddleware(c *gin.Context) {
+	if !h.rateLimiter().Allow(net.ParseIP(c.ClientIP())) {
+		rateLimitedCounter("doh").Inc()
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+	c.Next()
+}
+
+func (h *DohHandler) maxBodySize() int {
+	return FirstNonZero(h.MaxBodySize, DefaultDohMaxBodySize)
+}
+
+// DohGetHandler serves GET and HEAD queries in dns param, which is base64url encoded without padding.
 func (h *DohHandler) DohGetHandler(c *gin.Context) {
 	dnsQParam_ := c.Query("dns")
 	if s_ := strings.TrimSpace(dnsQParam_); s_ == "" {
-		log.Error("dns param is empty")
+		// Query in json api params on the DoH path.
+		if c.Query("name") != "" {
+			h.DohJsonHandler(c)
+			return
+		}
+		c.String(http.StatusBadRequest, "dns param is empty")
+		return
+	}
+	jsonRsp_, ok := NegotiateDohContentType(c.GetHeader("Accept"))
+	if !ok {
+		c.String(http.StatusNotAcceptable, "%s or %s not accepted", MimeTypeDnsMsg, MimeTypeDnsJson)
+		return
+	}
+	if base64.RawURLEncoding.DecodedLen(len(dnsQParam_)) > h.maxBodySize() {
+		c.String(http.StatusRequestEntityTooLarge, "dns param too large")
 		return
 	}
 
-	msgReqBytes_, err := base64.RawURLEncoding.DecodeString(dnsQParam_)
+	// Padding is not expected but tolerated.
+	msgReqBytes_, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(dnsQParam_, "="))
 	defer func() { msgReqBytes_ = nil }()
 	if err != nil {
-		log.Error(err)
+		c.String(http.StatusBadRequest, "dns param invalid: %v", err)
 		return
 	}
-	msgReq_ := new(dns.Msg)
+	msgReq_, err := unpackDohQuery(msgReqBytes_)
 	defer func() { msgReq_ = nil }()
-	err = msgReq_.Unpack(msgReqBytes_)
 	if err != nil {
-		log.Error(err)
+		c.String(http.StatusBadRequest, "dns param invalid: %v", err)
 		return
 	}
-	h.doDohResponse(c, msgReq_)
+	// Responses to the same url differ by Accept header.
+	c.Writer.Header().Add("Vary", "Accept")
+	h.doDohResponse(c, msgReq_, jsonRsp_)
 }
 
+// DohPostHandler serves queries in request body of application/dns-message.
 func (h *DohHandler) DohPostHandler(c *gin.Context) {
-	data_, err := c.GetRawData()
+	if c.ContentType() != MimeTypeDnsMsg {
+		c.String(http.StatusUnsupportedMediaType, "content type must be %s", MimeTypeDnsMsg)
+		return
+	}
+	jsonRsp_, ok := NegotiateDohContentType(c.GetHeader("Accept"))
+	if !ok {
+		c.String(http.StatusNotAcceptable, "%s or %s not accepted", MimeTypeDnsMsg, MimeTypeDnsJson)
+		return
+	}
+	if c.Request.ContentLength > int64(h.maxBodySize()) {
+		c.String(http.StatusRequestEntityTooLarge, "body too large")
+		return
+	}
+	data_, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(h.maxBodySize())+1))
 	if err != nil {
-		log.Error(err)
+		log.Debugf("doh body read error: %v", err)
+		c.String(http.StatusBadRequest, "body read error")
+		return
+	}
+	if len(data_) > h.maxBodySize() {
+		c.String(http.StatusRequestEntityTooLarge, "body too large")
 		return
 	}
-	msgReq_ := new(dns.Msg)
+	msgReq_, err := unpackDohQuery(data_)
 	defer func() { msgReq_ = nil }()
-	err = msgReq_.Unpack(data_)
 	if err != nil {
-		log.Error(err)
+		c.String(http.StatusBadRequest, "body invalid: %v", err)
+		return
+	}
+	h.doDohResponse(c, msgReq_, jsonRsp_)
+}
+
+// unpackDohQuery unpacks query message, responses and messages without question are rejected.
+func unpackDohQuery(data []byte) (msg *dns.Msg, err error) {
+	msg = new(dns.Msg)
+	if err = msg.Unpack(data); err != nil {
+		return nil, err
+	}
+	if msg.Response || len(msg.Question) == 0 {
+		return nil, fmt.Errorf("not a query")
+	}
+	return
+}
+
+// DohOptionsHandler answers OPTIONS, including CORS preflight requests of which headers are set by
+// CORSMiddleware.
+func (h *DohHandler) DohOptionsHandler(c *gin.Context) {
+	c.Header("Allow", "GET, HEAD, POST, OPTIONS")
+	c.Status(http.StatusNoContent)
+}
+
+// CORSMiddleware allows browser clients from origins to query, "*" allows any origin.
+func CORSMiddleware(origins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin_ := c.GetHeader("Origin")
+		if origin_ == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if SliceContains(origins, "*") {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else if SliceContains(origins, origin_) {
+			c.Header("Access-Control-Allow-Origin", origin_)
+		} else {
+			c.Next()
+			return
+		}
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type, Accept")
+			c.Header("Access-Control-Max-Age", strconv.Itoa(DohCORSMaxAge))
+		} else {
+			c.Header("Access-Control-Expose-Headers", "Content-Type, Cache-Control")
+		}
+		c.Next()
+	}
+}
+
+// DohJsonHandler serves json api queries like /resolve?name=example.com&type=A, params are the same as
+// Google's: name, type, cd, do, edns_client_subnet and ct.
+func (h *DohHandler) DohJsonHandler(c *gin.Context) {
+	msgReq_, err := NewDnsMsgFromJsonParams(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &DohJsonResolverRsp{Status: dns.RcodeFormatError, Comment: err.Error()})
+		return
+	}
+	h.doDohResponse(c, msgReq_, c.Query("ct") != MimeTypeDnsMsg)
+}
+
+// NewDnsMsgFromJsonParams builds query message from json api params.
+func NewDnsMsgFromJsonParams(params url.Values) (msg *dns.Msg, err error) {
+	name_ := strings.TrimSpace(params.Get("name"))
+	if name_ == "" {
+		return nil, fmt.Errorf("name param is empty")
+	}
+	if _, ok := dns.IsDomainName(name_); !ok {
+		return nil, fmt.Errorf("name param invalid: %s", name_)
+	}
+	qType_ := dns.TypeA
+	if s_ := strings.TrimSpace(params.Get("type")); s_ != "" {
+		if qType_, err = parseJsonQType(s_); err != nil {
+			return
+		}
+	}
+	msg = new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name_), qType_)
+	msg.CheckingDisabled = jsonParamTrue(params.Get("cd"))
+	dnssecOK_ := jsonParamTrue(params.Get("do"))
+	ecsParam_ := strings.TrimSpace(params.Get("edns_client_subnet"))
+	if !dnssecOK_ && ecsParam_ == "" {
 		return
 	}
-	h.doDohResponse(c, msgReq_)
+	msg.SetEdns0(DefaultReplyUDPSize, dnssecOK_)
+	if ecsParam_ != "" {
+		ecs_, err := parseJsonECSParam(ecsParam_)
+		if err != nil {
+			return nil, err
+		}
+		opt_ := msg.IsEdns0()
+		opt_.Option = append(opt_.Option, ecs_)
+	}
+	return
+}
+
+// parseJsonQType parses type param, which is a number or a mnemonic like AAAA.
+func parseJsonQType(s string) (qType uint16, err error) {
+	if n_, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(n_), nil
+	}
+	if qType, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+		return qType, nil
+	}
+	return 0, fmt.Errorf("type param invalid: %s", s)
+}
+
+func jsonParamTrue(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return s == "1" || s == "true"
 }
 
-func (h *DohHandler) responseEmpty(c *gin.Context, msgReq *dns.Msg) {
+// parseJsonECSParam parses edns_client_subnet param like 192.0.2.0/24, or an ip address.
+func parseJsonECSParam(s string) (ecs *dns.EDNS0_SUBNET, err error) {
+	ip_ := net.ParseIP(s)
+	ipNet_ := (*net.IPNet)(nil)
+	if ip_ == nil {
+		if ip_, ipNet_, err = net.ParseCIDR(s); err != nil {
+			return nil, fmt.Errorf("edns_client_subnet param invalid: %s", s)
+		}
+	} else {
+		ipNet_ = ECSSubnetOfIP(ip_)
+	}
+	ones_, _ := ipNet_.Mask.Size()
+	ecs = &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones_)}
+	if ip4_ := ip_.To4(); ip4_ != nil {
+		ecs.Family, ecs.Address = 1, ipNet_.IP.To4()
+	} else {
+		ecs.Family, ecs.Address = 2, ipNet_.IP.To16()
+	}
+	return
+}
+
+// NegotiateDohContentType picks response format by q-values of Accept header, wire format unless json is
+// preferred, ok is false if neither is acceptable.
+func NegotiateDohContentType(accept string) (jsonRsp, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return false, true
+	}
+	qMsg_, qJson_, qWildcard_ := -1.0, -1.0, -1.0
+	for _, v := range strings.Split(accept, ",") {
+		mediaType_, params_, _ := strings.Cut(strings.TrimSpace(v), ";")
+		q_ := 1.0
+		for _, param := range strings.Split(params_, ";") {
+			if k_, v_, _ := strings.Cut(strings.TrimSpace(param), "="); strings.TrimSpace(k_) == "q" {
+				if f_, err := strconv.ParseFloat(strings.TrimSpace(v_), 64); err == nil {
+					q_ = f_
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType_)) {
+		case MimeTypeDnsMsg:
+			qMsg_ = q_
+		case MimeTypeDnsJson, MimeTypeJson:
+			if q_ > qJson_ {
+				qJson_ = q_
+			}
+		case "*/*", "application/*":
+			if q_ > qWildcard_ {
+				qWildcard_ = q_
+			}
+		}
+	}
+	// Explicit types take precedence over wildcards.
+	if qMsg_ < 0 {
+		qMsg_ = qWildcard_
+	}
+	if qJson_ < 0 {
+		qJson_ = qWildcard_
+	}
+	if qMsg_ <= 0 && qJson_ <= 0 {
+		return false, false
+	}
+	return qJson_ > qMsg_, true
+}
+
+// DohCacheControl returns Cache-Control of response, max-age is the min TTL of records, negative answers
+// are cached by SOA as RFC 2308. Failures are not cached.
+func DohCacheControl(msg *dns.Msg) string {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return "no-store"
+	}
+	minTtl_ := -1
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl_ := int(rr.Header().Ttl)
+			if soa_, ok := rr.(*dns.SOA); ok && int(soa_.Minttl) < ttl_ {
+				ttl_ = int(soa_.Minttl)
+			}
+			if minTtl_ < 0 || ttl_ < minTtl_ {
+				minTtl_ = ttl_
+			}
+		}
+	}
+	if minTtl_ < 0 {
+		minTtl_ = 0
+	}
+	return fmt.Sprintf("max-age=%d", minTtl_)
+}
+
+func (h *DohHandler) responseEmpty(c *gin.Context, msgReq *dns.Msg, rCode int, jsonRsp bool) {
 	msgReq.Response = true
-	msgReq.Rcode = dns.RcodeSuccess
-	msgRspBytes_, err := msgReq.Pack()
+	msgReq.Rcode = rCode
+	_ = h.writeRsp(c, msgReq, jsonRsp)
+}
+
+// writeRsp writes dns message in json or wire format.
+func (h *DohHandler) writeRsp(c *gin.Context, msgRsp *dns.Msg, jsonRsp bool) (err error) {
+	var rspBytes_ []byte
+	if jsonRsp {
+		rspBytes_, err = json.Marshal(NewDohJsonResolverRspFromMsg(msgRsp))
+	} else {
+		rspBytes_, err = msgRsp.Pack()
+	}
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	c.Header("Content-Type", "application/dns-message")
-	_, err = c.Writer.Write(msgRspBytes_)
+	if jsonRsp {
+		c.Header("Content-Type", MimeTypeDnsJson)
+	} else {
+		c.Header("Content-Type", MimeTypeDnsMsg)
+	}
+	c.Header("Cache-Control", DohCacheControl(msgRsp))
+	c.Header("Content-Length", strconv.Itoa(len(rspBytes_)))
+	_, err = c.Writer.Write(rspBytes_)
 	if err != nil {
 		log.Error(err)
 		return
@@ -93,72 +437,89 @@ func (h *DohHandler) responseEmpty(c *gin.Context, msgReq *dns.Msg) {
 	return
 }
 
-func (h *DohHandler) doDohResponse(c *gin.Context, msgReq *dns.Msg) {
+func (h *DohHandler) doDohResponse(c *gin.Context, msgReq *dns.Msg, jsonRsp bool) {
 	// Ignore AAAA Question when configured to not answer
 	if len(msgReq.Question) > 0 && msgReq.Question[0].Qtype == dns.TypeAAAA && !ExecConfig.IPv6Answer {
 		c.Status(http.StatusOK)
-		h.responseEmpty(c, msgReq)
+		h.responseEmpty(c, msgReq, dns.RcodeSuccess, jsonRsp)
 		return
 	}
 
-	var tryEcsIPs_ []string
-	defer func() { tryEcsIPs_ = nil }()
-
-	// ECS in request dns message.
-	ecs_ := ObtainECS(msgReq)
-	if ecs_ != nil && ecs_.Address != nil && !IsPrivateIP(ecs_.Address) {
-		tryEcsIPs_ = append(tryEcsIPs_, ecs_.Address.String())
-	}
+	var clientEcsIPs_ []string
+	defer func() { clientEcsIPs_ = nil }()
 
 	// Custom Header for specifying EDNS-Client-Subnet.
 	if s_ := strings.TrimSpace(c.GetHeader("X-EDNS-Client-Subnet")); s_ != "" {
 		for _, s := range strings.Split(s_, ",") {
 			if ip := ObtainIPFromString(s); ip != nil &&
-				!SliceContains(tryEcsIPs_, ip.String()) &&
+				!SliceContains(clientEcsIPs_, ip.String()) &&
 				!IsPrivateIP(ip) {
 
-				tryEcsIPs_ = append(tryEcsIPs_, ip.String())
+				clientEcsIPs_ = append(clientEcsIPs_, ip.String())
 			}
 		}
 	}
 	// Client IP
 	if ip := ObtainIPFromString(c.ClientIP()); ExecConfig.DohConfig.UseClientIP &&
-		!SliceContains(tryEcsIPs_, c.ClientIP()) &&
+		!SliceContains(clientEcsIPs_, c.ClientIP()) &&
 		!IsPrivateIP(ip) {
 
-		tryEcsIPs_ = append(tryEcsIPs_, c.ClientIP())
+		clientEcsIPs_ = append(clientEcsIPs_, c.ClientIP())
 	}
-	tryEcsIPs_ = append(tryEcsIPs_, h.DefaultECSIPs...)
 
-	log.Debugf("edns_client_subnet param is %+v", tryEcsIPs_)
-	msgRsp_ := new(dns.Msg)
+	msgRsp_, err := h.resolveMsg(msgReq, clientEcsIPs_, DohProfileOf(c))
 	defer func() { msgRsp_ = nil }()
-	msgRsp_, err := RelayAnswerer.Answer(msgReq, strings.Join(tryEcsIPs_, ","))
-	defer func() { msgRsp_ = nil }()
-	if err != nil || msgRsp_ == nil {
-		log.Errorf("error when resolving %+v: %+v", msgReq.Question, err)
-		c.Status(http.StatusInternalServerError)
-		h.responseEmpty(c, msgReq)
+	if err != nil {
+		// DNS errors are replied with successful HTTP status (RFC 8484 4.2.1).
+		c.Status(http.StatusOK)
+		h.responseEmpty(c, msgReq, dns.RcodeServerFailure, jsonRsp)
 		return
 	}
-	// Restore request ECS.
-	if ecs_ == nil {
-		RemoveECSInDnsMsg(msgRsp_)
+	c.Status(http.StatusOK)
+	if err = h.writeRsp(c, msgRsp_, jsonRsp); err != nil && !c.Writer.Written() {
+		c.Status(http.StatusInternalServerError)
+		h.responseEmpty(c, msgReq, dns.RcodeServerFailure, jsonRsp)
+	}
+}
+
+// resolveMsg answers msgReq by answerer of profile, trying ECS in msgReq, then clientEcsIPs, then the default ECS
+// IPs of profile or the service. ECS of the reply is restored to the one in msgReq.
+func (h *DohHandler) resolveMsg(msgReq *dns.Msg, clientEcsIPs []string, profile *DohProfile) (msgRsp *dns.Msg,
+	err error) {
+
+	var tryEcsIPs_ []string
+	defer func() { tryEcsIPs_ = nil }()
+
+	// ECS in request dns message.
+	ecs_ := ObtainECS(msgReq)
+	if ecs_ != nil && ecs_.Address != nil && !IsPrivateIP(ecs_.Address) {
+		tryEcsIPs_ = append(tryEcsIPs_, ecs_.Address.String())
+	}
+	for _, ip := range clientEcsIPs {
+		if !SliceContains(tryEcsIPs_, ip) {
+			tryEcsIPs_ = append(tryEcsIPs_, ip)
+		}
+	}
+	if profile != nil && len(profile.DefaultECSIPs) > 0 {
+		tryEcsIPs_ = append(tryEcsIPs_, profile.DefaultECSIPs...)
 	} else {
-		ChangeECSInDnsMsg(msgRsp_, &ecs_.Address)
+		tryEcsIPs_ = append(tryEcsIPs_, h.defaultECSIPs()...)
 	}
-	msgRspBytes_, err := msgRsp_.Pack()
-	if err != nil {
-		log.Error(err)
-		c.Status(http.StatusInternalServerError)
-		h.responseEmpty(c, msgReq)
-		return
+
+	log.Debugf("edns_client_subnet param is %+v", tryEcsIPs_)
+	msgRsp, err = profile.answerer().Answer(msgReq, strings.Join(tryEcsIPs_, ","))
+	if err != nil || msgRsp == nil {
+		log.Errorf("error when resolving %+v: %+v", msgReq.Question, err)
+		if err == nil {
+			err = fmt.Errorf("no answer")
+		}
+		return nil, err
 	}
-	c.Status(http.StatusOK)
-	c.Header("Content-Type", "application/dns-message")
-	_, err = c.Writer.Write(msgRspBytes_)
-	if err != nil {
-		log.Error(err)
-		return
+	// Restore request ECS.
+	if ecs_ == nil {
+		RemoveECSInDnsMsg(msgRsp)
+	} else {
+		ChangeECSInDnsMsg(msgRsp, SubnetOfECS(ecs_))
 	}
+	return
 }
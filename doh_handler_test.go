@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +33,344 @@ func Test_Base64Encoding(t *testing.T) {
 		})
 	}
 }
+
+// rcodeTestNames maps query names to the RCODEs the fake upstream replies with.
+var rcodeTestNames = map[string]int{
+	"noerror.test.":   dns.RcodeSuccess,
+	"nxdomain.test.":  dns.RcodeNameError,
+	"servfail.test.":  dns.RcodeServerFailure,
+	"refused.test.":   dns.RcodeRefused,
+	"badcookie.test.": dns.RcodeBadCookie,
+}
+
+// rcodeAnswer replies with the RCODE mapped from query name, NXDOMAIN comes with a SOA record.
+func rcodeAnswer(msgReq *dns.Msg) (msgRsp *dns.Msg) {
+	msgRsp = fakeAnswer(msgReq)
+	if opt_ := msgReq.IsEdns0(); opt_ != nil {
+		msgRsp.SetEdns0(4096, opt_.Do())
+	}
+	rCode_, ok := rcodeTestNames[msgReq.Question[0].Name]
+	if !ok || rCode_ == dns.RcodeSuccess {
+		return
+	}
+	msgRsp.Answer = nil
+	msgRsp.Rcode = rCode_
+	if rCode_ == dns.RcodeNameError {
+		soa_, _ := dns.NewRR("test. 300 IN SOA ns.test. hostmaster.test. 1 7200 3600 1209600 60")
+		msgRsp.Ns = []dns.RR{soa_}
+	}
+	return
+}
+
+func TestDohHandler_Rcode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dohSrv_ := newFakeDohUpstream(t, rcodeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+	router_ := gin.New()
+	router_.GET("/dns-query", NewDohHandler().DohGetHandler)
+
+	for name, rCode := range rcodeTestNames {
+		t.Run(name, func(t *testing.T) {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			msgReq_.SetEdns0(1232, false)
+			msgReqBytes_, _ := msgReq_.Pack()
+			httpReq_ := httptest.NewRequest(http.MethodGet,
+				"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(msgReqBytes_), nil)
+			recorder_ := httptest.NewRecorder()
+			router_.ServeHTTP(recorder_, httpReq_)
+			if recorder_.Code != http.StatusOK {
+				t.Fatalf("http status = %d, want 200", recorder_.Code)
+			}
+			msgRsp_ := new(dns.Msg)
+			if err := msgRsp_.Unpack(recorder_.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Rcode != rCode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[msgRsp_.Rcode], dns.RcodeToString[rCode])
+			}
+		})
+	}
+}
+
+func TestDohHandler_JsonAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	InitGeoipReader("")
+	dohSrv_ := newFakeDohUpstream(t, rcodeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+	dohHandler_ := NewDohHandler()
+	router_ := gin.New()
+	router_.GET("/dns-query", dohHandler_.DohGetHandler)
+	router_.GET(DohJsonPath, dohHandler_.DohJsonHandler)
+
+	wireQuery_ := func() string {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("example.com.", dns.TypeA)
+		msgReqBytes_, _ := msgReq_.Pack()
+		return base64.RawURLEncoding.EncodeToString(msgReqBytes_)
+	}()
+	tests := []struct {
+		name        string
+		target      string
+		accept      string
+		wantCode    int
+		wantType    string
+		wantStatus  int
+		wantAnswers int
+		wantECS     string
+	}{
+		{"mnemonic type", DohJsonPath + "?name=example.com&type=A", "", 200, MimeTypeDnsJson, dns.RcodeSuccess, 1, ""},
+		{"numeric type", DohJsonPath + "?name=example.com.&type=1&cd=1", "", 200, MimeTypeDnsJson, dns.RcodeSuccess, 1, ""},
+		{"default type", DohJsonPath + "?name=example.com&do=true", "", 200, MimeTypeDnsJson, dns.RcodeSuccess, 1, ""},
+		{"nxdomain", DohJsonPath + "?name=nxdomain.test", "", 200, MimeTypeDnsJson, dns.RcodeNameError, 0, ""},
+		{"ecs", DohJsonPath + "?name=example.com&edns_client_subnet=198.51.100.7/24", "", 200, MimeTypeDnsJson,
+			dns.RcodeSuccess, 1, "198.51.100.0/24/0"},
+		{"wire ct", DohJsonPath + "?name=example.com&ct=application/dns-message", "", 200, MimeTypeDnsMsg,
+			dns.RcodeSuccess, 1, ""},
+		{"missing name", DohJsonPath + "?type=A", "", 400, "", 0, 0, ""},
+		{"invalid type", DohJsonPath + "?name=example.com&type=BOGUS", "", 400, "", 0, 0, ""},
+		{"invalid ecs", DohJsonPath + "?name=example.com&edns_client_subnet=bogus", "", 400, "", 0, 0, ""},
+		{"json params on doh path", "/dns-query?name=example.com", "", 200, MimeTypeDnsJson, dns.RcodeSuccess, 1, ""},
+		{"accept json on doh path", "/dns-query?dns=" + wireQuery_, MimeTypeDnsJson, 200, MimeTypeDnsJson,
+			dns.RcodeSuccess, 1, ""},
+		{"accept wire on doh path", "/dns-query?dns=" + wireQuery_, MimeTypeDnsMsg + ", " + MimeTypeDnsJson, 200,
+			MimeTypeDnsMsg, dns.RcodeSuccess, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq_ := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				httpReq_.Header.Set("Accept", tt.accept)
+			}
+			recorder_ := httptest.NewRecorder()
+			router_.ServeHTTP(recorder_, httpReq_)
+			if recorder_.Code != tt.wantCode {
+				t.Fatalf("http status = %d, want %d", recorder_.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if contentType_ := recorder_.Header().Get("Content-Type"); contentType_ != tt.wantType {
+				t.Fatalf("content type = %s, want %s", contentType_, tt.wantType)
+			}
+			var status_, answers_ int
+			var ecs_ string
+			if tt.wantType == MimeTypeDnsJson {
+				jsonRsp_ := new(DohJsonResolverRsp)
+				if err := json.Unmarshal(recorder_.Body.Bytes(), jsonRsp_); err != nil {
+					t.Fatal(err)
+				}
+				if len(jsonRsp_.Question) != 1 || jsonRsp_.Question[0].Name == "" {
+					t.Errorf("question = %v, want the query name", jsonRsp_.Question)
+				}
+				for _, rr := range jsonRsp_.AnswerV() {
+					if a_, ok := rr.(*dns.A); !ok || a_.A.String() != "192.0.2.1" {
+						t.Errorf("answer = %v, want A 192.0.2.1", rr)
+					}
+				}
+				status_, answers_, ecs_ = jsonRsp_.Status, len(jsonRsp_.Answer), jsonRsp_.EDNSClientSubnet
+			} else {
+				msgRsp_ := new(dns.Msg)
+				if err := msgRsp_.Unpack(recorder_.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				status_, answers_ = msgRsp_.Rcode, len(msgRsp_.Answer)
+			}
+			if status_ != tt.wantStatus || answers_ != tt.wantAnswers || ecs_ != tt.wantECS {
+				t.Errorf("status, answers, ecs = %d, %d, %q, want %d, %d, %q", status_, answers_, ecs_,
+					tt.wantStatus, tt.wantAnswers, tt.wantECS)
+			}
+		})
+	}
+}
+
+func TestDohHandler_HTTPSemantics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dohSrv_ := newFakeDohUpstream(t, rcodeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	dohHandler_ := NewDohHandler()
+	dohHandler_.MaxBodySize = 64
+	router_ := gin.New()
+	router_.Use(CORSMiddleware([]string{"https://app.example"}))
+	router_.GET("/dns-query", dohHandler_.DohGetHandler)
+	router_.HEAD("/dns-query", dohHandler_.DohGetHandler)
+	router_.POST("/dns-query", dohHandler_.DohPostHandler)
+	router_.OPTIONS("/dns-query", dohHandler_.DohOptionsHandler)
+
+	pack_ := func(name string, response bool) []byte {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion(name, dns.TypeA)
+		msgReq_.Response = response
+		msgReqBytes_, _ := msgReq_.Pack()
+		return msgReqBytes_
+	}
+	encode_ := func(name string) string { return base64.RawURLEncoding.EncodeToString(pack_(name, false)) }
+	longName_ := strings.Repeat("a", 60) + ".example."
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        []byte
+		headers     map[string]string
+		wantCode    int
+		wantType    string
+		wantCache   string
+		wantHeaders map[string]string
+	}{
+		{name: "get", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test."),
+			wantCode: 200, wantType: MimeTypeDnsMsg, wantCache: "max-age=300"},
+		{name: "get padded", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test.") + "==",
+			wantCode: 200, wantType: MimeTypeDnsMsg},
+		{name: "nxdomain cached by soa minimum", method: http.MethodGet,
+			target: "/dns-query?dns=" + encode_("nxdomain.test."), wantCode: 200, wantCache: "max-age=60"},
+		{name: "servfail not cached", method: http.MethodGet, target: "/dns-query?dns=" + encode_("servfail.test."),
+			wantCode: 200, wantCache: "no-store"},
+		{name: "head", method: http.MethodHead, target: "/dns-query?dns=" + encode_("noerror.test."),
+			wantCode: 200, wantType: MimeTypeDnsMsg},
+		{name: "missing dns", method: http.MethodGet, target: "/dns-query", wantCode: 400},
+		{name: "invalid base64", method: http.MethodGet, target: "/dns-query?dns=!!!", wantCode: 400},
+		{name: "invalid message", method: http.MethodGet, target: "/dns-query?dns=AAAA", wantCode: 400},
+		{name: "response message", method: http.MethodGet,
+			target:   "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(pack_("noerror.test.", true)),
+			wantCode: 400},
+		{name: "get too large", method: http.MethodGet, target: "/dns-query?dns=" + encode_(longName_),
+			wantCode: 413},
+		{name: "post", method: http.MethodPost, target: "/dns-query", body: pack_("noerror.test.", false),
+			headers: map[string]string{"Content-Type": MimeTypeDnsMsg}, wantCode: 200, wantType: MimeTypeDnsMsg,
+			wantCache: "max-age=300"},
+		{name: "post wrong type", method: http.MethodPost, target: "/dns-query", body: pack_("noerror.test.", false),
+			headers: map[string]string{"Content-Type": "application/octet-stream"}, wantCode: 415},
+		{name: "post too large", method: http.MethodPost, target: "/dns-query", body: pack_(longName_, false),
+			headers: map[string]string{"Content-Type": MimeTypeDnsMsg}, wantCode: 413},
+		{name: "post empty", method: http.MethodPost, target: "/dns-query",
+			headers: map[string]string{"Content-Type": MimeTypeDnsMsg}, wantCode: 400},
+		{name: "not acceptable", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test."),
+			headers: map[string]string{"Accept": "text/html"}, wantCode: 406},
+		{name: "accept by q", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test."),
+			headers:  map[string]string{"Accept": "application/dns-message;q=0.5, application/dns-json;q=0.9"},
+			wantCode: 200, wantType: MimeTypeDnsJson},
+		{name: "accept wildcard", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test."),
+			headers: map[string]string{"Accept": "application/dns-message;q=0, */*"}, wantCode: 200,
+			wantType: MimeTypeDnsJson},
+		{name: "cors", method: http.MethodGet, target: "/dns-query?dns=" + encode_("noerror.test."),
+			headers: map[string]string{"Origin": "https://app.example"}, wantCode: 200,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://app.example"}},
+		{name: "cors preflight", method: http.MethodOptions, target: "/dns-query",
+			headers:  map[string]string{"Origin": "https://app.example", "Access-Control-Request-Method": "POST"},
+			wantCode: 204, wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://app.example",
+				"Access-Control-Allow-Methods": "GET, HEAD, POST, OPTIONS"}},
+		{name: "cors origin not allowed", method: http.MethodOptions, target: "/dns-query",
+			headers: map[string]string{"Origin": "https://evil.example"}, wantCode: 204,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq_ := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			for k, v := range tt.headers {
+				httpReq_.Header.Set(k, v)
+			}
+			recorder_ := httptest.NewRecorder()
+			router_.ServeHTTP(recorder_, httpReq_)
+			if recorder_.Code != tt.wantCode {
+				t.Fatalf("http status = %d, want %d: %s", recorder_.Code, tt.wantCode, recorder_.Body.String())
+			}
+			if tt.wantType != "" && recorder_.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("content type = %s, want %s", recorder_.Header().Get("Content-Type"), tt.wantType)
+			}
+			if tt.wantCache != "" && recorder_.Header().Get("Cache-Control") != tt.wantCache {
+				t.Errorf("cache control = %s, want %s", recorder_.Header().Get("Cache-Control"), tt.wantCache)
+			}
+			for k, v := range tt.wantHeaders {
+				if recorder_.Header().Get(k) != v {
+					t.Errorf("%s = %q, want %q", k, recorder_.Header().Get(k), v)
+				}
+			}
+		})
+	}
+}
+
+func TestDohHandler_ACL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	dohHandler_ := NewDohHandler()
+	acl_, err := NewACL(&ACLConfigModel{Allow: []string{"192.0.2.0/24", "127.0.0.1"}, Deny: []string{"192.0.2.66"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dohHandler_.SetACL(acl_)
+	router_ := gin.New()
+	if err = router_.SetTrustedProxies([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	router_.RemoteIPHeaders = DefaultClientIPHeaders
+	router_.Use(dohHandler_.ACLMiddleware)
+	router_.GET("/dns-query", dohHandler_.DohGetHandler)
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReqBytes_, _ := msgReq_.Pack()
+	for name, tc := range map[string]struct {
+		remote   string
+		realIP   string
+		wantCode int
+	}{
+		"allowed":                  {remote: "192.0.2.7:5353", wantCode: http.StatusOK},
+		"denied":                   {remote: "192.0.2.66:5353", wantCode: http.StatusForbidden},
+		"not allowed":              {remote: "198.51.100.1:5353", wantCode: http.StatusForbidden},
+		"behind trusted proxy":     {remote: "127.0.0.1:5353", realIP: "198.51.100.1", wantCode: http.StatusForbidden},
+		"header of untrusted peer": {remote: "192.0.2.7:5353", realIP: "192.0.2.66", wantCode: http.StatusOK},
+	} {
+		httpReq_ := httptest.NewRequest(http.MethodGet,
+			"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(msgReqBytes_), nil)
+		httpReq_.RemoteAddr = tc.remote
+		if tc.realIP != "" {
+			httpReq_.Header.Set("X-Real-IP", tc.realIP)
+		}
+		recorder_ := httptest.NewRecorder()
+		router_.ServeHTTP(recorder_, httpReq_)
+		if recorder_.Code != tc.wantCode {
+			t.Errorf("%s: http status = %d, want %d", name, recorder_.Code, tc.wantCode)
+		}
+	}
+}
+
+func TestDohHandler_RateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, nil, nil),
+		nil, nil)
+	dohHandler_ := NewDohHandler()
+	rateLimiter_, _ := NewRateLimiter(&RateLimitConfigModel{Rate: 0.001, Burst: 2})
+	dohHandler_.SetRateLimiter(rateLimiter_)
+	router_ := gin.New()
+	router_.Use(dohHandler_.RateLimitMiddleware)
+	router_.GET("/dns-query", dohHandler_.DohGetHandler)
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	msgReqBytes_, _ := msgReq_.Pack()
+	query_ := func(remote string) *httptest.ResponseRecorder {
+		httpReq_ := httptest.NewRequest(http.MethodGet,
+			"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(msgReqBytes_), nil)
+		httpReq_.RemoteAddr = remote
+		recorder_ := httptest.NewRecorder()
+		router_.ServeHTTP(recorder_, httpReq_)
+		return recorder_
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if recorder_ := query_("192.0.2.7:5353"); recorder_.Code != want {
+			t.Fatalf("query %d: http status = %d, want %d", i, recorder_.Code, want)
+		}
+	}
+	if recorder_ := query_("192.0.2.7:5353"); recorder_.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After in 429")
+	}
+	if recorder_ := query_("192.0.2.8:5353"); recorder_.Code != http.StatusOK {
+		t.Fatalf("other client: http status = %d", recorder_.Code)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+)
+
+// NewDohHTTP3Server creates an HTTP/3 server sharing handler with the DoH service's tcp listener.
+func NewDohHTTP3Server(handler http.Handler) *http3.Server {
+	return &http3.Server{Handler: handler}
+}
+
+// AltSvcMiddleware advertises the HTTP/3 listener on responses over tcp, so clients switch to it.
+func AltSvcMiddleware(h3Server *http3.Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ProtoMajor < 3 {
+			if err := h3Server.SetQuicHeaders(c.Writer.Header()); err != nil {
+				log.Debugf("no Alt-Svc header for http3: %v", err)
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDohHTTP3Server(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pki_ := newTestPKI(t)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+
+	router_ := gin.New()
+	h3Server_ := NewDohHTTP3Server(router_)
+	router_.Use(AltSvcMiddleware(h3Server_))
+	router_.GET("/dns-query", NewDohHandler().DohGetHandler)
+
+	pc_, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3Server_.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{pki_.serverCert}})
+	go func() { _ = h3Server_.Serve(pc_) }()
+	t.Cleanup(func() {
+		_ = h3Server_.Close()
+		_ = pc_.Close()
+	})
+	tcpSrv_ := httptest.NewUnstartedServer(router_)
+	tcpSrv_.TLS = &tls.Config{Certificates: []tls.Certificate{pki_.serverCert}}
+	tcpSrv_.StartTLS()
+	t.Cleanup(tcpSrv_.Close)
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("example.com.", dns.TypeA)
+	msgReqBytes_, _ := msgReq_.Pack()
+	query_ := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(msgReqBytes_)
+	clientTLSConfig_ := &tls.Config{RootCAs: pki_.caPool}
+
+	h3RoundTripper_ := &http3.RoundTripper{TLSClientConfig: clientTLSConfig_}
+	defer func() { _ = h3RoundTripper_.Close() }()
+	httpRsp_, err := (&http.Client{Transport: h3RoundTripper_}).Get("https://" + pc_.LocalAddr().String() + query_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body_, _ := io.ReadAll(httpRsp_.Body)
+	_ = httpRsp_.Body.Close()
+	if httpRsp_.ProtoMajor != 3 {
+		t.Errorf("protocol = %s, want HTTP/3", httpRsp_.Proto)
+	}
+	if altSvc_ := httpRsp_.Header.Get("Alt-Svc"); altSvc_ != "" {
+		t.Errorf("Alt-Svc = %q over http3, want none", altSvc_)
+	}
+	msgRsp_ := new(dns.Msg)
+	if err = msgRsp_.Unpack(body_); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgRsp_.Answer) != 1 {
+		t.Errorf("answer = %v, want one A record", msgRsp_.Answer)
+	}
+
+	tcpClient_ := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig_}}
+	httpRsp_, err = tcpClient_.Get(tcpSrv_.URL + query_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = httpRsp_.Body.Close()
+	wantAltSvc_ := fmt.Sprintf(`h3=":%d"`, pc_.LocalAddr().(*net.UDPAddr).Port)
+	if altSvc_ := httpRsp_.Header.Get("Alt-Svc"); !strings.Contains(altSvc_, wantAltSvc_) {
+		t.Errorf("Alt-Svc = %q, want %s", altSvc_, wantAltSvc_)
+	}
+}
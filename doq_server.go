@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DoQALPN is the ALPN protocol identifier of DNS-over-QUIC (RFC 9250).
+	DoQALPN = "doq"
+	// DoQMaxIncomingStreams limits the queries in flight on a connection.
+	DoQMaxIncomingStreams = 256
+	// DoQShutdownLinger is how long replies written before shutdown have to be sent before connections are
+	// closed, quic-go drops stream data not sent yet on closing.
+	DoQShutdownLinger = 200 * time.Millisecond
+)
+
+// DNS-over-QUIC error codes, RFC 9250 section 4.3.
+const (
+	DoQNoError          = 0x0
+	DoQInternalError    = 0x1
+	DoQProtocolError    = 0x2
+	DoQRequestCancelled = 0x3
+	DoQExcessiveLoad    = 0x4
+)
+
+// DoQServer serves DNS-over-QUIC, every query arrives on its own bidirectional stream and is handed to
+// Handler as a dns53 query.
+type DoQServer struct {
+	Addr string
+	// PacketConn to serve on instead of listening on Addr, like a socket passed by systemd.
+	PacketConn net.PacketConn
+	TLSConfig  *tls.Config
+	// Handler to invoke, dns.DefaultServeMux if nil.
+	Handler     dns.Handler
+	IdleTimeout func() time.Duration
+	// NotifyStartedFunc is called once the server has started listening.
+	NotifyStartedFunc func()
+
+	mu        sync.Mutex
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	// inFlight counts queries being answered, accessed atomically.
+	inFlight int64
+	// answeredAt is unix nanoseconds of the last query answered, accessed atomically.
+	answeredAt int64
+}
+
+func (srv *DoQServer) handler() dns.Handler {
+	if srv.Handler == nil {
+		return dns.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+func (srv *DoQServer) idleTimeout() time.Duration {
+	if srv.IdleTimeout == nil {
+		return DefaultDns53IdleTimeout
+	}
+	return srv.IdleTimeout()
+}
+
+// ListenAndServe listens on srv.Addr, or serves srv.PacketConn if set, until Shutdown is called.
+func (srv *DoQServer) ListenAndServe() (err error) {
+	if srv.TLSConfig == nil {
+		return fmt.Errorf("doq server requires tls config")
+	}
+	tlsConfig_ := srv.TLSConfig.Clone()
+	tlsConfig_.NextProtos = []string{DoQALPN}
+	tlsConfig_.MinVersion = tls.VersionTLS13
+	conn_ := srv.PacketConn
+	if conn_ == nil {
+		var udpAddr_ *net.UDPAddr
+		if udpAddr_, err = net.ResolveUDPAddr("udp", srv.Addr); err != nil {
+			return
+		}
+		if conn_, err = net.ListenUDP("udp", udpAddr_); err != nil {
+			return
+		}
+	}
+	// Connections outlive the listener on its own transport, so they are drained on shutdown.
+	transport_ := &quic.Transport{Conn: conn_}
+	// 0-RTT is accepted, replayable data is only answered when it's a standard query, see serveStream.
+	listener_, err := transport_.ListenEarly(tlsConfig_, &quic.Config{
+		Allow0RTT:          true,
+		MaxIdleTimeout:     srv.idleTimeout(),
+		MaxIncomingStreams: DoQMaxIncomingStreams,
+	})
+	if err != nil {
+		_ = conn_.Close()
+		return
+	}
+	srv.mu.Lock()
+	srv.transport, srv.listener = transport_, listener_
+	srv.mu.Unlock()
+	if srv.NotifyStartedFunc != nil {
+		srv.NotifyStartedFunc()
+	}
+	for {
+		conn_, err := listener_.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go srv.serveConn(conn_)
+	}
+}
+
+// LocalAddr returns the address the server listens on, nil if not started.
+func (srv *DoQServer) LocalAddr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// Shutdown closes the listener and all connections at once.
+func (srv *DoQServer) Shutdown() error {
+	ctx_, cancel_ := context.WithCancel(context.Background())
+	cancel_()
+	if err := srv.ShutdownContext(ctx_); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// ShutdownContext stops accepting connections, waits for queries in flight and DoQShutdownLinger after the last
+// reply until ctx is done, then closes all connections.
+func (srv *DoQServer) ShutdownContext(ctx context.Context) (err error) {
+	srv.mu.Lock()
+	transport_, listener_ := srv.transport, srv.listener
+	srv.mu.Unlock()
+	if listener_ == nil {
+		return fmt.Errorf("doq server not started")
+	}
+	_ = listener_.Close()
+	ticker_ := time.NewTicker(10 * time.Millisecond)
+	defer ticker_.Stop()
+	for (atomic.LoadInt64(&srv.inFlight) > 0 ||
+		time.Since(time.Unix(0, atomic.LoadInt64(&srv.answeredAt))) < DoQShutdownLinger) && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker_.C:
+		}
+	}
+	_ = transport_.Close()
+	_ = transport_.Conn.Close()
+	return
+}
+
+func (srv *DoQServer) serveConn(conn quic.EarlyConnection) {
+	for {
+		stream_, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			log.Debugf("doq connection from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		go srv.serveStream(conn, stream_)
+	}
+}
+
+func (srv *DoQServer) serveStream(conn quic.EarlyConnection, stream quic.Stream) {
+	atomic.AddInt64(&srv.inFlight, 1)
+	defer func() {
+		atomic.StoreInt64(&srv.answeredAt, time.Now().UnixNano())
+		atomic.AddInt64(&srv.inFlight, -1)
+	}()
+	_ = stream.SetReadDeadline(time.Now().Add(srv.idleTimeout()))
+	msgReq_, err := readDoQMsg(stream)
+	if err != nil {
+		log.Debugf("doq read query from %s error: %v", conn.RemoteAddr(), err)
+		_ = conn.CloseWithError(DoQProtocolError, err.Error())
+		return
+	}
+	// The Message ID must be 0 on DoQ.
+	if msgReq_.Id != 0 {
+		_ = conn.CloseWithError(DoQProtocolError, "message id not 0")
+		return
+	}
+	// Data in 0-RTT may be replayed, which does no harm to standard queries. Others wait for the handshake.
+	if msgReq_.Opcode != dns.OpcodeQuery {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+	}
+	w_ := &doqResponseWriter{conn: conn, stream: stream}
+	srv.handler().ServeDNS(w_, msgReq_)
+	if !w_.written {
+		stream.CancelWrite(DoQInternalError)
+	}
+}
+
+// readDoQMsg reads a 2-octet length prefixed dns message, the client must end the stream after it. No more than
+// the length is read, so streams of trailing data are refused without being buffered.
+func readDoQMsg(r io.Reader) (msg *dns.Msg, err error) {
+	var length_ [2]byte
+	if _, err = io.ReadFull(r, length_[:]); err != nil {
+		return
+	}
+	buf_ := make([]byte, binary.BigEndian.Uint16(length_[:]))
+	if _, err = io.ReadFull(r, buf_); err != nil {
+		return nil, fmt.Errorf("doq message length mismatch: %v", err)
+	}
+	if _, err = io.ReadFull(r, length_[:1]); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("doq message length mismatch")
+		}
+		return nil, err
+	}
+	msg = new(dns.Msg)
+	if err = msg.Unpack(buf_); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// doqResponseWriter writes the reply of a query to its stream and ends the stream.
+type doqResponseWriter struct {
+	conn    quic.EarlyConnection
+	stream  quic.Stream
+	written bool
+}
+
+func (w *doqResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *doqResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *doqResponseWriter) WriteMsg(msg *dns.Msg) (err error) {
+	msg.Id = 0
+	buf_, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	_, err = w.Write(buf_)
+	return
+}
+
+func (w *doqResponseWriter) Write(buf []byte) (n int, err error) {
+	if w.written {
+		return 0, fmt.Errorf("doq reply already written")
+	}
+	if len(buf) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("doq reply too large: %d", len(buf))
+	}
+	w.written = true
+	if _, err = w.stream.Write(append(appendUint16(nil, uint16(len(buf))), buf...)); err != nil {
+		return
+	}
+	return len(buf), w.stream.Close()
+}
+
+func (w *doqResponseWriter) Close() error {
+	return w.stream.Close()
+}
+
+func (w *doqResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *doqResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *doqResponseWriter) Hijack() {}
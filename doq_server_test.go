@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"testing"
+	"time"
+)
+
+// doqExchange sends msgReq on a new stream of conn and reads the reply.
+func doqExchange(conn quic.Connection, msgReq *dns.Msg) (msgRsp *dns.Msg, err error) {
+	buf_, err := msgReq.Pack()
+	if err != nil {
+		return
+	}
+	stream_, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return
+	}
+	if _, err = stream_.Write(append(appendUint16(nil, uint16(len(buf_))), buf_...)); err != nil {
+		return
+	}
+	_ = stream_.Close()
+	_ = stream_.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return readDoQMsg(stream_)
+}
+
+func TestDoQServer(t *testing.T) {
+	pki_ := newTestPKI(t)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+
+	tlsConfig_, err := NewServerTLSConfig(pki_.serverCertFile, pki_.serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started_ := make(chan struct{})
+	server_ := &DoQServer{
+		Addr:              "127.0.0.1:0",
+		TLSConfig:         tlsConfig_,
+		Handler:           dns.HandlerFunc(NewDns53Handler().ServeDNS),
+		NotifyStartedFunc: func() { close(started_) },
+	}
+	go func() { _ = server_.ListenAndServe() }()
+	<-started_
+	t.Cleanup(func() { _ = server_.Shutdown() })
+	addr_ := server_.LocalAddr().String()
+
+	clientConfig_ := &tls.Config{
+		RootCAs:            pki_.caPool,
+		NextProtos:         []string{DoQALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	dial_ := func(tlsConfig *tls.Config) quic.EarlyConnection {
+		conn_, err := quic.DialAddrEarly(context.Background(), addr_, tlsConfig, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn_.CloseWithError(DoQNoError, "") })
+		return conn_
+	}
+
+	conn_ := dial_(clientConfig_)
+	// Queries on concurrent streams.
+	chErr_ := make(chan error)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		go func(name string) {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			msgReq_.Id = 0
+			msgRsp_, err := doqExchange(conn_, msgReq_)
+			if err != nil {
+				chErr_ <- err
+				return
+			}
+			if msgRsp_.Id != 0 || msgRsp_.Question[0].Name != name || len(msgRsp_.Answer) != 1 {
+				chErr_ <- errors.New("unexpected reply: " + msgRsp_.String())
+				return
+			}
+			chErr_ <- nil
+		}(name)
+	}
+	for i := 0; i < 3; i++ {
+		if err = <-chErr_; err != nil {
+			t.Error(err)
+		}
+	}
+	_ = conn_.CloseWithError(DoQNoError, "")
+
+	// Resumed connection sends its query in 0-RTT.
+	conn_ = dial_(clientConfig_)
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("d.example.", dns.TypeA)
+	msgReq_.Id = 0
+	if _, err = doqExchange(conn_, msgReq_); err != nil {
+		t.Fatal(err)
+	}
+	if !conn_.ConnectionState().Used0RTT {
+		t.Error("0-RTT not used on resumed connection")
+	}
+
+	// A non-zero message id is a protocol error. Without resumption, so the error code isn't concealed
+	// by a close during handshake.
+	conn_ = dial_(&tls.Config{RootCAs: pki_.caPool, NextProtos: []string{DoQALPN}})
+	msgReq_.Id = 1
+	_, err = doqExchange(conn_, msgReq_)
+	var appErr_ *quic.ApplicationError
+	if !errors.As(err, &appErr_) || appErr_.ErrorCode != DoQProtocolError {
+		t.Errorf("err = %v, want DOQ_PROTOCOL_ERROR", err)
+	}
+}
+
+func TestDoQServer_ShutdownContext(t *testing.T) {
+	pki_ := newTestPKI(t)
+	tlsConfig_, err := NewServerTLSConfig(pki_.serverCertFile, pki_.serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received_, release_ := make(chan struct{}), make(chan struct{})
+	started_ := make(chan struct{})
+	server_ := &DoQServer{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConfig_,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msgReq *dns.Msg) {
+			close(received_)
+			<-release_
+			_ = w.WriteMsg(fakeAnswer(msgReq))
+		}),
+		NotifyStartedFunc: func() { close(started_) },
+	}
+	chServe_ := make(chan error, 1)
+	go func() { chServe_ <- server_.ListenAndServe() }()
+	<-started_
+
+	conn_, err := quic.DialAddr(context.Background(), server_.LocalAddr().String(),
+		&tls.Config{RootCAs: pki_.caPool, NextProtos: []string{DoQALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn_.CloseWithError(DoQNoError, "") }()
+	chRsp_ := make(chan *dns.Msg, 1)
+	go func() {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.example.", dns.TypeA)
+		msgReq_.Id = 0
+		msgRsp_, err := doqExchange(conn_, msgReq_)
+		if err != nil {
+			t.Error(err)
+		}
+		chRsp_ <- msgRsp_
+	}()
+	<-received_
+
+	chShutdown_ := make(chan error, 1)
+	go func() { chShutdown_ <- server_.ShutdownContext(context.Background()) }()
+	if err = <-chServe_; err != nil {
+		t.Fatalf("serve error after shutdown: %v", err)
+	}
+	select {
+	case err = <-chShutdown_:
+		t.Fatalf("shutdown returned before query in flight answered: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release_)
+	if msgRsp_ := <-chRsp_; msgRsp_ == nil || len(msgRsp_.Answer) != 1 {
+		t.Fatalf("query in flight not answered: %v", msgRsp_)
+	}
+	if err = <-chShutdown_; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// endlessReader reads zeros endlessly, counting bytes read.
+type endlessReader struct {
+	n int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.n += len(p)
+	return len(p), nil
+}
+
+func TestReadDoQMsg(t *testing.T) {
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.test.", dns.TypeA)
+	buf_, err := msgReq_.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream_ := append(appendUint16(nil, uint16(len(buf_))), buf_...)
+	if msg_, err := readDoQMsg(bytes.NewReader(stream_)); err != nil || msg_.Question[0].Name != "a.test." {
+		t.Errorf("read = %v, %v", msg_, err)
+	}
+	for name, r := range map[string]io.Reader{
+		"short length": bytes.NewReader(stream_[:1]),
+		"short msg":    bytes.NewReader(stream_[:len(stream_)-1]),
+		"trailing":     bytes.NewReader(append(stream_, 0)),
+	} {
+		if _, err = readDoQMsg(r); err == nil {
+			t.Errorf("no error reading stream of %s", name)
+		}
+	}
+
+	// Streams of endless trailing data are refused without being read through.
+	endless_ := &endlessReader{}
+	if _, err = readDoQMsg(io.MultiReader(bytes.NewReader(stream_), endless_)); err == nil {
+		t.Error("no error reading stream of endless trailing data")
+	}
+	if endless_.n > 1 {
+		t.Errorf("read %d bytes of trailing data", endless_.n)
+	}
+}
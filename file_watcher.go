@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher tells if files something is loaded from are modified since, by their latest modification time.
+// It's embedded in what reloads files on lookups, so files are checked at most once every CheckInterval.
+type fileWatcher struct {
+	// files are watched, empty names are skipped.
+	files []string
+	// CheckInterval is how often files are checked.
+	CheckInterval time.Duration
+
+	mu        sync.Mutex
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// filesModTime returns the latest modification time of files.
+func (w *fileWatcher) filesModTime() (modTime time.Time, err error) {
+	for _, f := range w.files {
+		if f == "" {
+			continue
+		}
+		info_, err := os.Stat(f)
+		if err != nil {
+			return modTime, err
+		}
+		if info_.ModTime().After(modTime) {
+			modTime = info_.ModTime()
+		}
+	}
+	return
+}
+
+// load calls load, recording modification time of files before, so files modified while loading are loaded again.
+func (w *fileWatcher) load(load func() error) error {
+	modTime_, err := w.filesModTime()
+	if err != nil {
+		return err
+	}
+	if err = load(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.modTime, w.checkedAt = modTime_, time.Now()
+	w.mu.Unlock()
+	return nil
+}
+
+// modified tells if files are modified since loaded, checked CheckInterval ago.
+func (w *fileWatcher) modified() bool {
+	w.mu.Lock()
+	check_ := time.Since(w.checkedAt) >= w.CheckInterval
+	if check_ {
+		w.checkedAt = time.Now()
+	}
+	modTime_ := w.modTime
+	w.mu.Unlock()
+	if !check_ {
+		return false
+	}
+	newModTime_, err := w.filesModTime()
+	return err == nil && !newModTime_.Equal(modTime_)
+}
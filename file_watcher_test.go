@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	file_ := filepath.Join(t.TempDir(), "watched.txt")
+	if err := os.WriteFile(file_, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	touch_ := func(d time.Duration) {
+		if err := os.Chtimes(file_, time.Now(), time.Now().Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watcher_ := &fileWatcher{files: []string{file_, ""}, CheckInterval: time.Hour}
+	loads_ := 0
+	load_ := func() error {
+		loads_++
+		return nil
+	}
+	if err := watcher_.load(load_); err != nil || loads_ != 1 {
+		t.Fatalf("load = %v, loads %d", err, loads_)
+	}
+
+	// Files are not checked again within CheckInterval.
+	touch_(time.Second)
+	if watcher_.modified() {
+		t.Fatal("files checked within check interval")
+	}
+	watcher_.CheckInterval = 0
+	if !watcher_.modified() {
+		t.Fatal("modified files not told")
+	}
+
+	// Files stay modified until loaded successfully.
+	if err := watcher_.load(func() error { return fmt.Errorf("broken") }); err == nil {
+		t.Fatal("load error not returned")
+	}
+	if !watcher_.modified() {
+		t.Fatal("files not modified after failed load")
+	}
+	if err := watcher_.load(load_); err != nil || watcher_.modified() {
+		t.Fatalf("files modified after load: %v", err)
+	}
+
+	// Missing files are not told modified, they fail loading.
+	if err := os.Remove(file_); err != nil {
+		t.Fatal(err)
+	}
+	if watcher_.modified() {
+		t.Fatal("missing files told modified")
+	}
+	if err := watcher_.load(load_); err == nil || loads_ != 2 {
+		t.Fatalf("load of missing files = %v, loads %d", err, loads_)
+	}
+}
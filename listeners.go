@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// SystemdListenPrefix prefixes listen addresses of sockets passed by systemd socket activation, followed by
+	// the FileDescriptorName= of the socket, or its index among the passed sockets, like systemd/doh or systemd/0.
+	SystemdListenPrefix = "systemd/"
+	// UnixListenPrefix prefixes unix socket paths of stream listeners, mode may be set by query like
+	// unix:///run/doh-relay/doh.sock?mode=0660.
+	UnixListenPrefix = "unix://"
+	// systemdListenFdsStart is the first file descriptor passed by systemd, SD_LISTEN_FDS_START.
+	systemdListenFdsStart = 3
+)
+
+type systemdSocket struct {
+	name  string
+	file  *os.File
+	taken bool
+}
+
+var (
+	systemdMu      sync.Mutex
+	systemdLoaded  bool
+	systemdSockets []*systemdSocket
+)
+
+// loadSystemdSockets collects sockets passed by systemd by LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, nothing
+// if they were passed to another process.
+func loadSystemdSockets(getenv func(string) string, firstFd int) (sockets []*systemdSocket) {
+	if pid_, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid_ != os.Getpid() {
+		return
+	}
+	fds_, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || fds_ <= 0 {
+		return
+	}
+	names_ := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < fds_; i++ {
+		fd_ := firstFd + i
+		name_ := strconv.Itoa(i)
+		if i < len(names_) && names_[i] != "" {
+			name_ = names_[i]
+		}
+		sockets = append(sockets, &systemdSocket{name: name_, file: os.NewFile(uintptr(fd_), name_)})
+	}
+	return
+}
+
+// systemdFile takes the socket passed by systemd by name or index, sockets sharing a name are taken in order.
+func systemdFile(name string) (*os.File, error) {
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+	if !systemdLoaded {
+		systemdSockets = loadSystemdSockets(os.Getenv, systemdListenFdsStart)
+		for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(key)
+		}
+		systemdLoaded = true
+	}
+	for i, socket := range systemdSockets {
+		if !socket.taken && (socket.name == name || strconv.Itoa(i) == name) {
+			socket.taken = true
+			return socket.file, nil
+		}
+	}
+	return nil, fmt.Errorf("no socket %q passed by systemd", name)
+}
+
+// ValidListenAddr tells if addr is host:port, systemd/NAME or unix:///path, hostnames are resolved on listening.
+func ValidListenAddr(addr string) bool {
+	if strings.HasPrefix(addr, SystemdListenPrefix) {
+		return len(addr) > len(SystemdListenPrefix)
+	}
+	if strings.HasPrefix(addr, UnixListenPrefix) {
+		url_, err := url.Parse(addr)
+		return err == nil && url_.Path != ""
+	}
+	_, port_, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	portNum_, err := strconv.Atoi(port_)
+	return err == nil && portNum_ >= 0 && portNum_ < 65536
+}
+
+// ListenStream listens on addr of a stream listener, which is host:port, systemd/NAME or unix:///path.
+func ListenStream(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, SystemdListenPrefix) {
+		file_, err := systemdFile(strings.TrimPrefix(addr, SystemdListenPrefix))
+		if err != nil {
+			return nil, err
+		}
+		defer file_.Close()
+		return net.FileListener(file_)
+	}
+	if strings.HasPrefix(addr, UnixListenPrefix) {
+		return listenUnix(addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenPacket listens on addr of a udp listener, which is host:port or systemd/NAME.
+func ListenPacket(addr string) (*net.UDPConn, error) {
+	var conn_ net.PacketConn
+	var err error
+	if strings.HasPrefix(addr, SystemdListenPrefix) {
+		var file_ *os.File
+		if file_, err = systemdFile(strings.TrimPrefix(addr, SystemdListenPrefix)); err != nil {
+			return nil, err
+		}
+		defer file_.Close()
+		conn_, err = net.FilePacketConn(file_)
+	} else {
+		conn_, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	udpConn_, ok := conn_.(*net.UDPConn)
+	if !ok {
+		_ = conn_.Close()
+		return nil, fmt.Errorf("%s is not a udp socket", addr)
+	}
+	return udpConn_, nil
+}
+
+// listenUnix listens on unix socket, a stale socket file left by a previous run is removed.
+func listenUnix(addr string) (net.Listener, error) {
+	url_, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo_, err := os.Lstat(url_.Path); err == nil && fileInfo_.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(url_.Path)
+	}
+	listener_, err := net.Listen("unix", url_.Path)
+	if err != nil {
+		return nil, err
+	}
+	if mode_ := url_.Query().Get("mode"); mode_ != "" {
+		perm_, err := strconv.ParseUint(mode_, 8, 32)
+		if err == nil {
+			err = os.Chmod(url_.Path, os.FileMode(perm_))
+		}
+		if err != nil {
+			_ = listener_.Close()
+			return nil, fmt.Errorf("unix socket mode %s: %v", mode_, err)
+		}
+	}
+	return &localPeerListener{listener_}, nil
+}
+
+// localPeerListener reports peers of unix sockets as 127.0.0.1, so that local reverse proxies are trusted for
+// client ip headers like peers over loopback.
+type localPeerListener struct {
+	net.Listener
+}
+
+func (l *localPeerListener) Accept() (net.Conn, error) {
+	conn_, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &localPeerConn{conn_}, nil
+}
+
+type localPeerConn struct {
+	net.Conn
+}
+
+func (c *localPeerConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
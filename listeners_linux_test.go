@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestLoadSystemdSockets(t *testing.T) {
+	listener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener_.Close() }()
+	file_, err := listener_.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file_.Close() }()
+	// Sockets are owned by files of loadSystemdSockets as if passed by systemd, so pass a duplicate of file_.
+	fd_, err := syscall.Dup(int(file_.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env_ := map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "1", "LISTEN_FDNAMES": "doh"}
+	getenv_ := func(key string) string { return env_[key] }
+
+	if sockets_ := loadSystemdSockets(func(key string) string {
+		if key == "LISTEN_PID" {
+			return "1"
+		}
+		return getenv_(key)
+	}, fd_); len(sockets_) != 0 {
+		t.Fatal("sockets passed to another process are taken")
+	}
+
+	systemdMu.Lock()
+	systemdSockets, systemdLoaded = loadSystemdSockets(getenv_, fd_), true
+	systemdMu.Unlock()
+	t.Cleanup(func() {
+		systemdMu.Lock()
+		systemdSockets, systemdLoaded = nil, false
+		systemdMu.Unlock()
+	})
+
+	activated_, err := ListenStream(SystemdListenPrefix + "doh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = activated_.Close() }()
+	if activated_.Addr().String() != listener_.Addr().String() {
+		t.Fatalf("activated listener on %v, want %v", activated_.Addr(), listener_.Addr())
+	}
+	if _, err = ListenStream(SystemdListenPrefix + "doh"); err == nil {
+		t.Fatal("socket taken twice")
+	}
+}
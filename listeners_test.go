@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidListenAddr(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		":53":                            true,
+		"127.0.0.1:443":                  true,
+		"[::1]:443":                      true,
+		"localhost:8443":                 true,
+		"systemd/doh":                    true,
+		"unix:///run/doh.sock?mode=0660": true,
+		"53":                             false,
+		"127.0.0.1":                      false,
+		"localhost:https":                false,
+		"systemd/":                       false,
+		"unix://":                        false,
+		"127.0.0.1:65536":                false,
+	} {
+		if ValidListenAddr(addr) != valid {
+			t.Errorf("ValidListenAddr(%q) = %v", addr, !valid)
+		}
+	}
+}
+
+func TestListenStream_Unix(t *testing.T) {
+	path_ := filepath.Join(t.TempDir(), "doh.sock")
+	// Stale socket file of a previous run is replaced.
+	stale_, err := net.Listen("unix", path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale_.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale_.Close()
+
+	listener_, err := ListenStream(UnixListenPrefix + path_ + "?mode=0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener_.Close() }()
+	fileInfo_, err := os.Stat(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo_.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v", fileInfo_.Mode())
+	}
+
+	go func() {
+		if conn_, err := net.Dial("unix", path_); err == nil {
+			_ = conn_.Close()
+		}
+	}()
+	conn_, err := listener_.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn_.Close() }()
+	if host_, _, err := net.SplitHostPort(conn_.RemoteAddr().String()); err != nil || host_ != "127.0.0.1" {
+		t.Fatalf("peer address: %v", conn_.RemoteAddr())
+	}
+}
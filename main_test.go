@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_ParseListen(t *testing.T) {
@@ -41,3 +49,64 @@ func Test_ParseListen(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRsvAnswerer(t *testing.T) {
+	dns53Addr_ := newFakeDns53Upstream(t, fakeAnswer)
+	for _, tt := range []struct {
+		proto, endpoint, want string
+	}{
+		{"", "https://127.0.0.1/dns-query", "*main.DohDnsMsgResolver"},
+		{RelayUpstreamProtoDoh, "https://127.0.0.1/dns-query", "*main.DohDnsMsgResolver"},
+		{RelayUpstreamProtoJson, "https://127.0.0.1/resolve", "*main.DohJsonResolver"},
+		{RelayUpstreamProtoDns53, "tcp://" + dns53Addr_, "*main.Dns53DnsMsgResolver"},
+		{RelayUpstreamProtoRecursive, "127.0.0.1", "*main.RecursiveResolver"},
+		{RelayUpstreamProtoODoh, "https://127.0.0.1/proxy?targethost=odoh.example&targetpath=/dns-query",
+			"*main.ODoHResolver"},
+		{RelayUpstreamProtoDNSCrypt, "sdns://AQcAAAAAAAAACTEyNy4wLjAuMQ", "*main.DNSCryptResolver"},
+	} {
+		fixedResolving_ := []FixedResolvingConfigModel{{NameRegex: `\.lan\.$`, Server: tt.endpoint}}
+		conf_ := &ConfigModel{
+			DohConfig: DohConfigModel{UpstreamProto: tt.proto, Upstream: tt.endpoint, UpstreamFallback: tt.endpoint,
+				FixedResolving: fixedResolving_},
+			Dns53Config: Dns53ConfigModel{UpstreamProto: tt.proto, Upstream: tt.endpoint, UpstreamFallback: tt.endpoint,
+				FixedResolving: fixedResolving_},
+		}
+		for svc, answerer := range map[string]*DnsMsgAnswerer{
+			"doh": newDohRsvAnswerer(conf_), "dns53": newDns53RsvAnswerer(conf_),
+		} {
+			var fixed_ Resolver
+			for _, rsv := range answerer.FixedResolvers {
+				fixed_ = rsv
+			}
+			for _, rsv := range []Resolver{answerer.Resolver, answerer.FallbackResolver, fixed_} {
+				if got_ := fmt.Sprintf("%T", rsv); got_ != tt.want {
+					t.Errorf("%s resolver of upstream_proto %q = %s, want %s", svc, tt.proto, got_, tt.want)
+				}
+			}
+			answerer.Close()
+		}
+	}
+}
+
+func TestMain_Dns53ListenError(t *testing.T) {
+	// Runs main in the process started below.
+	if args_ := os.Getenv("DOH_RELAY_TEST_MAIN_ARGS"); args_ != "" {
+		os.Args = append(os.Args[:1], strings.Fields(args_)...)
+		main()
+		return
+	}
+	listener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener_.Close()
+	ctx_, cancel_ := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel_()
+	cmd_ := exec.CommandContext(ctx_, os.Args[0], "-test.run=^TestMain_Dns53ListenError$")
+	cmd_.Env = append(os.Environ(), "DOH_RELAY_TEST_MAIN_ARGS=-dns53 -dns53-listen tcp://"+listener_.Addr().String())
+	err = cmd_.Run()
+	var exitErr_ *exec.ExitError
+	if !errors.As(err, &exitErr_) || exitErr_.ExitCode() != ExitCodeServiceError {
+		t.Errorf("exit of dns53 service failed to listen: %v, want exit code %d", err, ExitCodeServiceError)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// MetricsNamespace prefixes names of metrics.
+	MetricsNamespace = "doh_relay"
+	// MetricsContentType is of the Prometheus text exposition format.
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Metrics holds counters of the process, exposed on the admin listener.
+var Metrics = &MetricsRegistry{}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	// value is accessed atomically.
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+type counterFamily struct {
+	help     string
+	counters map[string]*Counter
+}
+
+// MetricsRegistry creates counters by name and labels, and writes them in Prometheus text format.
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*counterFamily
+}
+
+// Counter returns counter of name, prefixed by MetricsNamespace, with labels of key and value pairs, created
+// on first use.
+func (r *MetricsRegistry) Counter(name, help string, labels ...string) *Counter {
+	name = MetricsNamespace + "_" + name
+	var labels_ []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value_ := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		labels_ = append(labels_, fmt.Sprintf(`%s="%s"`, labels[i], value_))
+	}
+	key_ := strings.Join(labels_, ",")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families == nil {
+		r.families = make(map[string]*counterFamily)
+	}
+	family_, ok := r.families[name]
+	if !ok {
+		family_ = &counterFamily{help: help, counters: make(map[string]*Counter)}
+		r.families[name] = family_
+	}
+	counter_, ok := family_.counters[key_]
+	if !ok {
+		counter_ = &Counter{}
+		family_.counters[key_] = counter_
+	}
+	return counter_
+}
+
+// Write writes all counters in Prometheus text format, sorted by name and labels.
+func (r *MetricsRegistry) Write(w io.Writer) (err error) {
+	r.mu.Lock()
+	var b_ strings.Builder
+	names_ := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names_ = append(names_, name)
+	}
+	sort.Strings(names_)
+	for _, name := range names_ {
+		family_ := r.families[name]
+		fmt.Fprintf(&b_, "# HELP %s %s\n# TYPE %s counter\n", name, family_.help, name)
+		keys_ := make([]string, 0, len(family_.counters))
+		for key := range family_.counters {
+			keys_ = append(keys_, key)
+		}
+		sort.Strings(keys_)
+		for _, key := range keys_ {
+			if key == "" {
+				fmt.Fprintf(&b_, "%s %d\n", name, family_.counters[key].Value())
+			} else {
+				fmt.Fprintf(&b_, "%s{%s} %d\n", name, key, family_.counters[key].Value())
+			}
+		}
+	}
+	r.mu.Unlock()
+	_, err = io.WriteString(w, b_.String())
+	return
+}
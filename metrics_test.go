@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsRegistry_Write(t *testing.T) {
+	metrics_ := &MetricsRegistry{}
+	metrics_.Counter("rrl_responses_total", "Responses over limit.", "class", "responses", "action", "slip").Inc()
+	metrics_.Counter("rrl_responses_total", "Responses over limit.", "class", "errors", "action", "drop").Inc()
+	metrics_.Counter("rrl_responses_total", "Responses over limit.", "class", "responses", "action", "slip").Inc()
+	metrics_.Counter("reloads_total", "Reloads.").Inc()
+
+	adminSrv_ := httptest.NewServer(NewAdminHandler(&ConfigReloader{}, metrics_))
+	defer adminSrv_.Close()
+	httpRsp_, err := http.Get(adminSrv_.URL + AdminMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = httpRsp_.Body.Close() }()
+	body_, _ := io.ReadAll(httpRsp_.Body)
+	want_ := `# HELP doh_relay_reloads_total Reloads.
+# TYPE doh_relay_reloads_total counter
+doh_relay_reloads_total 1
+# HELP doh_relay_rrl_responses_total Responses over limit.
+# TYPE doh_relay_rrl_responses_total counter
+doh_relay_rrl_responses_total{class="errors",action="drop"} 1
+doh_relay_rrl_responses_total{class="responses",action="slip"} 2
+`
+	if httpRsp_.StatusCode != http.StatusOK || httpRsp_.Header.Get("Content-Type") != MetricsContentType ||
+		string(body_) != want_ {
+		t.Fatalf("metrics: %d %s\n%s", httpRsp_.StatusCode, httpRsp_.Header.Get("Content-Type"), body_)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"io"
+)
+
+// Oblivious DNS over HTTPS, RFC 9230.
+
+const (
+	ODoHVersion     = 0x0001
+	ODoHConfigsPath = "/.well-known/odohconfigs"
+
+	ODoHMessageTypeQuery    = 0x01
+	ODoHMessageTypeResponse = 0x02
+
+	odohQueryInfo     = "odoh query"
+	odohResponseLabel = "odoh response"
+	odohKeyIDLabel    = "odoh key id"
+	odohKeyLabel      = "odoh key"
+	odohNonceLabel    = "odoh nonce"
+
+	// Pad plaintexts to block sizes recommended by RFC 8467.
+	odohQueryPaddingBlock    = 128
+	odohResponsePaddingBlock = 468
+)
+
+var ErrODoHDecryption = errors.New("odoh decryption failed")
+
+// ODoHConfigContents is the HPKE settings of an ODoH target.
+type ODoHConfigContents struct {
+	KemID     hpke.KEM
+	KdfID     hpke.KDF
+	AeadID    hpke.AEAD
+	PublicKey []byte
+}
+
+func (c ODoHConfigContents) Marshal() []byte {
+	b_ := make([]byte, 8, 8+len(c.PublicKey))
+	binary.BigEndian.PutUint16(b_[0:], uint16(c.KemID))
+	binary.BigEndian.PutUint16(b_[2:], uint16(c.KdfID))
+	binary.BigEndian.PutUint16(b_[4:], uint16(c.AeadID))
+	binary.BigEndian.PutUint16(b_[6:], uint16(len(c.PublicKey)))
+	return append(b_, c.PublicKey...)
+}
+
+// KeyID identifies the config in queries.
+func (c ODoHConfigContents) KeyID() []byte {
+	prk_ := c.KdfID.Extract(c.Marshal(), nil)
+	return c.KdfID.Expand(prk_, []byte(odohKeyIDLabel), uint(c.KdfID.ExtractSize()))
+}
+
+func (c ODoHConfigContents) suite() (suite hpke.Suite, err error) {
+	if !c.KemID.IsValid() || !c.KdfID.IsValid() || !c.AeadID.IsValid() {
+		return suite, fmt.Errorf("odoh config suite not supported: kem %d, kdf %d, aead %d",
+			c.KemID, c.KdfID, c.AeadID)
+	}
+	return hpke.NewSuite(c.KemID, c.KdfID, c.AeadID), nil
+}
+
+// MarshalODoHConfigs encodes configs as served on ODoHConfigsPath.
+func MarshalODoHConfigs(configs ...ODoHConfigContents) []byte {
+	var buf_ bytes.Buffer
+	for _, c := range configs {
+		contents_ := c.Marshal()
+		_ = binary.Write(&buf_, binary.BigEndian, uint16(ODoHVersion))
+		_ = binary.Write(&buf_, binary.BigEndian, uint16(len(contents_)))
+		buf_.Write(contents_)
+	}
+	return append(appendUint16(nil, uint16(buf_.Len())), buf_.Bytes()...)
+}
+
+// ParseODoHConfigs decodes configs, those of unknown versions or unsupported suites are skipped.
+func ParseODoHConfigs(b []byte) (configs []ODoHConfigContents, err error) {
+	configsBytes_, _, err := readUint16Prefixed(b)
+	if err != nil {
+		return nil, fmt.Errorf("odoh configs invalid: %v", err)
+	}
+	for len(configsBytes_) > 0 {
+		if len(configsBytes_) < 2 {
+			return nil, fmt.Errorf("odoh configs invalid: truncated")
+		}
+		version_ := binary.BigEndian.Uint16(configsBytes_)
+		var contents_ []byte
+		contents_, configsBytes_, err = readUint16Prefixed(configsBytes_[2:])
+		if err != nil {
+			return nil, fmt.Errorf("odoh configs invalid: %v", err)
+		}
+		if version_ != ODoHVersion || len(contents_) < 6 {
+			continue
+		}
+		c_ := ODoHConfigContents{
+			KemID:  hpke.KEM(binary.BigEndian.Uint16(contents_[0:])),
+			KdfID:  hpke.KDF(binary.BigEndian.Uint16(contents_[2:])),
+			AeadID: hpke.AEAD(binary.BigEndian.Uint16(contents_[4:])),
+		}
+		if c_.PublicKey, _, err = readUint16Prefixed(contents_[6:]); err != nil {
+			return nil, fmt.Errorf("odoh config public key invalid: %v", err)
+		}
+		if _, err := c_.suite(); err != nil {
+			log.Debugf("skipping odoh config: %v", err)
+			continue
+		}
+		configs = append(configs, c_)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no supported odoh config")
+	}
+	return
+}
+
+// ODoHMessage is the message body of application/oblivious-dns-message.
+type ODoHMessage struct {
+	Type             uint8
+	KeyID            []byte
+	EncryptedMessage []byte
+}
+
+func (m *ODoHMessage) Marshal() []byte {
+	b_ := make([]byte, 0, 5+len(m.KeyID)+len(m.EncryptedMessage))
+	b_ = append(b_, m.Type)
+	b_ = appendUint16(b_, uint16(len(m.KeyID)))
+	b_ = append(b_, m.KeyID...)
+	b_ = appendUint16(b_, uint16(len(m.EncryptedMessage)))
+	return append(b_, m.EncryptedMessage...)
+}
+
+func ParseODoHMessage(b []byte) (m *ODoHMessage, err error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("odoh message empty")
+	}
+	m = &ODoHMessage{Type: b[0]}
+	rest_ := b[1:]
+	if m.KeyID, rest_, err = readUint16Prefixed(rest_); err != nil {
+		return nil, fmt.Errorf("odoh message key id invalid: %v", err)
+	}
+	if m.EncryptedMessage, rest_, err = readUint16Prefixed(rest_); err != nil {
+		return nil, fmt.Errorf("odoh message encrypted message invalid: %v", err)
+	}
+	if len(rest_) != 0 {
+		return nil, fmt.Errorf("odoh message has trailing data")
+	}
+	return
+}
+
+// aad is the associated data for the message's AEAD encryption.
+func (m *ODoHMessage) aad() []byte {
+	aad_ := appendUint16([]byte{m.Type}, uint16(len(m.KeyID)))
+	return append(aad_, m.KeyID...)
+}
+
+// ODoHQueryContext keeps the states of a query for decrypting its response.
+type ODoHQueryContext struct {
+	suite     hpke.Suite
+	secret    []byte
+	plaintext []byte
+}
+
+// EncryptQuery encrypts the dns message to the target of config.
+func (c ODoHConfigContents) EncryptQuery(dnsMsg []byte) (msg *ODoHMessage, ctx *ODoHQueryContext, err error) {
+	suite_, err := c.suite()
+	if err != nil {
+		return
+	}
+	pk_, err := c.KemID.Scheme().UnmarshalBinaryPublicKey(c.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh config public key invalid: %v", err)
+	}
+	sender_, err := suite_.NewSender(pk_, []byte(odohQueryInfo))
+	if err != nil {
+		return
+	}
+	enc_, sealer_, err := sender_.Setup(rand.Reader)
+	if err != nil {
+		return
+	}
+	plaintext_ := marshalODoHPlaintext(dnsMsg, odohQueryPaddingBlock)
+	msg = &ODoHMessage{Type: ODoHMessageTypeQuery, KeyID: c.KeyID()}
+	ct_, err := sealer_.Seal(plaintext_, msg.aad())
+	if err != nil {
+		return nil, nil, err
+	}
+	msg.EncryptedMessage = append(enc_, ct_...)
+	_, _, aead_ := suite_.Params()
+	ctx = &ODoHQueryContext{
+		suite:     suite_,
+		secret:    sealer_.Export([]byte(odohResponseLabel), aead_.KeySize()),
+		plaintext: plaintext_,
+	}
+	return
+}
+
+// DecryptResponse decrypts the response message to the query.
+func (ctx *ODoHQueryContext) DecryptResponse(msg *ODoHMessage) (dnsMsg []byte, err error) {
+	if msg.Type != ODoHMessageTypeResponse {
+		return nil, fmt.Errorf("odoh message type is not response: %d", msg.Type)
+	}
+	aead_, nonce_, err := deriveODoHResponseAEAD(ctx.suite, ctx.secret, ctx.plaintext, msg.KeyID)
+	if err != nil {
+		return
+	}
+	plaintext_, err := aead_.Open(nil, nonce_, msg.EncryptedMessage, msg.aad())
+	if err != nil {
+		return nil, ErrODoHDecryption
+	}
+	return parseODoHPlaintext(plaintext_)
+}
+
+// ODoHKeyPair is the HPKE key pair of an ODoH target.
+type ODoHKeyPair struct {
+	Config     ODoHConfigContents
+	privateKey kem.PrivateKey
+}
+
+// NewODoHKeyPair generates a key pair with the suite of X25519, HKDF-SHA256 and AES-128-GCM.
+func NewODoHKeyPair() (kp *ODoHKeyPair, err error) {
+	kemID_ := hpke.KEM_X25519_HKDF_SHA256
+	pk_, sk_, err := kemID_.Scheme().GenerateKeyPair()
+	if err != nil {
+		return
+	}
+	pkBytes_, err := pk_.MarshalBinary()
+	if err != nil {
+		return
+	}
+	return &ODoHKeyPair{
+		Config: ODoHConfigContents{
+			KemID:     kemID_,
+			KdfID:     hpke.KDF_HKDF_SHA256,
+			AeadID:    hpke.AEAD_AES128GCM,
+			PublicKey: pkBytes_,
+		},
+		privateKey: sk_,
+	}, nil
+}
+
+// ODoHResponseContext keeps the states of a decrypted query for encrypting its response.
+type ODoHResponseContext struct {
+	ODoHQueryContext
+}
+
+// DecryptQuery decrypts a query message encrypted to the key pair.
+func (kp *ODoHKeyPair) DecryptQuery(msg *ODoHMessage) (dnsMsg []byte, ctx *ODoHResponseContext, err error) {
+	if msg.Type != ODoHMessageTypeQuery {
+		return nil, nil, fmt.Errorf("odoh message type is not query: %d", msg.Type)
+	}
+	if !bytes.Equal(msg.KeyID, kp.Config.KeyID()) {
+		return nil, nil, ErrODoHDecryption
+	}
+	suite_, err := kp.Config.suite()
+	if err != nil {
+		return
+	}
+	encSize_ := kp.Config.KemID.Scheme().CiphertextSize()
+	if len(msg.EncryptedMessage) < encSize_ {
+		return nil, nil, ErrODoHDecryption
+	}
+	receiver_, err := suite_.NewReceiver(kp.privateKey, []byte(odohQueryInfo))
+	if err != nil {
+		return
+	}
+	opener_, err := receiver_.Setup(msg.EncryptedMessage[:encSize_])
+	if err != nil {
+		return nil, nil, ErrODoHDecryption
+	}
+	plaintext_, err := opener_.Open(msg.EncryptedMessage[encSize_:], msg.aad())
+	if err != nil {
+		return nil, nil, ErrODoHDecryption
+	}
+	if dnsMsg, err = parseODoHPlaintext(plaintext_); err != nil {
+		return
+	}
+	_, _, aead_ := suite_.Params()
+	ctx = &ODoHResponseContext{ODoHQueryContext{
+		suite:     suite_,
+		secret:    opener_.Export([]byte(odohResponseLabel), aead_.KeySize()),
+		plaintext: plaintext_,
+	}}
+	return
+}
+
+// EncryptResponse encrypts the response dns message to the query.
+func (ctx *ODoHResponseContext) EncryptResponse(dnsMsg []byte) (msg *ODoHMessage, err error) {
+	_, _, aeadID_ := ctx.suite.Params()
+	nonceSize_ := aeadID_.KeySize()
+	if aeadID_.NonceSize() > nonceSize_ {
+		nonceSize_ = aeadID_.NonceSize()
+	}
+	nonce_ := make([]byte, nonceSize_)
+	if _, err = io.ReadFull(rand.Reader, nonce_); err != nil {
+		return
+	}
+	aead_, aeadNonce_, err := deriveODoHResponseAEAD(ctx.suite, ctx.secret, ctx.plaintext, nonce_)
+	if err != nil {
+		return
+	}
+	msg = &ODoHMessage{Type: ODoHMessageTypeResponse, KeyID: nonce_}
+	msg.EncryptedMessage = aead_.Seal(nil, aeadNonce_, marshalODoHPlaintext(dnsMsg, odohResponsePaddingBlock),
+		msg.aad())
+	return
+}
+
+// deriveODoHResponseAEAD derives key and nonce of response encryption from the query context.
+func deriveODoHResponseAEAD(suite hpke.Suite, secret, queryPlaintext, responseNonce []byte) (
+	aead cipher.AEAD, nonce []byte, err error) {
+
+	_, kdf_, aeadID_ := suite.Params()
+	salt_ := append(append([]byte{}, queryPlaintext...), appendUint16(nil,
+		uint16(len(responseNonce)))...)
+	salt_ = append(salt_, responseNonce...)
+	prk_ := kdf_.Extract(secret, salt_)
+	key_ := kdf_.Expand(prk_, []byte(odohKeyLabel), aeadID_.KeySize())
+	nonce = kdf_.Expand(prk_, []byte(odohNonceLabel), aeadID_.NonceSize())
+	aead, err = aeadID_.New(key_)
+	return
+}
+
+// marshalODoHPlaintext encodes the dns message with zero padding to a multiple of block size.
+func marshalODoHPlaintext(dnsMsg []byte, block int) []byte {
+	paddingLen_ := 0
+	if rem_ := (len(dnsMsg) + 4) % block; rem_ != 0 {
+		paddingLen_ = block - rem_
+	}
+	b_ := make([]byte, 0, len(dnsMsg)+4+paddingLen_)
+	b_ = appendUint16(b_, uint16(len(dnsMsg)))
+	b_ = append(b_, dnsMsg...)
+	b_ = appendUint16(b_, uint16(paddingLen_))
+	return append(b_, make([]byte, paddingLen_)...)
+}
+
+func parseODoHPlaintext(b []byte) (dnsMsg []byte, err error) {
+	dnsMsg, rest_, err := readUint16Prefixed(b)
+	if err != nil || len(dnsMsg) == 0 {
+		return nil, fmt.Errorf("odoh plaintext dns message invalid")
+	}
+	padding_, rest_, err := readUint16Prefixed(rest_)
+	if err != nil || len(rest_) != 0 {
+		return nil, fmt.Errorf("odoh plaintext padding invalid")
+	}
+	for _, p := range padding_ {
+		if p != 0 {
+			return nil, fmt.Errorf("odoh plaintext padding not zero")
+		}
+	}
+	return
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// readUint16Prefixed reads the data prefixed by 2-byte length.
+func readUint16Prefixed(b []byte) (data, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	len_ := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+len_ {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[2 : 2+len_], b[2+len_:], nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultODoHProxyPath = "/proxy"
+	// DefaultODoHKeyRotation is how often a target generates a new key pair.
+	DefaultODoHKeyRotation = 24 * time.Hour
+	// ODoHMaxMessageSize limits the body of oblivious queries and responses.
+	ODoHMaxMessageSize = 64 * 1024
+)
+
+// ODoHTargetHandler serves as an oblivious target, it decrypts queries forwarded by oblivious proxies and
+// answers them by DohHandler.
+type ODoHTargetHandler struct {
+	dohHandler *DohHandler
+	mu         sync.RWMutex
+	// The previous key pair is still accepted after rotation, for clients caching the previous configs.
+	keyPair     *ODoHKeyPair
+	prevKeyPair *ODoHKeyPair
+}
+
+// NewODoHTargetHandler creates a target with a new key pair, which is rotated every rotation interval if
+// it's positive.
+func NewODoHTargetHandler(dohHandler *DohHandler, rotation time.Duration) (h *ODoHTargetHandler) {
+	h = &ODoHTargetHandler{dohHandler: dohHandler}
+	if err := h.RotateKey(); err != nil {
+		panic(err)
+	}
+	if rotation > 0 {
+		go func() {
+			for range time.Tick(rotation) {
+				if err := h.RotateKey(); err != nil {
+					log.Errorf("odoh key rotation error: %v", err)
+				}
+			}
+		}()
+	}
+	return
+}
+
+// RotateKey generates a new key pair, and keeps the current one as previous.
+func (h *ODoHTargetHandler) RotateKey() error {
+	keyPair_, err := NewODoHKeyPair()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.prevKeyPair, h.keyPair = h.keyPair, keyPair_
+	h.mu.Unlock()
+	log.Infof("odoh target key id: %x", keyPair_.Config.KeyID())
+	return nil
+}
+
+// keyPairOf returns the key pair which the message is encrypted to.
+func (h *ODoHTargetHandler) keyPairOf(msg *ODoHMessage) *ODoHKeyPair {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, kp := range []*ODoHKeyPair{h.keyPair, h.prevKeyPair} {
+		if kp != nil && bytes.Equal(kp.Config.KeyID(), msg.KeyID) {
+			return kp
+		}
+	}
+	return nil
+}
+
+// ConfigsHandler publishes configs of the current key pair.
+func (h *ODoHTargetHandler) ConfigsHandler(c *gin.Context) {
+	h.mu.RLock()
+	config_ := h.keyPair.Config
+	h.mu.RUnlock()
+	c.Header("Cache-Control", fmt.Sprintf("max-age=%d", int(ODoHConfigsTTL.Seconds())))
+	c.Data(http.StatusOK, "application/octet-stream", MarshalODoHConfigs(config_))
+}
+
+// Wrap dispatches oblivious queries to the target, and others to next.
+func (h *ODoHTargetHandler) Wrap(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.ContentType() == MimeTypeODoHMsg {
+			h.QueryHandler(c)
+			return
+		}
+		next(c)
+	}
+}
+
+// QueryHandler answers an oblivious query, the client ip is the proxy's and not used as ECS.
+func (h *ODoHTargetHandler) QueryHandler(c *gin.Context) {
+	body_, err := io.ReadAll(io.LimitReader(c.Request.Body, ODoHMaxMessageSize))
+	if err != nil {
+		log.Error(err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	odohReq_, err := ParseODoHMessage(body_)
+	if err != nil {
+		log.Debugf("odoh query invalid: %v", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	keyPair_ := h.keyPairOf(odohReq_)
+	if keyPair_ == nil {
+		// Tell the client to refetch configs.
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	msgReqBytes_, rspCtx_, err := keyPair_.DecryptQuery(odohReq_)
+	if err != nil {
+		log.Debugf("odoh query decryption error: %v", err)
+		if errors.Is(err, ErrODoHDecryption) {
+			c.Status(http.StatusUnauthorized)
+		} else {
+			c.Status(http.StatusBadRequest)
+		}
+		return
+	}
+	msgReq_ := new(dns.Msg)
+	if err = msgReq_.Unpack(msgReqBytes_); err != nil {
+		log.Debugf("odoh query dns message invalid: %v", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	msgRsp_, err := h.dohHandler.resolveMsg(msgReq_, nil, DohProfileOf(c))
+	if err != nil {
+		// DNS errors are replied in the encrypted dns message.
+		msgRsp_ = new(dns.Msg)
+		msgRsp_.SetRcode(msgReq_, dns.RcodeServerFailure)
+	}
+	msgRspBytes_, err := msgRsp_.Pack()
+	if err != nil {
+		log.Error(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	odohRsp_, err := rspCtx_.EncryptResponse(msgRspBytes_)
+	if err != nil {
+		log.Error(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Data(http.StatusOK, MimeTypeODoHMsg, odohRsp_.Marshal())
+}
+
+// ODoHProxyHandler serves as an oblivious proxy, it forwards sealed queries to allowed targets without
+// anything identifying clients.
+type ODoHProxyHandler struct {
+	httpClient     *http.Client
+	allowedTargets []string
+}
+
+func NewODoHProxyHandler(allowedTargets []string, upstreamOptions *UpstreamOptions) (h *ODoHProxyHandler) {
+	httpTransport_ := &http.Transport{
+		Proxy:                 nil,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	dialContext_, err := NewUpstreamDialContext(upstreamOptions)
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.DialContext = dialContext_
+	tlsConfig_, err := upstreamOptions.TLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.TLSClientConfig = tlsConfig_
+	h = &ODoHProxyHandler{
+		httpClient: &http.Client{
+			Transport: httpTransport_,
+			Timeout:   10 * time.Second,
+			// Targets are only reached at the allowed host.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, t := range allowedTargets {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			h.allowedTargets = append(h.allowedTargets, t)
+		}
+	}
+	if len(h.allowedTargets) == 0 {
+		log.Warnf("odoh proxy has no allowed targets, all queries will be rejected")
+	}
+	return
+}
+
+// TargetAllowed tells if target host is allowed, an allowed target without port matches any port.
+func (h *ODoHProxyHandler) TargetAllowed(targetHost string) bool {
+	targetHost = strings.ToLower(targetHost)
+	hostname_ := targetHost
+	if host_, _, err := net.SplitHostPort(targetHost); err == nil {
+		hostname_ = host_
+	}
+	return SliceContains(h.allowedTargets, targetHost) || SliceContains(h.allowedTargets, hostname_)
+}
+
+// ProxyHandler forwards a query like POST /proxy?targethost=odoh.example&targetpath=/dns-query.
+func (h *ODoHProxyHandler) ProxyHandler(c *gin.Context) {
+	targetHost_, targetPath_ := c.Query("targethost"), c.Query("targetpath")
+	if targetHost_ == "" || !strings.HasPrefix(targetPath_, "/") {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if !h.TargetAllowed(targetHost_) {
+		log.Debugf("odoh target not allowed: %s", targetHost_)
+		c.Status(http.StatusForbidden)
+		return
+	}
+	if c.ContentType() != MimeTypeODoHMsg {
+		c.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+	body_, err := io.ReadAll(io.LimitReader(c.Request.Body, ODoHMaxMessageSize))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	targetURL_ := url.URL{Scheme: "https", Host: targetHost_, Path: targetPath_}
+	httpReq_, err := http.NewRequest(http.MethodPost, targetURL_.String(), bytes.NewReader(body_))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	httpReq_.Header.Set("Content-Type", MimeTypeODoHMsg)
+	httpReq_.Header.Set("Accept", MimeTypeODoHMsg)
+	httpRsp_, err := h.httpClient.Do(httpReq_)
+	if err != nil {
+		log.Errorf("odoh proxy forwarding to %s error: %v", targetHost_, err)
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = httpRsp_.Body.Close() }()
+	rspBody_, err := io.ReadAll(io.LimitReader(httpRsp_.Body, ODoHMaxMessageSize))
+	if err != nil {
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Data(httpRsp_.StatusCode, httpRsp_.Header.Get("Content-Type"), rspBody_)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestODoHTargetAndProxyHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pki_ := newTestPKI(t)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	RelayAnswerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+
+	dohHandler_ := NewDohHandler()
+	target_ := NewODoHTargetHandler(dohHandler_, 0)
+	targetRouter_ := gin.New()
+	targetRouter_.GET(ODoHConfigsPath, target_.ConfigsHandler)
+	targetRouter_.POST("/dns-query", target_.Wrap(dohHandler_.DohPostHandler))
+	targetSrv_ := httptest.NewUnstartedServer(targetRouter_)
+	targetSrv_.TLS = &tls.Config{Certificates: []tls.Certificate{pki_.serverCert}}
+	targetSrv_.StartTLS()
+	t.Cleanup(targetSrv_.Close)
+	targetHost_ := targetSrv_.Listener.Addr().String()
+
+	proxy_ := NewODoHProxyHandler([]string{targetHost_},
+		NewUpstreamOptions("", &UpstreamTLSConfigModel{CAFile: pki_.caFile}))
+	proxyRouter_ := gin.New()
+	proxyRouter_.POST(DefaultODoHProxyPath, proxy_.ProxyHandler)
+	proxySrv_ := httptest.NewServer(proxyRouter_)
+	t.Cleanup(proxySrv_.Close)
+
+	endpoint_ := proxySrv_.URL + DefaultODoHProxyPath + "?" + url.Values{
+		"targethost": {targetHost_},
+		"targetpath": {"/dns-query"},
+	}.Encode()
+	rsv_ := NewODoHResolver([]string{endpoint_}, false, &CacheOptions{cacheType: CacheTypeInternal},
+		NewUpstreamOptions("", &UpstreamTLSConfigModel{CAFile: pki_.caFile}))
+	resolve_ := func() error {
+		rsp_, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil)
+		if err != nil {
+			return err
+		}
+		if ip_ := GetIPAnswerFromResolverRsp(rsp_); ip_ != "192.0.2.1" {
+			t.Errorf("answer = %q, want 192.0.2.1", ip_)
+		}
+		return nil
+	}
+	if err := resolve_(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Previous key is still accepted after rotation.
+	if err := target_.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve_(); err != nil {
+		t.Fatalf("query with previous key: %v", err)
+	}
+	// Configs older than previous are rejected, then refetched by the resolver.
+	if err := target_.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve_(); err == nil {
+		t.Error("query with expired key succeeded")
+	}
+	if err := resolve_(); err != nil {
+		t.Fatalf("query after refetching configs: %v", err)
+	}
+
+	// Targets not allowed are rejected by proxy.
+	httpRsp_, err := http.Post(proxySrv_.URL+DefaultODoHProxyPath+"?targethost=odoh.invalid&targetpath=/dns-query",
+		MimeTypeODoHMsg, bytes.NewReader([]byte{0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = httpRsp_.Body.Close()
+	if httpRsp_.StatusCode != http.StatusForbidden {
+		t.Errorf("status of not allowed target = %d, want 403", httpRsp_.StatusCode)
+	}
+
+	// Plain DoH queries on the target path are still served.
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("example.com.", dns.TypeA)
+	msgReqBytes_, _ := msgReq_.Pack()
+	recorder_ := httptest.NewRecorder()
+	httpReq_ := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(msgReqBytes_))
+	httpReq_.Header.Set("Content-Type", MimeTypeDnsMsg)
+	targetRouter_.ServeHTTP(recorder_, httpReq_)
+	msgRsp_ := new(dns.Msg)
+	if err = msgRsp_.Unpack(recorder_.Body.Bytes()); err != nil || len(msgRsp_.Answer) != 1 {
+		t.Errorf("plain doh reply = %v, %v, want one answer", msgRsp_, err)
+	}
+}
+
+func TestODoHProxyHandler_TargetAllowed(t *testing.T) {
+	proxy_ := NewODoHProxyHandler([]string{"odoh.example", " ODoH2.example:8443 "}, nil)
+	tests := map[string]bool{
+		"odoh.example":       true,
+		"odoh.example:443":   true,
+		"odoh2.example:8443": true,
+		"odoh2.example":      false,
+		"odoh2.example:443":  false,
+		"evil.example":       false,
+	}
+	for host, want := range tests {
+		if got := proxy_.TargetAllowed(host); got != want {
+			t.Errorf("TargetAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
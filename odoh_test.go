@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestODoHRoundTrip(t *testing.T) {
+	keyPair_, err := NewODoHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs_, err := ParseODoHConfigs(MarshalODoHConfigs(keyPair_.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(configs_[0].Marshal(), keyPair_.Config.Marshal()) {
+		t.Fatalf("parsed config differs")
+	}
+
+	query_ := []byte("query message")
+	odohReq_, queryCtx_, err := configs_[0].EncryptQuery(query_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(odohReq_.EncryptedMessage) <= len(query_) {
+		t.Errorf("query not padded")
+	}
+	odohReq_, err = ParseODoHMessage(odohReq_.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotQuery_, rspCtx_, err := keyPair_.DecryptQuery(odohReq_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotQuery_, query_) {
+		t.Errorf("decrypted query = %q, want %q", gotQuery_, query_)
+	}
+
+	response_ := []byte("response message")
+	odohRsp_, err := rspCtx_.EncryptResponse(response_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odohRsp_, err = ParseODoHMessage(odohRsp_.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotResponse_, err := queryCtx_.DecryptResponse(odohRsp_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotResponse_, response_) {
+		t.Errorf("decrypted response = %q, want %q", gotResponse_, response_)
+	}
+
+	odohRsp_.EncryptedMessage[0] ^= 0xff
+	if _, err = queryCtx_.DecryptResponse(odohRsp_); err == nil {
+		t.Errorf("DecryptResponse() of tampered message succeeded")
+	}
+	otherKeyPair_, _ := NewODoHKeyPair()
+	if _, _, err = otherKeyPair_.DecryptQuery(odohReq_); err == nil {
+		t.Errorf("DecryptQuery() with other key pair succeeded")
+	}
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	keyPair_, _ := NewODoHKeyPair()
+	unsupported_ := keyPair_.Config
+	unsupported_.AeadID = 0xfffe
+	tests := []struct {
+		name    string
+		b       []byte
+		want    int
+		wantErr bool
+	}{
+		{name: "single", b: MarshalODoHConfigs(keyPair_.Config), want: 1},
+		{name: "unsupported suite skipped", b: MarshalODoHConfigs(unsupported_, keyPair_.Config), want: 1},
+		{name: "only unsupported", b: MarshalODoHConfigs(unsupported_), wantErr: true},
+		{name: "truncated", b: MarshalODoHConfigs(keyPair_.Config)[:10], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs_, err := ParseODoHConfigs(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseODoHConfigs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(configs_) != tt.want {
+				t.Errorf("got %d configs, want %d", len(configs_), tt.want)
+			}
+		})
+	}
+}
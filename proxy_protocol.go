@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProxyHeaderTimeout is how long a trusted proxy has to send the PROXY protocol header of a connection.
+	ProxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the max length of a v1 header line, including CRLF.
+	proxyV1MaxLen = 107
+)
+
+var (
+	// DefaultTrustedProxies are trusted if trusted_proxies is not configured, local reverse proxies only.
+	DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+	// DefaultClientIPHeaders are used if client_ip_headers is not configured.
+	DefaultClientIPHeaders = []string{"X-Real-IP"}
+	proxyV2Signature       = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// isTrustedProxy tells if the peer at addr is one of trusted.
+func isTrustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	ip_ := AddrIP(addr)
+	if ip_ == nil {
+		return false
+	}
+	for _, net_ := range trusted {
+		if net_.Contains(ip_) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddrIP returns ip of tcp and udp addresses, the client's for addresses behind PROXY protocol.
+func AddrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *ProxiedAddr:
+		return AddrIP(a.Client)
+	}
+	if host_, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host_)
+	}
+	return nil
+}
+
+// readProxyHeader reads v1 or v2 PROXY protocol header of a stream connection, src is nil if the header
+// carries no client address, like v1 UNKNOWN and v2 LOCAL.
+func readProxyHeader(r *bufio.Reader) (src net.Addr, err error) {
+	first_, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first_[0] == 'P' {
+		return readProxyV1Header(r)
+	}
+	header_ := make([]byte, 16)
+	if _, err = io.ReadFull(r, header_); err != nil {
+		return
+	}
+	body_ := make([]byte, binary.BigEndian.Uint16(header_[14:16]))
+	if _, err = io.ReadFull(r, body_); err != nil {
+		return
+	}
+	return parseProxyV2(header_, body_)
+}
+
+func readProxyV1Header(r *bufio.Reader) (src net.Addr, err error) {
+	var line_ []byte
+	for !bytes.HasSuffix(line_, []byte("\r\n")) {
+		if len(line_) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("proxy v1 header too long")
+		}
+		b_, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line_ = append(line_, b_)
+	}
+	fields_ := strings.Fields(string(line_))
+	if len(fields_) < 2 || fields_[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy v1 header invalid")
+	}
+	if fields_[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields_) != 6 || (fields_[1] != "TCP4" && fields_[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy v1 header invalid: %s", strings.TrimSpace(string(line_)))
+	}
+	ip_ := net.ParseIP(fields_[2])
+	port_, err := strconv.ParseUint(fields_[4], 10, 16)
+	if ip_ == nil || err != nil {
+		return nil, fmt.Errorf("proxy v1 source invalid: %s %s", fields_[2], fields_[4])
+	}
+	return &net.TCPAddr{IP: ip_, Port: int(port_)}, nil
+}
+
+// parseProxyV2 parses v2 header of 16 bytes and the addresses following it, TLVs are ignored.
+func parseProxyV2(header, body []byte) (src net.Addr, err error) {
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy v2 header invalid")
+	}
+	switch header[12] & 0xf {
+	case 0: // LOCAL, like health checks of the proxy itself.
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy v2 command invalid: %d", header[12]&0xf)
+	}
+	var ip_ net.IP
+	var port_ int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("proxy v2 addresses truncated")
+		}
+		ip_, port_ = net.IP(append([]byte{}, body[:4]...)), int(binary.BigEndian.Uint16(body[8:10]))
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("proxy v2 addresses truncated")
+		}
+		ip_, port_ = net.IP(append([]byte{}, body[:16]...)), int(binary.BigEndian.Uint16(body[32:34]))
+	default:
+		return nil, nil
+	}
+	if header[13]&0xf == 2 {
+		return &net.UDPAddr{IP: ip_, Port: port_}, nil
+	}
+	return &net.TCPAddr{IP: ip_, Port: port_}, nil
+}
+
+// ProxyProtocolListener reads PROXY protocol header of connections from trusted proxies, remote address of
+// the connection is the client's then. Connections from other peers are served as they are.
+type ProxyProtocolListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+
+	once  sync.Once
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+// NewProxyProtocolListener wraps listener with PROXY protocol from trusted proxies.
+func NewProxyProtocolListener(listener net.Listener, trusted []*net.IPNet) *ProxyProtocolListener {
+	return &ProxyProtocolListener{Listener: listener, Trusted: trusted}
+}
+
+// Accept returns connections of which headers are read, headers are read concurrently so that a slow proxy
+// does not block others.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		l.conns, l.done = make(chan net.Conn), make(chan struct{})
+		go l.acceptLoop()
+	})
+	select {
+	case conn_ := <-l.conns:
+		return conn_, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *ProxyProtocolListener) acceptLoop() {
+	for {
+		conn_, err := l.Listener.Accept()
+		if err != nil {
+			var netErr_ net.Error
+			if errors.As(err, &netErr_) && netErr_.Timeout() {
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.readHeader(conn_)
+	}
+}
+
+func (l *ProxyProtocolListener) readHeader(conn net.Conn) {
+	if isTrustedProxy(conn.RemoteAddr(), l.Trusted) {
+		reader_ := bufio.NewReader(conn)
+		_ = conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		src_, err := readProxyHeader(reader_)
+		_ = conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Debugf("proxy protocol header from %s error: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+		conn = &proxyConn{Conn: conn, reader: reader_, src: src_}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	src    net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.src == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.src
+}
+
+// ProxiedAddr is the client address of a datagram relayed by a proxy, replies are sent back to the proxy.
+type ProxiedAddr struct {
+	Client net.Addr
+	Proxy  net.Addr
+}
+
+func (a *ProxiedAddr) Network() string { return a.Client.Network() }
+
+func (a *ProxiedAddr) String() string { return a.Client.String() }
+
+// ProxyProtocolPacketConn reads PROXY protocol v2 header of datagrams from trusted proxies, datagrams from
+// trusted proxies without valid header are dropped.
+type ProxyProtocolPacketConn struct {
+	net.PacketConn
+	Trusted []*net.IPNet
+}
+
+// NewProxyProtocolPacketConn wraps conn with PROXY protocol v2 from trusted proxies.
+func NewProxyProtocolPacketConn(conn net.PacketConn, trusted []*net.IPNet) *ProxyProtocolPacketConn {
+	return &ProxyProtocolPacketConn{PacketConn: conn, Trusted: trusted}
+}
+
+func (c *ProxyProtocolPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		if n, addr, err = c.PacketConn.ReadFrom(b); err != nil || !isTrustedProxy(addr, c.Trusted) {
+			return
+		}
+		if n < 16 || int(binary.BigEndian.Uint16(b[14:16])) > n-16 {
+			log.Debugf("proxy protocol header from %s truncated", addr)
+			continue
+		}
+		headerLen_ := 16 + int(binary.BigEndian.Uint16(b[14:16]))
+		src_, err := parseProxyV2(b[:16], b[16:headerLen_])
+		if err != nil {
+			log.Debugf("proxy protocol header from %s error: %v", addr, err)
+			continue
+		}
+		n = copy(b, b[headerLen_:n])
+		if src_ != nil {
+			addr = &ProxiedAddr{Client: src_, Proxy: addr}
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *ProxyProtocolPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if proxied_, ok := addr.(*ProxiedAddr); ok {
+		addr = proxied_.Proxy
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
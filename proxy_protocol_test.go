@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds v2 PROXY header from src to dst, both ipv4 or ipv6.
+func proxyV2Header(src, dst net.IP, srcPort, dstPort uint16, udp bool) []byte {
+	header_ := append([]byte{}, proxyV2Signature...)
+	fam_, body_ := byte(0x10), append(append([]byte{}, src.To4()...), dst.To4()...)
+	if src.To4() == nil {
+		fam_, body_ = 0x20, append(append([]byte{}, src.To16()...), dst.To16()...)
+	}
+	if udp {
+		fam_ |= 2
+	} else {
+		fam_ |= 1
+	}
+	body_ = appendUint16(appendUint16(body_, srcPort), dstPort)
+	header_ = append(header_, 0x21, fam_)
+	return append(appendUint16(header_, uint16(len(body_))), body_...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2Local_ := append(append([]byte{}, proxyV2Signature...), 0x20, 0, 0, 0)
+	for name, tc := range map[string]struct {
+		header string
+		src    string
+		err    bool
+	}{
+		"v1 tcp4":    {header: "PROXY TCP4 203.0.113.7 192.0.2.1 51234 53\r\n", src: "203.0.113.7:51234"},
+		"v1 tcp6":    {header: "PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n", src: "[2001:db8::7]:51234"},
+		"v1 unknown": {header: "PROXY UNKNOWN\r\n"},
+		"v1 invalid": {header: "PROXY TCP4 203.0.113.7\r\n", err: true},
+		"v1 long":    {header: "PROXY " + strings.Repeat("x", 120) + "\r\n", err: true},
+		"v2 tcp6": {header: string(proxyV2Header(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"),
+			51234, 443, false)), src: "[2001:db8::7]:51234"},
+		"v2 local":   {header: string(v2Local_)},
+		"not header": {header: "\x00\x1d\x00\x00", err: true},
+	} {
+		src_, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.header + "payload")))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v", name, err)
+			continue
+		}
+		if tc.src == "" && src_ != nil || tc.src != "" && (src_ == nil || src_.String() != tc.src) {
+			t.Errorf("%s: source %v, want %q", name, src_, tc.src)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	listen_ := func(trusted string) net.Listener {
+		listener_, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets_, err := ParseIPNets([]string{trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyListener_ := NewProxyProtocolListener(listener_, nets_)
+		t.Cleanup(func() { _ = proxyListener_.Close() })
+		return proxyListener_
+	}
+	accept_ := func(listener net.Listener, send string) (remote net.Addr, payload string) {
+		go func() {
+			conn_, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn_.Close() }()
+			_, _ = conn_.Write([]byte(send))
+			time.Sleep(100 * time.Millisecond)
+		}()
+		conn_, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn_.Close() }()
+		b_ := make([]byte, len("payload"))
+		if _, err = io.ReadFull(conn_, b_); err != nil {
+			t.Fatal(err)
+		}
+		return conn_.RemoteAddr(), string(b_)
+	}
+
+	remote_, payload_ := accept_(listen_("127.0.0.1"), "PROXY TCP4 203.0.113.7 192.0.2.1 51234 53\r\npayload")
+	if remote_.String() != "203.0.113.7:51234" || payload_ != "payload" {
+		t.Fatalf("from trusted proxy: %v, %q", remote_, payload_)
+	}
+
+	// Headers from untrusted peers are not parsed, a client can't spoof its address.
+	untrusted_ := listen_("192.0.2.0/24")
+	remote_, payload_ = accept_(untrusted_, "payload")
+	if AddrIP(remote_).String() != "127.0.0.1" || payload_ != "payload" {
+		t.Fatalf("from untrusted peer: %v, %q", remote_, payload_)
+	}
+	remote_, payload_ = accept_(untrusted_, "PROXY TCP4 203.0.113.7 192.0.2.1 51234 53\r\n")
+	if AddrIP(remote_).String() != "127.0.0.1" || payload_ != "PROXY T" {
+		t.Fatalf("header from untrusted peer: %v, %q", remote_, payload_)
+	}
+}
+
+func TestProxyProtocolPacketConn(t *testing.T) {
+	udpConn_, err := ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets_, _ := ParseIPNets(DefaultTrustedProxies)
+	clients_ := make(chan net.Addr, 1)
+	server_ := &dns.Server{PacketConn: NewProxyProtocolPacketConn(udpConn_, nets_), Net: "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msgReq *dns.Msg) {
+			clients_ <- w.RemoteAddr()
+			msgRsp_ := new(dns.Msg)
+			_ = w.WriteMsg(msgRsp_.SetReply(msgReq))
+		})}
+	started_ := make(chan struct{})
+	server_.NotifyStartedFunc = func() { close(started_) }
+	go func() { _ = server_.ActivateAndServe() }()
+	<-started_
+	t.Cleanup(func() { _ = server_.Shutdown() })
+
+	conn_, err := net.Dial("udp", udpConn_.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn_.Close() }()
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion("a.example.", dns.TypeA)
+	packed_, _ := msgReq_.Pack()
+	if _, err = conn_.Write(append(proxyV2Header(net.ParseIP("203.0.113.7"), net.ParseIP("192.0.2.1"),
+		51234, 53, true), packed_...)); err != nil {
+		t.Fatal(err)
+	}
+	// Reply is sent back to the proxy.
+	_ = conn_.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b_ := make([]byte, dns.MinMsgSize)
+	n_, err := conn_.Read(b_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgRsp_ := new(dns.Msg)
+	if err = msgRsp_.Unpack(b_[:n_]); err != nil || msgRsp_.Id != msgReq_.Id {
+		t.Fatalf("reply: %v, %v", msgRsp_, err)
+	}
+	if client_ := <-clients_; client_.String() != "203.0.113.7:51234" || AddrIP(client_).String() != "203.0.113.7" {
+		t.Fatalf("client address: %v", client_)
+	}
+}
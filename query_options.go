@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// DefaultForwardEdns0Options are EDNS0 option codes forwarded to upstreams when not configured,
+// hop-by-hop options like COOKIE, PADDING and TCP-KEEPALIVE are never forwarded by default.
+var DefaultForwardEdns0Options = []uint16{
+	dns.EDNS0NSID,
+	dns.EDNS0DAU,
+	dns.EDNS0DHU,
+	dns.EDNS0N3U,
+}
+
+// DefaultReplyUDPSize is the UDP payload size advertised in OPT records of replies.
+const DefaultReplyUDPSize = 1232
+
+// QueryOptions holds the semantics of a client query which are forwarded to upstreams.
+type QueryOptions struct {
+	Edns0             bool
+	CheckingDisabled  bool
+	AuthenticatedData bool
+	DnssecOK          bool
+	Edns0Options      []dns.EDNS0
+}
+
+// ForwardEdns0Options returns the allow-list of EDNS0 option codes forwarded to upstreams.
+func ForwardEdns0Options() []uint16 {
+	if ExecConfig.ForwardEdns0Options == nil {
+		return DefaultForwardEdns0Options
+	}
+	return ExecConfig.ForwardEdns0Options
+}
+
+// NewQueryOptionsFromMsg obtains query options from client message, only EDNS0 options in allowed are kept,
+// ECS is always left out since it's handled separately.
+func NewQueryOptionsFromMsg(msg *dns.Msg, allowed []uint16) (opts *QueryOptions) {
+	opts = &QueryOptions{
+		CheckingDisabled:  msg.CheckingDisabled,
+		AuthenticatedData: msg.AuthenticatedData,
+	}
+	opt_ := msg.IsEdns0()
+	if opt_ == nil {
+		return
+	}
+	opts.Edns0 = true
+	opts.DnssecOK = opt_.Do()
+	for _, o := range opt_.Option {
+		if code_ := o.Option(); code_ != dns.EDNS0SUBNET && SliceContains(allowed, code_) {
+			opts.Edns0Options = append(opts.Edns0Options, o)
+		}
+	}
+	return
+}
+
+// ApplyToMsg sets the query options to message which is going to be sent to upstream.
+func (opts *QueryOptions) ApplyToMsg(msg *dns.Msg) {
+	if opts == nil {
+		return
+	}
+	msg.CheckingDisabled = opts.CheckingDisabled
+	msg.AuthenticatedData = opts.AuthenticatedData
+	if !opts.Edns0 {
+		return
+	}
+	opt_ := msg.IsEdns0()
+	if opt_ == nil {
+		msg.SetEdns0(DefaultReplyUDPSize, opts.DnssecOK)
+		opt_ = msg.IsEdns0()
+	} else {
+		opt_.SetDo(opts.DnssecOK)
+	}
+	opt_.Option = append(opt_.Option, opts.Edns0Options...)
+}
+
+// CacheKey represents the query options in cache key, responses differ with these options.
+func (opts *QueryOptions) CacheKey() string {
+	if opts == nil || (!opts.Edns0 && !opts.CheckingDisabled && !opts.AuthenticatedData) {
+		return ""
+	}
+	var opts_ []string
+	for _, o := range opts.Edns0Options {
+		opts_ = append(opts_, fmt.Sprintf("%d:%s", o.Option(), o.String()))
+	}
+	return fmt.Sprintf("CD[%t]AD[%t]EDNS[%t]DO[%t]OPTS[%s]", opts.CheckingDisabled, opts.AuthenticatedData,
+		opts.Edns0, opts.DnssecOK, strings.Join(opts_, ","))
+}
+
+// NewReplyOPT creates the OPT record replying to a client's OPT, carrying over options from upstream's OPT
+// which are ECS, Extended DNS Errors or in allowed.
+func NewReplyOPT(reqOpt, upstreamOpt *dns.OPT, allowed []uint16) (opt *dns.OPT) {
+	opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(DefaultReplyUDPSize)
+	opt.SetDo(reqOpt != nil && reqOpt.Do())
+	if upstreamOpt == nil {
+		return
+	}
+	for _, o := range upstreamOpt.Option {
+		switch code_ := o.Option(); {
+		case code_ == dns.EDNS0SUBNET, code_ == dns.EDNS0EDE, SliceContains(allowed, code_):
+			opt.Option = append(opt.Option, o)
+		}
+	}
+	return
+}
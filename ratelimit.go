@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitSweepInterval is how often buckets of idle clients are removed.
+	RateLimitSweepInterval = time.Minute
+	// DefaultRRLWindow is how many seconds of responses over limit a client subnet has to pay back, like BIND's
+	// window.
+	DefaultRRLWindow = 15
+	// DefaultRRLSlip sends every other response over limit as truncated reply.
+	DefaultRRLSlip = 2
+	// DefaultRRLPrefixV4 and DefaultRRLPrefixV6 group clients of RRL by subnet, like BIND's.
+	DefaultRRLPrefixV4 = 24
+	DefaultRRLPrefixV6 = 56
+)
+
+// Response classes of RRL, accounted separately.
+const (
+	RRLClassResponses = "responses"
+	RRLClassNodata    = "nodata"
+	RRLClassNxdomains = "nxdomains"
+	RRLClassErrors    = "errors"
+)
+
+// RRLAction is what to do with a response accounted by RRL.
+type RRLAction int
+
+const (
+	RRLSend RRLAction = iota
+	RRLDrop
+	RRLSlip
+)
+
+// subnetKey returns ip truncated to prefix lengths, which keys buckets of clients.
+func subnetKey(ip net.IP, prefixV4, prefixV6 int) string {
+	if ip4_ := ip.To4(); ip4_ != nil {
+		return ip4_.Mask(net.CIDRMask(prefixV4, 8*net.IPv4len)).String()
+	}
+	return ip.To16().Mask(net.CIDRMask(prefixV6, 8*net.IPv6len)).String()
+}
+
+// checkPrefixes checks prefix lengths of ipv4 and ipv6 subnets.
+func checkPrefixes(prefixV4, prefixV6 int) error {
+	if prefixV4 < 0 || prefixV4 > 8*net.IPv4len {
+		return fmt.Errorf("prefix_v4 must be within 0-%d: %d", 8*net.IPv4len, prefixV4)
+	}
+	if prefixV6 < 0 || prefixV6 > 8*net.IPv6len {
+		return fmt.Errorf("prefix_v6 must be within 0-%d: %d", 8*net.IPv6len, prefixV6)
+	}
+	return nil
+}
+
+func rateLimitedCounter(service string) *Counter {
+	return Metrics.Counter("rate_limited_queries_total", "Queries over per-client rate limits.",
+		"service", service)
+}
+
+func rrlCounter(class, action string) *Counter {
+	return Metrics.Counter("rrl_responses_total", "Udp responses over RRL limits by response class and action.",
+		"class", class, "action", action)
+}
+
+// RateLimiter limits queries of client subnets by token buckets, refilled by Rate per second up to Burst.
+type RateLimiter struct {
+	Rate     float64
+	Burst    float64
+	PrefixV4 int
+	PrefixV6 int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewRateLimiter creates RateLimiter of service, nil if rate is 0, which limits no client.
+func NewRateLimiter(conf *RateLimitConfigModel) (l *RateLimiter, err error) {
+	if conf.Rate == 0 {
+		return nil, nil
+	}
+	if conf.Rate < 0 || conf.Burst < 0 {
+		return nil, fmt.Errorf("rate_limit rate and burst must not be negative")
+	}
+	l = &RateLimiter{
+		Rate:     conf.Rate,
+		Burst:    float64(conf.Burst),
+		PrefixV4: FirstNonZero(conf.PrefixV4, 8*net.IPv4len),
+		PrefixV6: FirstNonZero(conf.PrefixV6, 8*net.IPv6len),
+		buckets:  make(map[string]*tokenBucket),
+	}
+	if l.Burst == 0 {
+		l.Burst = math.Max(math.Ceil(l.Rate), 1)
+	}
+	if err = checkPrefixes(l.PrefixV4, l.PrefixV6); err != nil {
+		return nil, fmt.Errorf("rate_limit %v", err)
+	}
+	return
+}
+
+func (l *RateLimiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Allow takes a token from the bucket of client ip, any client is allowed by nil RateLimiter.
+func (l *RateLimiter) Allow(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return true
+	}
+	now_, key_ := l.clock(), subnetKey(ip, l.PrefixV4, l.PrefixV6)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now_)
+	bucket_, ok := l.buckets[key_]
+	if !ok {
+		bucket_ = &tokenBucket{tokens: l.Burst, at: now_}
+		l.buckets[key_] = bucket_
+	}
+	bucket_.tokens = math.Min(l.Burst, bucket_.tokens+now_.Sub(bucket_.at).Seconds()*l.Rate)
+	bucket_.at = now_
+	if bucket_.tokens < 1 {
+		return false
+	}
+	bucket_.tokens--
+	return true
+}
+
+// sweep removes buckets refilled to full, which are the same as new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < RateLimitSweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.at).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RRL limits identical responses to client subnets on udp like BIND's Response Rate Limiting, so that the relay
+// is of no use to reflection attacks. Responses over limit are dropped, but every Slip-th of them is sent as
+// truncated reply, so that legitimate clients retry over tcp.
+type RRL struct {
+	// Rates are responses per second by class, classes of rate 0 are not limited.
+	Rates    map[string]float64
+	Window   time.Duration
+	Slip     int
+	PrefixV4 int
+	PrefixV6 int
+	now      func() time.Time
+
+	mu       sync.Mutex
+	accounts map[rrlKey]*rrlAccount
+	sweptAt  time.Time
+}
+
+// rrlKey identifies responses accounted together.
+type rrlKey struct {
+	subnet string
+	class  string
+	name   string
+	qtype  uint16
+}
+
+type rrlAccount struct {
+	balance float64
+	at      time.Time
+	slipped int
+}
+
+// NewRRL creates RRL of dns53 service, nil if no class is limited.
+func NewRRL(conf *RRLConfigModel) (r *RRL, err error) {
+	rates_ := map[string]float64{
+		RRLClassResponses: float64(conf.ResponsesPerSecond),
+		RRLClassNodata:    float64(FirstNonZero(conf.NodataPerSecond, conf.ResponsesPerSecond)),
+		RRLClassNxdomains: float64(FirstNonZero(conf.NxdomainsPerSecond, conf.ResponsesPerSecond)),
+		RRLClassErrors:    float64(FirstNonZero(conf.ErrorsPerSecond, conf.ResponsesPerSecond)),
+	}
+	limited_ := false
+	for class, rate := range rates_ {
+		if rate < 0 {
+			return nil, fmt.Errorf("rrl %s per second must not be negative", class)
+		}
+		limited_ = limited_ || rate > 0
+	}
+	if !limited_ {
+		return nil, nil
+	}
+	r = &RRL{
+		Rates:    rates_,
+		Window:   time.Duration(FirstNonZero(conf.Window, DefaultRRLWindow)) * time.Second,
+		Slip:     DefaultRRLSlip,
+		PrefixV4: FirstNonZero(conf.PrefixV4, DefaultRRLPrefixV4),
+		PrefixV6: FirstNonZero(conf.PrefixV6, DefaultRRLPrefixV6),
+		accounts: make(map[rrlKey]*rrlAccount),
+	}
+	if conf.Slip != nil {
+		r.Slip = *conf.Slip
+	}
+	if r.Window < 0 || r.Slip < 0 {
+		return nil, fmt.Errorf("rrl window and slip must not be negative")
+	}
+	if err = checkPrefixes(r.PrefixV4, r.PrefixV6); err != nil {
+		return nil, fmt.Errorf("rrl %v", err)
+	}
+	return
+}
+
+func (r *RRL) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// rrlClassify returns class of response and what it is accounted by, qname and qtype for answers, the zone for
+// negative answers, and nothing for errors.
+func rrlClassify(msgRsp *dns.Msg) (class, name string, qtype uint16) {
+	if len(msgRsp.Question) > 0 {
+		name, qtype = strings.ToLower(msgRsp.Question[0].Name), msgRsp.Question[0].Qtype
+	}
+	zone_ := name
+	for _, rr := range msgRsp.Ns {
+		if soa_, ok := rr.(*dns.SOA); ok {
+			zone_ = strings.ToLower(soa_.Hdr.Name)
+		}
+	}
+	switch {
+	case msgRsp.Rcode == dns.RcodeNameError:
+		return RRLClassNxdomains, zone_, 0
+	case msgRsp.Rcode != dns.RcodeSuccess:
+		return RRLClassErrors, "", 0
+	case len(msgRsp.Answer) == 0:
+		return RRLClassNodata, zone_, 0
+	}
+	return RRLClassResponses, name, qtype
+}
+
+// Check accounts response to client ip, any response is sent by nil RRL.
+func (r *RRL) Check(ip net.IP, msgRsp *dns.Msg) (action RRLAction, class string) {
+	if r == nil || ip == nil {
+		return RRLSend, ""
+	}
+	class, name_, qtype_ := rrlClassify(msgRsp)
+	rate_ := r.Rates[class]
+	if rate_ == 0 {
+		return RRLSend, class
+	}
+	now_ := r.clock()
+	key_ := rrlKey{subnet: subnetKey(ip, r.PrefixV4, r.PrefixV6), class: class, name: name_, qtype: qtype_}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now_)
+	account_, ok := r.accounts[key_]
+	if !ok {
+		account_ = &rrlAccount{balance: rate_, at: now_}
+		r.accounts[key_] = account_
+	}
+	account_.balance = math.Min(rate_, account_.balance+now_.Sub(account_.at).Seconds()*rate_)
+	account_.at = now_
+	// Clients over limit pay back at most window seconds of responses.
+	account_.balance = math.Max(account_.balance-1, -r.Window.Seconds()*rate_)
+	if account_.balance >= 0 {
+		return RRLSend, class
+	}
+	if r.Slip > 0 {
+		if account_.slipped++; account_.slipped >= r.Slip {
+			account_.slipped = 0
+			return RRLSlip, class
+		}
+	}
+	return RRLDrop, class
+}
+
+// sweep removes accounts credited to full, which are the same as new ones.
+func (r *RRL) sweep(now time.Time) {
+	if now.Sub(r.sweptAt) < RateLimitSweepInterval {
+		return
+	}
+	r.sweptAt = now
+	for key, account := range r.accounts {
+		rate_ := r.Rates[key.class]
+		if account.balance+now.Sub(account.at).Seconds()*rate_ >= rate_ {
+			delete(r.accounts, key)
+		}
+	}
+}
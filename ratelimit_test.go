@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now_ := time.Unix(1700000000, 0)
+	limiter_, err := NewRateLimiter(&RateLimitConfigModel{Rate: 2, Burst: 3, PrefixV4: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter_.now = func() time.Time { return now_ }
+
+	client_, neighbour_, other_ := net.ParseIP("192.0.2.7"), net.ParseIP("192.0.2.8"), net.ParseIP("198.51.100.1")
+	for i := 0; i < 3; i++ {
+		if !limiter_.Allow(client_) {
+			t.Fatalf("query %d within burst limited", i)
+		}
+	}
+	if limiter_.Allow(neighbour_) {
+		t.Fatal("query of the same subnet over burst allowed")
+	}
+	if !limiter_.Allow(other_) {
+		t.Fatal("query of another subnet limited")
+	}
+	now_ = now_.Add(500 * time.Millisecond)
+	if !limiter_.Allow(client_) || limiter_.Allow(client_) {
+		t.Fatal("bucket not refilled by rate")
+	}
+
+	// Idle clients are swept once refilled.
+	now_ = now_.Add(RateLimitSweepInterval)
+	limiter_.Allow(other_)
+	if len(limiter_.buckets) != 1 {
+		t.Fatalf("buckets after sweeping: %d", len(limiter_.buckets))
+	}
+
+	if limiter_, err = NewRateLimiter(&RateLimitConfigModel{}); err != nil || limiter_ != nil ||
+		!limiter_.Allow(client_) {
+		t.Fatalf("rate limiter without rate: %v, %v", limiter_, err)
+	}
+	if _, err = NewRateLimiter(&RateLimitConfigModel{Rate: 1, PrefixV6: 129}); err == nil {
+		t.Fatal("invalid prefix accepted")
+	}
+}
+
+func TestRRL_Check(t *testing.T) {
+	slip_ := 2
+	rrl_, err := NewRRL(&RRLConfigModel{ResponsesPerSecond: 2, ErrorsPerSecond: 1, Window: 2, Slip: &slip_})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now_ := time.Unix(1700000000, 0)
+	rrl_.now = func() time.Time { return now_ }
+
+	answer_ := func(name string) *dns.Msg {
+		return rcodeAnswer(new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+	client_ := net.ParseIP("192.0.2.7")
+	check_ := func(msgRsp *dns.Msg) RRLAction {
+		action_, _ := rrl_.Check(client_, msgRsp)
+		return action_
+	}
+
+	for i, want := range []RRLAction{RRLSend, RRLSend, RRLDrop, RRLSlip, RRLDrop, RRLSlip} {
+		if action_ := check_(answer_("a.test.")); action_ != want {
+			t.Fatalf("response %d: action %d, want %d", i, action_, want)
+		}
+	}
+	// Responses of other names and classes are accounted separately.
+	if check_(answer_("b.test.")) != RRLSend {
+		t.Fatal("response of another name limited")
+	}
+	if action_, class_ := rrl_.Check(client_, answer_("servfail.test.")); action_ != RRLSend ||
+		class_ != RRLClassErrors {
+		t.Fatalf("error response: %d, %s", action_, class_)
+	}
+	if _, class_ := rrl_.Check(client_, answer_("nxdomain.test.")); class_ != RRLClassNxdomains {
+		t.Fatalf("nxdomain class: %s", class_)
+	}
+	// Clients of other subnets are not limited.
+	if action_, _ := rrl_.Check(net.ParseIP("198.51.100.1"), answer_("a.test.")); action_ != RRLSend {
+		t.Fatal("response to another subnet limited")
+	}
+
+	// Debt is capped by window, paid back in window seconds.
+	now_ = now_.Add(2 * time.Second)
+	if check_(answer_("a.test.")) == RRLSend {
+		t.Fatal("debt paid back before window")
+	}
+	now_ = now_.Add(3 * time.Second)
+	if action_ := check_(answer_("a.test.")); action_ != RRLSend {
+		t.Fatalf("debt not paid back after window: %d", action_)
+	}
+
+	if rrl_, err = NewRRL(&RRLConfigModel{}); err != nil || rrl_ != nil {
+		t.Fatalf("rrl without rates: %v, %v", rrl_, err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReloadCloseDelay is how long answerers replaced on reload are kept for queries in flight before closed.
+const ReloadCloseDelay = 30 * time.Second
+
+// Reloads re-reads config file on SIGHUP or the admin endpoint.
+var Reloads = &ConfigReloader{}
+
+var answerersMu sync.RWMutex
+
+// CurrentRelayAnswerer returns answerer of the DoH service, which is swapped on reload.
+func CurrentRelayAnswerer() *DnsMsgAnswerer {
+	answerersMu.RLock()
+	defer answerersMu.RUnlock()
+	return RelayAnswerer
+}
+
+// CurrentDns53Answerer returns answerer of the dns53 service, which is swapped on reload.
+func CurrentDns53Answerer() *DnsMsgAnswerer {
+	answerersMu.RLock()
+	defer answerersMu.RUnlock()
+	return Dns53Answerer
+}
+
+// SwapAnswerer sets *answerer to next, the previous one is closed after ReloadCloseDelay.
+func SwapAnswerer(answerer **DnsMsgAnswerer, next *DnsMsgAnswerer) {
+	answerersMu.Lock()
+	prev_ := *answerer
+	*answerer = next
+	answerersMu.Unlock()
+	if prev_ != nil {
+		time.AfterFunc(ReloadCloseDelay, prev_.Close)
+	}
+}
+
+// ReloadFunc prepares what to swap in from the new config without applying it, commit applies it once all
+// reload funcs succeeded, discard releases it otherwise. Both may be nil if there is nothing to reload.
+type ReloadFunc func(prev, conf *ConfigModel) (commit, discard func(), err error)
+
+type reloadHook struct {
+	name string
+	f    ReloadFunc
+}
+
+// ConfigReloader applies reloadable settings of the config file, listeners and other settings require restart.
+type ConfigReloader struct {
+	mu     sync.Mutex
+	path   string
+	config ConfigModel
+	hooks  []reloadHook
+}
+
+// SetConfigFile sets the file to reload and the config currently applied.
+func (r *ConfigReloader) SetConfigFile(path string, config ConfigModel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.path, r.config = path, config
+}
+
+// OnReload registers f to reload part name.
+func (r *ConfigReloader) OnReload(name string, f ReloadFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, reloadHook{name: name, f: f})
+}
+
+// Reload reads and validates config file, then applies it all or nothing. Changed settings are returned,
+// those not reloadable are marked as requiring restart.
+func (r *ConfigReloader) Reload() (changes []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() {
+		if err != nil {
+			log.Errorf("config not reloaded: %v", err)
+		}
+	}()
+	if r.path == "" {
+		return nil, fmt.Errorf("no config file to reload")
+	}
+	conf_, err := LoadConfigFromFile(r.path)
+	if err != nil {
+		return
+	}
+	if err = ValidateConfig(&conf_); err != nil {
+		return
+	}
+
+	var commits_, discards_ []func()
+	for _, hook := range r.hooks {
+		commit_, discard_, err := prepareReload(hook, &r.config, &conf_)
+		if err != nil {
+			for _, discard := range discards_ {
+				discard()
+			}
+			return nil, fmt.Errorf("%s: %v", hook.name, err)
+		}
+		if commit_ != nil {
+			commits_ = append(commits_, commit_)
+		}
+		if discard_ != nil {
+			discards_ = append(discards_, discard_)
+		}
+	}
+	for _, commit := range commits_ {
+		commit()
+	}
+	changes = ConfigChanges(&r.config, &conf_)
+	r.config = conf_
+	log.Infof("config reloaded from %s, changes: %s", r.path, strings.Join(changes, ", "))
+	return
+}
+
+// prepareReload calls the reload func of hook, panics of resolver constructors are returned as errors.
+func prepareReload(hook reloadHook, prev, conf *ConfigModel) (commit, discard func(), err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return hook.f(prev, conf)
+}
+
+// reloadableSettings are settings applied on reload, by yaml key.
+var reloadableSettings = []string{
+	"dns53.upstream", "dns53.upstream_fallback", "dns53.upstream_proto", "dns53.upstream_proxy",
+	"dns53.upstream_tls", "dns53.1st_ecs_ip", "dns53.2nd_ecs_ip", "dns53.use_client_ip", "dns53.fixed_resolving",
+	"dns53.client_ecs_prefix_v4", "dns53.client_ecs_prefix_v6", "dns53.client_ecs_map", "dns53.acl",
+	"dns53.rate_limit", "dns53.rrl",
+	"doh.upstream", "doh.upstream_fallback", "doh.upstream_proto", "doh.upstream_proxy", "doh.upstream_tls",
+	"doh.1st_ecs_ip", "doh.2nd_ecs_ip", "doh.fixed_resolving", "doh.acl", "doh.rate_limit", "doh.auth",
+	"cache_enabled", "names_in_jail", "upstream_proxy", "upstream_tls",
+}
+
+// ConfigChanges lists settings changed from prev to conf by yaml key, like "doh.upstream", settings not
+// reloadable are suffixed by " (restart required)".
+func ConfigChanges(prev, conf *ConfigModel) (changes []string) {
+	for _, key := range configDiff("", reflect.ValueOf(*prev), reflect.ValueOf(*conf)) {
+		if !SliceContains(reloadableSettings, key) {
+			key += " (restart required)"
+		}
+		changes = append(changes, key)
+	}
+	return
+}
+
+// ConfigChanged tells if any of settings by yaml key prefix changed from prev to conf.
+func ConfigChanged(prev, conf *ConfigModel, prefixes ...string) bool {
+	for _, key := range configDiff("", reflect.ValueOf(*prev), reflect.ValueOf(*conf)) {
+		for _, prefix := range prefixes {
+			if key == prefix || strings.HasPrefix(key, prefix+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configDiff compares structs field by field, recursing into the service sections.
+func configDiff(prefix string, prev, conf reflect.Value) (keys []string) {
+	for i := 0; i < prev.NumField(); i++ {
+		field_ := prev.Type().Field(i)
+		key_ := prefix + strings.Split(field_.Tag.Get("yaml"), ",")[0]
+		if field_.Type == reflect.TypeOf(Dns53ConfigModel{}) || field_.Type == reflect.TypeOf(DohConfigModel{}) {
+			keys = append(keys, configDiff(key_+".", prev.Field(i), conf.Field(i))...)
+			continue
+		}
+		if !reflect.DeepEqual(prev.Field(i).Interface(), conf.Field(i).Interface()) {
+			keys = append(keys, key_)
+		}
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConfigReloader(t *testing.T) {
+	answerFrom_ := func(ip string) func(*dns.Msg) *dns.Msg {
+		return func(msgReq *dns.Msg) (msgRsp *dns.Msg) {
+			msgRsp = new(dns.Msg)
+			msgRsp.SetReply(msgReq)
+			rr_, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A %s", msgReq.Question[0].Name, ip))
+			msgRsp.Answer = []dns.RR{rr_}
+			return
+		}
+	}
+	upstreamA_ := newFakeDohUpstream(t, answerFrom_("192.0.2.1"))
+	upstreamB_ := newFakeDohUpstream(t, answerFrom_("192.0.2.2"))
+	path_ := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig_ := func(upstream, listen, extra string) {
+		conf_ := fmt.Sprintf("doh:\n  listen: %s\n  upstream: %s/dns-query\n  upstream_proto: doh\n%s",
+			listen, upstream, extra)
+		if err := os.WriteFile(path_, []byte(conf_), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answeredIP_ := func() string {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.example.", dns.TypeA)
+		msgRsp_, err := CurrentRelayAnswerer().Answer(msgReq_, "")
+		if err != nil || len(msgRsp_.Answer) != 1 {
+			t.Fatalf("answer: %v, %v", msgRsp_, err)
+		}
+		return msgRsp_.Answer[0].(*dns.A).A.String()
+	}
+
+	writeConfig_(upstreamA_.URL, "127.0.0.1:15353", "")
+	conf_, err := LoadConfigFromFile(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RelayAnswerer = newDohRsvAnswerer(&conf_)
+	SetNamesInJailConfig(map[string][]*regexp.Regexp{})
+	t.Cleanup(func() { SetNamesInJailConfig(map[string][]*regexp.Regexp{}) })
+	reloader_ := &ConfigReloader{}
+	reloader_.SetConfigFile(path_, conf_)
+	reloader_.OnReload("doh relay answerer", reloadDohRsvAnswerer)
+	reloader_.OnReload("names in jail", reloadNamesInJail)
+	if ip_ := answeredIP_(); ip_ != "192.0.2.1" {
+		t.Fatalf("answered %s before reload", ip_)
+	}
+
+	writeConfig_(upstreamB_.URL, "127.0.0.1:15354",
+		"names_in_jail:\n  - name_regex: ^jailed\\.example\\.$\n    country_codes: XX\n")
+	changes_, err := reloader_.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanges_ := []string{"doh.listen (restart required)", "doh.upstream", "names_in_jail"}
+	if strings.Join(changes_, ",") != strings.Join(wantChanges_, ",") {
+		t.Errorf("changes = %v, want %v", changes_, wantChanges_)
+	}
+	if ip_ := answeredIP_(); ip_ != "192.0.2.2" {
+		t.Errorf("answered %s after reload", ip_)
+	}
+	if !IsNameInJailOfCountry("jailed.example.", "XX") {
+		t.Error("names in jail not reloaded")
+	}
+
+	// Broken config is not applied at all.
+	writeConfig_(upstreamA_.URL, "127.0.0.1:15354",
+		"  fixed_resolving:\n    - name_regex: \"(\"\n      server: https://dns.example/dns-query\n")
+	if _, err = reloader_.Reload(); err == nil {
+		t.Error("expected error reloading broken config")
+	}
+	if ip_ := answeredIP_(); ip_ != "192.0.2.2" {
+		t.Errorf("answered %s after broken reload", ip_)
+	}
+
+	// Admin endpoint.
+	writeConfig_(upstreamB_.URL, "127.0.0.1:15354",
+		"names_in_jail:\n  - name_regex: ^jailed\\.example\\.$\n    country_codes: XX\n")
+	adminSrv_ := httptest.NewServer(NewAdminHandler(reloader_, &MetricsRegistry{}))
+	t.Cleanup(adminSrv_.Close)
+	httpRsp_, err := http.Get(adminSrv_.URL + AdminReloadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = httpRsp_.Body.Close()
+	if httpRsp_.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d", httpRsp_.StatusCode)
+	}
+	httpRsp_, err = http.Post(adminSrv_.URL+AdminReloadPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = httpRsp_.Body.Close() }()
+	var reloadRsp_ AdminReloadRsp
+	if err = json.NewDecoder(httpRsp_.Body).Decode(&reloadRsp_); err != nil {
+		t.Fatal(err)
+	}
+	if httpRsp_.StatusCode != http.StatusOK || reloadRsp_.Error != "" || len(reloadRsp_.Changes) != 0 {
+		t.Errorf("POST reload: %d, %+v", httpRsp_.StatusCode, reloadRsp_)
+	}
+}
+
+func TestConfigReloader_DohAuth(t *testing.T) {
+	upstreamA_ := newFakeDohUpstream(t, fakeAnswer)
+	upstreamB_ := newFakeDohUpstream(t, func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := fakeAnswer(msgReq)
+		msgRsp_.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+		return msgRsp_
+	})
+	path_ := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig_ := func(upstream string) {
+		// Profile of only upstream_proto uses upstreams of the doh service.
+		conf_ := fmt.Sprintf("doh:\n  upstream: %s/dns-query\n  upstream_proto: doh\n  auth:\n    profiles:\n"+
+			"      - name: a\n        tokens: [token-a]\n        upstream_proto: doh\n", upstream)
+		if err := os.WriteFile(path_, []byte(conf_), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answeredIP_ := func(h *DohHandler) string {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a.example.", dns.TypeA)
+		msgRsp_, err := h.auth().Profile("token-a").answerer().Answer(msgReq_, "")
+		if err != nil || len(msgRsp_.Answer) != 1 {
+			t.Fatalf("answer: %v, %v", msgRsp_, err)
+		}
+		return msgRsp_.Answer[0].(*dns.A).A.String()
+	}
+
+	writeConfig_(upstreamA_.URL)
+	conf_, err := LoadConfigFromFile(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth_, err := NewDohAuth(&conf_.DohConfig.Auth, func(profile *DohProfileConfigModel) *DnsMsgAnswerer {
+		return newDohProfileAnswerer(&conf_, profile)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dohHandler_ := NewDohHandler()
+	dohHandler_.SetAuth(auth_)
+	t.Cleanup(func() { dohHandler_.auth().Close() })
+	reloader_ := &ConfigReloader{}
+	reloader_.SetConfigFile(path_, conf_)
+	reloader_.OnReload("doh auth", reloadDohAuth(dohHandler_))
+	if ip_ := answeredIP_(dohHandler_); ip_ != "192.0.2.1" {
+		t.Fatalf("profile answered %s before reload", ip_)
+	}
+
+	writeConfig_(upstreamB_.URL)
+	changes_, err := reloader_.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changes_, ",") != "doh.upstream" {
+		t.Errorf("changes = %v, want [doh.upstream]", changes_)
+	}
+	if ip_ := answeredIP_(dohHandler_); ip_ != "192.0.2.2" {
+		t.Errorf("profile answered %s after reload of doh.upstream", ip_)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/buraksezer/connpool"
 	"github.com/miekg/dns"
 	"net"
@@ -10,6 +11,9 @@ import (
 	"time"
 )
 
+// Dns53TLSHandshakeTimeout is timeout of TLS handshakes with DNS-over-TLS upstreams.
+const Dns53TLSHandshakeTimeout = 3 * time.Second
+
 var Quad9Dns53Endpoints = []string{
 	"tcp://149.112.112.11:53",
 	"tcp://9.9.9.11:53",
@@ -23,12 +27,13 @@ type Dns53DnsMsgResolver struct {
 	netConnPool connpool.Pool
 }
 
-func NewDns53DnsMsgResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions) (rsv *Dns53DnsMsgResolver) {
+func NewDns53DnsMsgResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *Dns53DnsMsgResolver) {
 	rsv = &Dns53DnsMsgResolver{
 		useCache:  useCache,
 		endpoints: endpoints,
 	}
-	rsv.netConnPool = newConnPool4Resolver(endpoints)
+	rsv.netConnPool = newConnPool4Resolver(endpoints, upstreamOptions)
 	// If using cache
 	if rsv.useCache {
 		if cacheOptions.cacheType == CacheTypeInternal {
@@ -40,21 +45,30 @@ func NewDns53DnsMsgResolver(endpoints []string, useCache bool, cacheOptions *Cac
 	return
 }
 
-func newConnPool4Resolver(endpoints []string) (pool connpool.Pool) {
+func newConnPool4Resolver(endpoints []string, upstreamOptions *UpstreamOptions) (pool connpool.Pool) {
 	dialParams_ := make([][]string, 0, len(endpoints))
 	for _, edp := range endpoints {
 		url_, err := url.Parse(strings.TrimSpace(edp))
 		if err != nil {
 			panic(err)
 		}
-		if strings.ToLower(url_.Scheme) != "tcp" || !ListenAddrPortAvailable(url_.Host) {
-			log.Errorf("endpoint not usable, should be like tcp://8.8.8.8:53,tcp://8.8.4.4:53")
+		scheme_ := strings.ToLower(url_.Scheme)
+		if (scheme_ != "tcp" && scheme_ != "tls") || !ListenAddrPortAvailable(url_.Host) {
+			log.Errorf("endpoint not usable, should be like tcp://8.8.8.8:53,tls://8.8.4.4:853")
 			continue
 		}
-		dialParams_ = append(dialParams_, []string{url_.Scheme, url_.Host})
+		dialParams_ = append(dialParams_, []string{scheme_, url_.Host})
 	}
 	if len(dialParams_) == 0 {
-		panic("endpoint not usable, should be like tcp://8.8.8.8:53,tcp://8.8.4.4:53")
+		panic("endpoint not usable, should be like tcp://8.8.8.8:53,tls://8.8.4.4:853")
+	}
+	dialContext_, err := NewUpstreamDialContext(upstreamOptions)
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig_, err := upstreamOptions.TLSConfig()
+	if err != nil {
+		panic(err)
 	}
 	nextDailParams_ := func() func() []string {
 		initV_ := 0
@@ -73,9 +87,25 @@ func newConnPool4Resolver(endpoints []string) (pool connpool.Pool) {
 	factory_ := func() (net.Conn, error) {
 		dParams_ := nextDailParams_()
 		log.Infof("new connection to: %+v", dParams_)
-		return net.Dial(dParams_[0], dParams_[1])
+		conn_, err := dialContext_(context.Background(), "tcp", dParams_[1])
+		if err != nil || dParams_[0] != "tls" {
+			return conn_, err
+		}
+		// DNS-over-TLS upstream.
+		connTLSConfig_ := tlsConfig_.Clone()
+		if connTLSConfig_.ServerName == "" {
+			connTLSConfig_.ServerName, _, _ = net.SplitHostPort(dParams_[1])
+		}
+		tlsConn_ := tls.Client(conn_, connTLSConfig_)
+		ctx_, cancel_ := context.WithTimeout(context.Background(), Dns53TLSHandshakeTimeout)
+		defer cancel_()
+		if err = tlsConn_.HandshakeContext(ctx_); err != nil {
+			_ = conn_.Close()
+			return nil, err
+		}
+		return tlsConn_, nil
 	}
-	pool, err := connpool.NewChannelPool(len(dialParams_)*8, len(dialParams_)*128, factory_)
+	pool, err = connpool.NewChannelPool(len(dialParams_)*8, len(dialParams_)*128, factory_)
 	if err != nil {
 		panic(err)
 	}
@@ -86,6 +116,11 @@ func (rsv *Dns53DnsMsgResolver) IsUsingCache() bool {
 	return rsv.useCache
 }
 
+func (rsv *Dns53DnsMsgResolver) Close() {
+	rsv.netConnPool.Close()
+	closeCache(rsv.cache)
+}
+
 func (rsv *Dns53DnsMsgResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
 	cacheItem_, ok := rsv.cache.Get(key)
 	if !ok {
@@ -104,47 +139,30 @@ func (rsv *Dns53DnsMsgResolver) SetCache(key string, value *RspCacheItem, ttl ui
 }
 
 // Query Dns over dns53 endpoint.
-func (rsv *Dns53DnsMsgResolver) Query(qName string, qType uint16, ecsIPs string) (
+func (rsv *Dns53DnsMsgResolver) Query(qName string, qType uint16, ecsIPs string, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
-	return CommonResolverQuery(rsv, qName, qType, ecsIPs)
+	return CommonResolverQuery(rsv, qName, qType, ecsIPs, opts)
 }
 
-func (rsv *Dns53DnsMsgResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
+func (rsv *Dns53DnsMsgResolver) Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
 	msgReq_ := new(dns.Msg)
 	defer func() { msgReq_ = nil }()
 	msgReq_.SetQuestion(dns.Fqdn(qName), qType)
 	msgReq_.RecursionDesired = true
-	if ecsIP != nil {
-		ChangeECSInDnsMsg(msgReq_, ecsIP)
+	opts.ApplyToMsg(msgReq_)
+	if ecs != nil {
+		ChangeECSInDnsMsg(msgReq_, ecs)
 	}
 	msgRsp_, rtt_ := rsv.doQueryUpstream(msgReq_)
-	rsvRsp_ := &DnsMsgResolverRsp{
-		Status:             msgRsp_.Rcode,
-		Truncated:          msgRsp_.Truncated,
-		RecursionDesired:   msgRsp_.RecursionDesired,
-		RecursionAvailable: msgRsp_.RecursionAvailable,
-		AuthenticData:      msgRsp_.AuthenticatedData,
-		CheckingDisabled:   msgRsp_.CheckingDisabled,
-	}
-	rsvRsp_.Question = make([]DohDnsMsgResolverQ, len(msgRsp_.Question))
-	for i, q := range msgRsp_.Question {
-		rsvRsp_.Question[i] = DohDnsMsgResolverQ{
-			Name: q.Name,
-			Type: q.Qtype,
-		}
-	}
-	rsvRsp_.Answer = msgRsp_.Answer
-	rsvRsp_.Authority = msgRsp_.Ns
-	rsvRsp_.Additional = msgRsp_.Extra
+	rsvRsp_ := NewDnsMsgResolverRsp(msgRsp_)
 	if len(msgRsp_.Question) > 0 {
 		log.Infof("got reply to question: %s, %s, %+v", msgRsp_.Question[0].Name,
 			dns.TypeToString[msgRsp_.Question[0].Qtype], rtt_)
 	}
 	log.Tracef("got reply from upstream: %v", msgRsp_.String())
-	rsvRsp_.UnixTSOfArrival_ = time.Now().Unix()
 	return rsvRsp_, nil
 }
 
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DNSCryptStampPrefix = "sdns://"
+	DNSCryptTimeout     = 5 * time.Second
+	// DNSCryptCertRefreshMargin is how long before expiration a provider certificate is refreshed.
+	DNSCryptCertRefreshMargin = 10 * time.Minute
+)
+
+// dnscryptServer is a DNSCrypt resolver with its verified provider certificate.
+type dnscryptServer struct {
+	stamp        string
+	mu           sync.Mutex
+	resolverInfo *dnscrypt.ResolverInfo
+}
+
+type DNSCryptResolver struct {
+	udpClient  *dnscrypt.Client
+	tcpClient  *dnscrypt.Client
+	cache      Cache
+	cacheType  string
+	useCache   bool
+	servers    []*dnscryptServer
+	nextServer func() *dnscryptServer
+}
+
+func NewDNSCryptResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *DNSCryptResolver) {
+	if upstreamOptions != nil && upstreamOptions.proxyURL != "" {
+		log.Warnf("proxy is not supported by dnscrypt upstreams, connecting directly")
+	}
+	rsv = &DNSCryptResolver{
+		udpClient: &dnscrypt.Client{Net: "udp", Timeout: DNSCryptTimeout, UDPSize: DefaultReplyUDPSize},
+		tcpClient: &dnscrypt.Client{Net: "tcp", Timeout: DNSCryptTimeout},
+		useCache:  useCache,
+	}
+	for _, e := range endpoints {
+		if !strings.HasPrefix(e, DNSCryptStampPrefix) {
+			panic("endpoint not usable, should be a dnscrypt stamp like sdns://AQ...")
+		}
+		rsv.servers = append(rsv.servers, &dnscryptServer{stamp: e})
+	}
+	if len(rsv.servers) == 0 {
+		panic("dnscrypt endpoint not specified")
+	}
+	rsv.nextServer = func() func() *dnscryptServer {
+		initV_ := 0
+		if len(rsv.servers) == 1 {
+			return func() *dnscryptServer {
+				return rsv.servers[0]
+			}
+		} else {
+			return func() *dnscryptServer {
+				ret_ := rsv.servers[initV_]
+				initV_ = (initV_ + 1) % len(rsv.servers)
+				return ret_
+			}
+		}
+	}()
+	// If using cache
+	if rsv.useCache {
+		if cacheOptions.cacheType == CacheTypeInternal {
+			rsv.cache = NewCacheInternal()
+			rsv.cacheType = CacheTypeInternal
+		}
+		// TODO: redis cache type
+	}
+	return
+}
+
+func (rsv *DNSCryptResolver) IsUsingCache() bool {
+	return rsv.useCache
+}
+
+func (rsv *DNSCryptResolver) Close() {
+	closeCache(rsv.cache)
+}
+
+func (rsv *DNSCryptResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
+	cacheItem_, ok := rsv.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if rsv.cacheType == CacheTypeInternal {
+		return cacheItem_.(*RspCacheItem).ResolverResponse, true
+	} else {
+		// TODO: redis cache type
+		return nil, false
+	}
+}
+
+func (rsv *DNSCryptResolver) SetCache(key string, value *RspCacheItem, ttl uint32) {
+	rsv.cache.Set(key, value, ttl)
+}
+
+// resolverInfo returns the server's verified certificate, fetches a new one when absent, about to expire
+// or forced to.
+func (rsv *DNSCryptResolver) resolverInfo(server *dnscryptServer, force bool) (
+	info *dnscrypt.ResolverInfo, err error) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !force && server.resolverInfo != nil {
+		notAfter_ := time.Unix(int64(server.resolverInfo.ResolverCert.NotAfter), 0)
+		if time.Now().Add(DNSCryptCertRefreshMargin).Before(notAfter_) {
+			return server.resolverInfo, nil
+		}
+	}
+	info, err = rsv.udpClient.Dial(server.stamp)
+	if err != nil {
+		// Some servers only answer certificate queries over tcp.
+		if info, err = rsv.tcpClient.Dial(server.stamp); err != nil {
+			return nil, fmt.Errorf("fetch dnscrypt certificate error: %v", err)
+		}
+	}
+	log.Debugf("dnscrypt certificate of %s: serial %d, %s, valid until %s", info.ProviderName,
+		info.ResolverCert.Serial, info.ResolverCert.EsVersion,
+		time.Unix(int64(info.ResolverCert.NotAfter), 0).Format(time.RFC3339))
+	server.resolverInfo = info
+	return
+}
+
+// exchange sends query over udp and retries over tcp if the response is truncated.
+func (rsv *DNSCryptResolver) exchange(msgReq *dns.Msg, info *dnscrypt.ResolverInfo) (msgRsp *dns.Msg, err error) {
+	msgRsp, err = rsv.udpClient.Exchange(msgReq, info)
+	if err == nil && !msgRsp.Truncated {
+		return
+	}
+	if err != nil {
+		log.Debugf("dnscrypt udp exchange error, retrying over tcp: %v", err)
+	} else {
+		log.Debugf("dnscrypt udp response truncated, retrying over tcp")
+	}
+	return rsv.tcpClient.Exchange(msgReq, info)
+}
+
+// Query DNSCrypt endpoint.
+func (rsv *DNSCryptResolver) Query(qName string, qType uint16, ecsIPs string, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	return CommonResolverQuery(rsv, qName, qType, ecsIPs, opts)
+}
+
+func (rsv *DNSCryptResolver) Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion(dns.Fqdn(qName), qType)
+	msgReq_.RecursionDesired = true
+	opts.ApplyToMsg(msgReq_)
+	if ecs != nil {
+		ChangeECSInDnsMsg(msgReq_, ecs)
+	}
+	server_ := rsv.nextServer()
+	info_, err := rsv.resolverInfo(server_, false)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	msgRsp_, err := rsv.exchange(msgReq_, info_)
+	if err != nil {
+		// The provider may have rotated its certificate, refetch it and try again.
+		log.Debugf("dnscrypt exchange error, refreshing certificate: %v", err)
+		if info_, err = rsv.resolverInfo(server_, true); err != nil {
+			log.Error(err)
+			return
+		}
+		if msgRsp_, err = rsv.exchange(msgReq_, info_); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if len(msgRsp_.Question) > 0 {
+		log.Infof("got dnscrypt reply to question: %s, %s", msgRsp_.Question[0].Name,
+			dns.TypeToString[msgRsp_.Question[0].Qtype])
+	}
+	log.Tracef("got reply from upstream: %v", msgRsp_.String())
+	return NewDnsMsgResolverRsp(msgRsp_), nil
+}
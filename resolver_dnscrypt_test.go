@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDNSCryptHandler answers with answer and counts queries over tcp.
+type fakeDNSCryptHandler struct {
+	answer     func(*dns.Msg) *dns.Msg
+	tcpQueries int32
+}
+
+func (h *fakeDNSCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		atomic.AddInt32(&h.tcpQueries, 1)
+	}
+	return rw.WriteMsg(h.answer(r))
+}
+
+// startFakeDNSCryptServer serves with a new certificate signed by providerKey on addr, port 0 means random.
+func startFakeDNSCryptServer(t *testing.T, providerKey ed25519.PrivateKey, esVersion dnscrypt.CryptoConstruction,
+	addr string, handler dnscrypt.Handler) (stamp string, stop func()) {
+
+	rc_, err := dnscrypt.GenerateResolverConfig("doh-relay.test", providerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc_.EsVersion = esVersion
+	cert_, err := rc_.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ := &dnscrypt.Server{ProviderName: rc_.ProviderName, ResolverCert: cert_, Handler: handler}
+	tcpListener_, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn_, err := net.ListenPacket("udp", tcpListener_.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn_ := packetConn_.(*net.UDPConn)
+	go func() { _ = server_.ServeTCP(tcpListener_) }()
+	go func() { _ = server_.ServeUDP(udpConn_) }()
+	stamp_, err := rc_.CreateStamp(tcpListener_.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = func() {
+		ctx_, cancel_ := context.WithTimeout(context.Background(), time.Second)
+		defer cancel_()
+		_ = server_.Shutdown(ctx_)
+		_ = tcpListener_.Close()
+		_ = udpConn_.Close()
+	}
+	t.Cleanup(stop)
+	return stamp_.String(), stop
+}
+
+func TestDNSCryptResolver(t *testing.T) {
+	_, providerKey_, _ := ed25519.GenerateKey(rand.Reader)
+	for _, esVersion := range []dnscrypt.CryptoConstruction{dnscrypt.XSalsa20Poly1305, dnscrypt.XChacha20Poly1305} {
+		t.Run(esVersion.String(), func(t *testing.T) {
+			stamp_, _ := startFakeDNSCryptServer(t, providerKey_, esVersion, "127.0.0.1:0",
+				&fakeDNSCryptHandler{answer: fakeAnswer})
+			rsv_ := NewDNSCryptResolver([]string{stamp_}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+			rsp_, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip_ := GetIPAnswerFromResolverRsp(rsp_); ip_ != "192.0.2.1" {
+				t.Errorf("answer = %q, want 192.0.2.1", ip_)
+			}
+		})
+	}
+}
+
+func TestDNSCryptResolver_TruncatedRetryTCP(t *testing.T) {
+	handler_ := &fakeDNSCryptHandler{answer: func(msgReq *dns.Msg) *dns.Msg {
+		msgRsp_ := new(dns.Msg)
+		msgRsp_.SetReply(msgReq)
+		for i := 0; i < 100; i++ {
+			msgRsp_.Answer = append(msgRsp_.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: msgReq.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat("x", 32)},
+			})
+		}
+		return msgRsp_
+	}}
+	_, providerKey_, _ := ed25519.GenerateKey(rand.Reader)
+	stamp_, _ := startFakeDNSCryptServer(t, providerKey_, dnscrypt.XSalsa20Poly1305, "127.0.0.1:0", handler_)
+	rsv_ := NewDNSCryptResolver([]string{stamp_}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+	rsp_, err := rsv_.Resolve("example.com", dns.TypeTXT, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp_.TruncatedV() || len(rsp_.AnswerV()) != 100 {
+		t.Errorf("got %d answers truncated %t, want full answer over tcp", len(rsp_.AnswerV()), rsp_.TruncatedV())
+	}
+	if atomic.LoadInt32(&handler_.tcpQueries) != 1 {
+		t.Errorf("tcp queries = %d, want 1", handler_.tcpQueries)
+	}
+}
+
+func TestDNSCryptResolver_CertRotation(t *testing.T) {
+	_, providerKey_, _ := ed25519.GenerateKey(rand.Reader)
+	stamp_, stop_ := startFakeDNSCryptServer(t, providerKey_, dnscrypt.XSalsa20Poly1305, "127.0.0.1:0",
+		&fakeDNSCryptHandler{answer: fakeAnswer})
+	rsv_ := NewDNSCryptResolver([]string{stamp_}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+	if _, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	oldCert_ := rsv_.servers[0].resolverInfo.ResolverCert
+
+	// Restart the server on the same address with new short-term keys.
+	stop_()
+	time.Sleep(time.Second)
+	addr_ := rsv_.servers[0].resolverInfo.ServerAddress
+	startFakeDNSCryptServer(t, providerKey_, dnscrypt.XSalsa20Poly1305, addr_, &fakeDNSCryptHandler{answer: fakeAnswer})
+	if _, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rsv_.servers[0].resolverInfo.ResolverCert.ResolverPk == oldCert_.ResolverPk {
+		t.Errorf("certificate not rotated")
+	}
+}
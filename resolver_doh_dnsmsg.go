@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/miekg/dns"
@@ -9,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -27,7 +25,8 @@ type DohDnsMsgResolver struct {
 	nextEndpoint func() string
 }
 
-func NewDohDnsMsgResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions) (rsv *DohDnsMsgResolver) {
+func NewDohDnsMsgResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *DohDnsMsgResolver) {
 	httpTransport_ := &http.Transport{
 		Proxy:                 nil,
 		ForceAttemptHTTP2:     true,
@@ -36,28 +35,16 @@ func NewDohDnsMsgResolver(endpoints []string, useCache bool, cacheOptions *Cache
 		TLSHandshakeTimeout:   3 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
-	if ExecConfig.UpstreamHostResolver != "" {
-		url_, err := url.Parse(strings.TrimSpace(ExecConfig.UpstreamHostResolver))
-		if err == nil {
-			if ListenAddrPortAvailable(url_.Host) {
-				dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
-					dialer := &net.Dialer{
-						Resolver: &net.Resolver{
-							PreferGo: true,
-							Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-								d := net.Dialer{
-									Timeout: time.Duration(5000) * time.Millisecond,
-								}
-								return d.DialContext(ctx, url_.Scheme, url_.Host)
-							},
-						},
-					}
-					return dialer.DialContext(ctx, network, addr)
-				}
-				httpTransport_.DialContext = dialContext
-			}
-		}
+	dialContext_, err := NewUpstreamDialContext(upstreamOptions)
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.DialContext = dialContext_
+	tlsConfig_, err := upstreamOptions.TLSConfig()
+	if err != nil {
+		panic(err)
 	}
+	httpTransport_.TLSClientConfig = tlsConfig_
 	rsv = &DohDnsMsgResolver{
 		httpClient: &http.Client{
 			Transport: httpTransport_,
@@ -94,6 +81,11 @@ func (rsv *DohDnsMsgResolver) IsUsingCache() bool {
 	return rsv.useCache
 }
 
+func (rsv *DohDnsMsgResolver) Close() {
+	rsv.httpClient.CloseIdleConnections()
+	closeCache(rsv.cache)
+}
+
 func (rsv *DohDnsMsgResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
 	cacheItem_, ok := rsv.cache.Get(key)
 	if !ok {
@@ -112,21 +104,22 @@ func (rsv *DohDnsMsgResolver) SetCache(key string, value *RspCacheItem, ttl uint
 }
 
 // Query Dns over HTTPS endpoint.
-func (rsv *DohDnsMsgResolver) Query(qName string, qType uint16, ecsIPs string) (
+func (rsv *DohDnsMsgResolver) Query(qName string, qType uint16, ecsIPs string, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
-	return CommonResolverQuery(rsv, qName, qType, ecsIPs)
+	return CommonResolverQuery(rsv, qName, qType, ecsIPs, opts)
 }
 
-func (rsv *DohDnsMsgResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
+func (rsv *DohDnsMsgResolver) Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
 	msgReq_ := new(dns.Msg)
 	defer func() { msgReq_ = nil }()
 	msgReq_.SetQuestion(dns.Fqdn(qName), qType)
 	msgReq_.RecursionDesired = true
-	if ecsIP != nil {
-		ChangeECSInDnsMsg(msgReq_, ecsIP)
+	opts.ApplyToMsg(msgReq_)
+	if ecs != nil {
+		ChangeECSInDnsMsg(msgReq_, ecs)
 	}
 	msgBytes_, err := msgReq_.Pack()
 	defer func() { msgBytes_ = nil }()
@@ -142,7 +135,7 @@ func (rsv *DohDnsMsgResolver) Resolve(qName string, qType uint16, ecsIP *net.IP)
 	}
 	httpReq_ := &http.Request{
 		URL:    url_,
-		Header: map[string][]string{"Accept": {"application/dns-message"}},
+		Header: map[string][]string{"Accept": {MimeTypeDnsMsg}},
 	}
 	defer func() {
 		httpReq_.URL = nil
@@ -175,29 +168,11 @@ func (rsv *DohDnsMsgResolver) Resolve(qName string, qType uint16, ecsIP *net.IP)
 		log.Error(err)
 		return
 	}
-	rsvRsp_ := &DnsMsgResolverRsp{
-		Status:             msgRsp_.Rcode,
-		Truncated:          msgRsp_.Truncated,
-		RecursionDesired:   msgRsp_.RecursionDesired,
-		RecursionAvailable: msgRsp_.RecursionAvailable,
-		AuthenticData:      msgRsp_.AuthenticatedData,
-		CheckingDisabled:   msgRsp_.CheckingDisabled,
-	}
-	rsvRsp_.Question = make([]DohDnsMsgResolverQ, len(msgRsp_.Question))
-	for i, q := range msgRsp_.Question {
-		rsvRsp_.Question[i] = DohDnsMsgResolverQ{
-			Name: q.Name,
-			Type: q.Qtype,
-		}
-	}
-	rsvRsp_.Answer = msgRsp_.Answer
-	rsvRsp_.Authority = msgRsp_.Ns
-	rsvRsp_.Additional = msgRsp_.Extra
+	rsvRsp_ := NewDnsMsgResolverRsp(msgRsp_)
 	if len(msgRsp_.Question) > 0 {
 		log.Infof("got reply to question: %s, %s [%s]", msgRsp_.Question[0].Name,
 			dns.TypeToString[msgRsp_.Question[0].Qtype], msgBase64_)
 	}
 	log.Tracef("got reply from upstream: %v", msgRsp_.String())
-	rsvRsp_.UnixTSOfArrival_ = time.Now().Unix()
 	return rsvRsp_, nil
 }
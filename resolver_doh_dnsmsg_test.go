@@ -76,7 +76,7 @@ func Test_DnsMsgBase64(t *testing.T) {
 }
 
 func TestDnsMsgResolver_Resolve(t *testing.T) {
-	resolver_ := NewDohDnsMsgResolver(Quad9DnsMsgEndpoints, true, &CacheOptions{cacheType: CacheTypeInternal})
+	resolver_ := NewDohDnsMsgResolver(Quad9DnsMsgEndpoints, true, &CacheOptions{cacheType: CacheTypeInternal}, nil)
 	type args struct {
 		qName            string
 		qType            uint16
@@ -136,8 +136,8 @@ func TestDnsMsgResolver_Resolve(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rsv := resolver_
-			ecsIP_ := net.ParseIP(tt.args.eDnsClientSubnet)
-			_, err := rsv.Resolve(tt.args.qName, tt.args.qType, &ecsIP_)
+			ecs_ := ObtainECSFromString(tt.args.eDnsClientSubnet)
+			_, err := rsv.Resolve(tt.args.qName, tt.args.qType, ecs_, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
 				return
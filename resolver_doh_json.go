@@ -1,14 +1,15 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/miekg/dns"
+	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -26,7 +27,8 @@ type DohJsonResolver struct {
 	nextEndpoint func() string
 }
 
-func NewDohJsonResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions) (rsv *DohJsonResolver) {
+func NewDohJsonResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *DohJsonResolver) {
 	httpTransport_ := &http.Transport{
 		Proxy:                 nil,
 		ForceAttemptHTTP2:     true,
@@ -35,28 +37,16 @@ func NewDohJsonResolver(endpoints []string, useCache bool, cacheOptions *CacheOp
 		TLSHandshakeTimeout:   3 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
-	if ExecConfig.UpstreamHostResolver != "" {
-		url_, err := url.Parse(strings.TrimSpace(ExecConfig.UpstreamHostResolver))
-		if err == nil {
-			if ListenAddrPortAvailable(url_.Host) {
-				dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
-					dialer := &net.Dialer{
-						Resolver: &net.Resolver{
-							PreferGo: true,
-							Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-								d := net.Dialer{
-									Timeout: time.Duration(5000) * time.Millisecond,
-								}
-								return d.DialContext(ctx, url_.Scheme, url_.Host)
-							},
-						},
-					}
-					return dialer.DialContext(ctx, network, addr)
-				}
-				httpTransport_.DialContext = dialContext
-			}
-		}
+	dialContext_, err := NewUpstreamDialContext(upstreamOptions)
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.DialContext = dialContext_
+	tlsConfig_, err := upstreamOptions.TLSConfig()
+	if err != nil {
+		panic(err)
 	}
+	httpTransport_.TLSClientConfig = tlsConfig_
 	rsv = &DohJsonResolver{
 		httpClient: &http.Client{
 			Transport: httpTransport_,
@@ -93,6 +83,11 @@ func (rsv *DohJsonResolver) IsUsingCache() bool {
 	return rsv.useCache
 }
 
+func (rsv *DohJsonResolver) Close() {
+	rsv.httpClient.CloseIdleConnections()
+	closeCache(rsv.cache)
+}
+
 func (rsv *DohJsonResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
 	cacheItem_, ok := rsv.cache.Get(key)
 	if !ok {
@@ -111,29 +106,37 @@ func (rsv *DohJsonResolver) SetCache(key string, value *RspCacheItem, ttl uint32
 }
 
 // Query Dns over HTTPS endpoint.
-func (rsv *DohJsonResolver) Query(qName string, qType uint16, ecsIPs string) (
+func (rsv *DohJsonResolver) Query(qName string, qType uint16, ecsIPs string, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
-	return CommonResolverQuery(rsv, qName, qType, ecsIPs)
+	return CommonResolverQuery(rsv, qName, qType, ecsIPs, opts)
 }
 
-func (rsv *DohJsonResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
+func (rsv *DohJsonResolver) Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
-	ecsP_ := fmt.Sprintf("")
-	if ecsIP != nil {
-		ecsP_ = fmt.Sprintf("&edns_client_subnet=%s", ecsIP.String())
+	params_ := url.Values{}
+	params_.Set("name", qName)
+	params_.Set("type", strconv.Itoa(int(qType)))
+	params_.Set("ct", MimeTypeDnsJson)
+	if opts != nil && opts.DnssecOK {
+		params_.Set("do", "1")
+	}
+	if opts != nil && opts.CheckingDisabled {
+		params_.Set("cd", "1")
 	}
-	urlStr_ := fmt.Sprintf("%s?name=%s&type=%d&do=1%s&random_padding=%d",
-		rsv.nextEndpoint(), qName, qType, ecsP_, time.Now().Nanosecond())
-	url_, err := url.Parse(urlStr_)
+	if ecs != nil {
+		params_.Set("edns_client_subnet", ecs.String())
+	}
+	params_.Set("random_padding", strconv.Itoa(time.Now().Nanosecond()))
+	url_, err := url.Parse(fmt.Sprintf("%s?%s", rsv.nextEndpoint(), params_.Encode()))
 	if err != nil {
 		log.Error(err)
 		return
 	}
 	httpReq_ := &http.Request{
 		URL:    url_,
-		Header: map[string][]string{"Accept": {"application/dns-message"}},
+		Header: map[string][]string{"Accept": {MimeTypeDnsJson, MimeTypeJson}},
 	}
 	defer func() {
 		httpReq_.URL = nil
@@ -155,6 +158,20 @@ func (rsv *DohJsonResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
 		log.Error(err)
 		return nil, err
 	}
+	// Some upstreams honor ct param with wire format.
+	if mediaType_, _, _ := mime.ParseMediaType(httpRsp_.Header.Get("Content-Type")); mediaType_ == MimeTypeDnsMsg {
+		buf_, err := io.ReadAll(httpRsp_.Body)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		msgRsp_ := new(dns.Msg)
+		if err = msgRsp_.Unpack(buf_); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		return NewDnsMsgResolverRsp(msgRsp_), nil
+	}
 	jsonRsp_ := new(DohJsonResolverRsp)
 	decoder_ := json.NewDecoder(httpRsp_.Body)
 	err = decoder_.Decode(&jsonRsp_)
@@ -163,7 +180,7 @@ func (rsv *DohJsonResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
 		return
 	}
 	if jsonRsp_.Status != 0 {
-		log.Warnf("response status is not 0: %+v", rsp)
+		log.Warnf("response status is not 0: %+v", jsonRsp_)
 	} else {
 		log.Tracef("json response: %+v", jsonRsp_)
 	}
@@ -171,28 +188,7 @@ func (rsv *DohJsonResolver) Resolve(qName string, qType uint16, ecsIP *net.IP) (
 		log.Infof("got reply to question: %s %s", jsonRsp_.Question[0].Name,
 			dns.TypeToString[jsonRsp_.Question[0].Type])
 	}
-	for _, r_ := range jsonRsp_.Answer {
-		if rr_, err := r_.RR(); err != nil {
-			log.Error(err)
-			return nil, err
-		} else {
-			log.Debugf("answer record: %s", rr_)
-		}
-	}
-	for _, r_ := range jsonRsp_.Authority {
-		if rr_, err := r_.RR(); err != nil {
-			log.Error(err)
-		} else {
-			log.Debugf("authority record: %s", rr_)
-		}
-	}
-	for _, r_ := range jsonRsp_.Additional {
-		if rr_, err := r_.RR(); err != nil {
-			log.Error(err)
-		} else {
-			log.Debugf("extra record: %s", rr_)
-		}
-	}
+	jsonRsp_.parseRRs()
 	jsonRsp_.UnixTSOfArrival_ = time.Now().Unix()
 	return jsonRsp_, nil
 }
@@ -2,6 +2,10 @@ package main
 
 import (
 	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -10,7 +14,7 @@ func TestDohJsonResolver_Resolve(t *testing.T) {
 		qName string
 		qType uint16
 	}
-	resolver_ := NewDohJsonResolver(Quad9JsonEndpoints, true, &CacheOptions{cacheType: CacheTypeInternal})
+	resolver_ := NewDohJsonResolver(Quad9JsonEndpoints, true, &CacheOptions{cacheType: CacheTypeInternal}, nil)
 	tests := []struct {
 		name     string
 		resolver *DohJsonResolver
@@ -66,7 +70,7 @@ func TestDohJsonResolver_Resolve(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rsv := tt.resolver
-			_, err := rsv.Resolve(tt.args.qName, tt.args.qType, nil)
+			_, err := rsv.Resolve(tt.args.qName, tt.args.qType, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -74,3 +78,98 @@ func TestDohJsonResolver_Resolve(t *testing.T) {
 		})
 	}
 }
+
+func TestDohJsonResolver_Parity(t *testing.T) {
+	var header_ http.Header
+	var params_ url.Values
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header_, params_ = r.Header, r.URL.Query()
+		w.Header().Set("Content-Type", MimeTypeDnsJson)
+		_, _ = w.Write([]byte(`{"Status":0,"RA":true,` +
+			`"Question":[{"name":"a&b.example.","type":1}],` +
+			`"Answer":[` +
+			`{"name":"a&b.example.","type":1,"TTL":300,"data":"192.0.2.1"},` +
+			`{"name":"a&b.example.","type":1,"TTL":300,"data":"not-an-ip"},` +
+			`{"name":"a&b.example.","type":65280,"TTL":300,"data":"\\# 2 abcd"},` +
+			`{"name":"a&b.example.","type":65281,"TTL":300,"data":"0102"}],` +
+			`"edns_client_subnet":"192.0.2.0/24/16"}`))
+	}))
+	defer srv_.Close()
+	rsv_ := NewDohJsonResolver([]string{srv_.URL + "/resolve"}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+
+	ecs_ := ECSSubnetOfIP(net.ParseIP("192.0.2.55"))
+	rsp_, err := rsv_.Resolve("a&b.example.", dns.TypeA, ecs_, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept_ := header_.Values("Accept"); !SliceContains(accept_, MimeTypeDnsJson) {
+		t.Errorf("Accept = %v, want %s", accept_, MimeTypeDnsJson)
+	}
+	if params_.Get("name") != "a&b.example." || params_.Get("type") != "1" {
+		t.Errorf("name/type params = %v", params_)
+	}
+	if params_.Get("ct") != MimeTypeDnsJson {
+		t.Errorf("ct param = %q, want %s", params_.Get("ct"), MimeTypeDnsJson)
+	}
+	if ecs_ := params_.Get("edns_client_subnet"); ecs_ != "192.0.2.0/24" {
+		t.Errorf("edns_client_subnet param = %q, want 192.0.2.0/24", ecs_)
+	}
+	if answer_ := rsp_.AnswerV(); len(answer_) != 3 {
+		t.Errorf("answer = %v, want 3 records with the invalid one skipped", answer_)
+	} else if again_ := rsp_.AnswerV(); again_[0] != answer_[0] {
+		t.Error("answer records parsed again")
+	}
+	opt_ := rsp_.OptV()
+	if opt_ == nil || len(opt_.Option) != 1 {
+		t.Fatalf("OptV() = %v, want ECS option", opt_)
+	}
+	if ecs_ := opt_.Option[0].(*dns.EDNS0_SUBNET); ecs_.SourceNetmask != 24 || ecs_.SourceScope != 16 {
+		t.Errorf("ECS = %v, want source 24 and scope 16", ecs_)
+	}
+}
+
+func TestDohJsonResolver_WireFormatResponse(t *testing.T) {
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion(dns.Fqdn(r.URL.Query().Get("name")), dns.TypeA)
+		msgRspBytes_, _ := fakeAnswer(msgReq_).Pack()
+		w.Header().Set("Content-Type", MimeTypeDnsMsg)
+		_, _ = w.Write(msgRspBytes_)
+	}))
+	defer srv_.Close()
+	rsv_ := NewDohJsonResolver([]string{srv_.URL + "/resolve"}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+	rsp_, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip_ := GetIPAnswerFromResolverRsp(rsp_); ip_ != "192.0.2.1" {
+		t.Errorf("answer = %q, want 192.0.2.1", ip_)
+	}
+}
+
+func TestParseJsonECS(t *testing.T) {
+	tests := []struct {
+		s          string
+		wantSource uint8
+		wantScope  uint8
+		wantErr    bool
+	}{
+		{s: "192.0.2.0/24/0", wantSource: 24, wantScope: 0},
+		{s: "192.0.2.0/20", wantSource: 32, wantScope: 20},
+		{s: "2001:db8::/56/48", wantSource: 56, wantScope: 48},
+		{s: "192.0.2.0/33", wantErr: true},
+		{s: "192.0.2.0", wantErr: true},
+		{s: "bogus/24", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			ecs_, err := ParseJsonECS(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseJsonECS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (ecs_.SourceNetmask != tt.wantSource || ecs_.SourceScope != tt.wantScope) {
+				t.Errorf("ParseJsonECS() = %v, want source %d scope %d", ecs_, tt.wantSource, tt.wantScope)
+			}
+		})
+	}
+}
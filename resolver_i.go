@@ -3,9 +3,11 @@ package main
 import "net"
 
 type Resolver interface {
-	Query(qName string, qType uint16, eDnsClientSubnets string) (rsp ResolverRsp, err error)
-	Resolve(qName string, qType uint16, ip *net.IP) (rsp ResolverRsp, err error)
+	Query(qName string, qType uint16, eDnsClientSubnets string, opts *QueryOptions) (rsp ResolverRsp, err error)
+	Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (rsp ResolverRsp, err error)
 	IsUsingCache() bool
 	GetCache(string) (rsp ResolverRsp, ok bool)
 	SetCache(string, *RspCacheItem, uint32)
+	// Close releases upstream connections and cache.
+	Close()
 }
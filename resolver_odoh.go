@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ODoHConfigsTTL is how long the HPKE configs of a target are cached.
+const ODoHConfigsTTL = 1 * time.Hour
+
+// odohEndpoint is an endpoint of oblivious proxy with targethost and targetpath params, or an endpoint of
+// target which is queried directly.
+type odohEndpoint struct {
+	url        string
+	configsURL string
+}
+
+type odohConfigsItem struct {
+	config   ODoHConfigContents
+	expireAt time.Time
+}
+
+type ODoHResolver struct {
+	httpClient   *http.Client
+	cache        Cache
+	cacheType    string
+	useCache     bool
+	endpoints    []odohEndpoint
+	nextEndpoint func() odohEndpoint
+	configsMu    sync.Mutex
+	configs      map[string]*odohConfigsItem
+}
+
+func NewODoHResolver(endpoints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *ODoHResolver) {
+	httpTransport_ := &http.Transport{
+		Proxy:                 nil,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	dialContext_, err := NewUpstreamDialContext(upstreamOptions)
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.DialContext = dialContext_
+	tlsConfig_, err := upstreamOptions.TLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	httpTransport_.TLSClientConfig = tlsConfig_
+	rsv = &ODoHResolver{
+		httpClient: &http.Client{
+			Transport: httpTransport_,
+		},
+		useCache: useCache,
+		configs:  make(map[string]*odohConfigsItem),
+	}
+	for _, e := range endpoints {
+		endpoint_, err := parseODoHEndpoint(e)
+		if err != nil {
+			panic(err)
+		}
+		rsv.endpoints = append(rsv.endpoints, endpoint_)
+	}
+	if len(rsv.endpoints) == 0 {
+		panic("odoh endpoint not specified, should be like " +
+			"https://proxy.example/proxy?targethost=odoh.example&targetpath=/dns-query")
+	}
+	rsv.nextEndpoint = func() func() odohEndpoint {
+		initV_ := 0
+		if len(rsv.endpoints) == 1 {
+			return func() odohEndpoint {
+				return rsv.endpoints[0]
+			}
+		} else {
+			return func() odohEndpoint {
+				ret_ := rsv.endpoints[initV_]
+				initV_ = (initV_ + 1) % len(rsv.endpoints)
+				return ret_
+			}
+		}
+	}()
+	// If using cache
+	if rsv.useCache {
+		if cacheOptions.cacheType == CacheTypeInternal {
+			rsv.cache = NewCacheInternal()
+			rsv.cacheType = CacheTypeInternal
+		}
+		// TODO: redis cache type
+	}
+	return
+}
+
+// parseODoHEndpoint figures out where to fetch the configs of target, which is always served over https.
+func parseODoHEndpoint(endpoint string) (e odohEndpoint, err error) {
+	url_, err := url.Parse(endpoint)
+	if err != nil || url_.Host == "" {
+		return e, fmt.Errorf("odoh endpoint invalid: %s", endpoint)
+	}
+	e.url = endpoint
+	if targetHost_ := url_.Query().Get("targethost"); targetHost_ != "" {
+		e.configsURL = "https://" + targetHost_ + ODoHConfigsPath
+	} else {
+		e.configsURL = "https://" + url_.Host + ODoHConfigsPath
+	}
+	return
+}
+
+func (rsv *ODoHResolver) IsUsingCache() bool {
+	return rsv.useCache
+}
+
+func (rsv *ODoHResolver) Close() {
+	rsv.httpClient.CloseIdleConnections()
+	closeCache(rsv.cache)
+}
+
+func (rsv *ODoHResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
+	cacheItem_, ok := rsv.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if rsv.cacheType == CacheTypeInternal {
+		return cacheItem_.(*RspCacheItem).ResolverResponse, true
+	} else {
+		// TODO: redis cache type
+		return nil, false
+	}
+}
+
+func (rsv *ODoHResolver) SetCache(key string, value *RspCacheItem, ttl uint32) {
+	rsv.cache.Set(key, value, ttl)
+}
+
+// targetConfig returns the cached config of target, fetches it if not cached or expired.
+func (rsv *ODoHResolver) targetConfig(configsURL string) (config ODoHConfigContents, err error) {
+	rsv.configsMu.Lock()
+	item_, ok := rsv.configs[configsURL]
+	rsv.configsMu.Unlock()
+	if ok && time.Now().Before(item_.expireAt) {
+		return item_.config, nil
+	}
+	httpRsp_, err := rsv.httpClient.Get(configsURL)
+	if err != nil {
+		return
+	}
+	defer func() { _ = httpRsp_.Body.Close() }()
+	if httpRsp_.StatusCode != http.StatusOK {
+		return config, fmt.Errorf("fetch odoh configs got status code: %d", httpRsp_.StatusCode)
+	}
+	buf_, err := io.ReadAll(httpRsp_.Body)
+	if err != nil {
+		return
+	}
+	configs_, err := ParseODoHConfigs(buf_)
+	if err != nil {
+		return
+	}
+	config = configs_[0]
+	rsv.configsMu.Lock()
+	rsv.configs[configsURL] = &odohConfigsItem{config: config, expireAt: time.Now().Add(ODoHConfigsTTL)}
+	rsv.configsMu.Unlock()
+	return
+}
+
+// dropTargetConfig removes the cached config of target, for target may have rotated its keys.
+func (rsv *ODoHResolver) dropTargetConfig(configsURL string) {
+	rsv.configsMu.Lock()
+	delete(rsv.configs, configsURL)
+	rsv.configsMu.Unlock()
+}
+
+// Query Oblivious DoH endpoint. ECS IPs are ignored, client subnets sent to target would defeat the
+// obliviousness, and replies are cached regardless of locations.
+func (rsv *ODoHResolver) Query(qName string, qType uint16, _ string, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	return CommonResolverQuery(rsv, qName, qType, "", opts)
+}
+
+// Resolve queries target through proxy, queries carry no ECS.
+func (rsv *ODoHResolver) Resolve(qName string, qType uint16, _ *net.IPNet, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	msgReq_ := new(dns.Msg)
+	msgReq_.SetQuestion(dns.Fqdn(qName), qType)
+	msgReq_.RecursionDesired = true
+	opts.ApplyToMsg(msgReq_)
+	msgBytes_, err := msgReq_.Pack()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	endpoint_ := rsv.nextEndpoint()
+	config_, err := rsv.targetConfig(endpoint_.configsURL)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	odohReq_, queryCtx_, err := config_.EncryptQuery(msgBytes_)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	httpReq_, err := http.NewRequest(http.MethodPost, endpoint_.url, bytes.NewReader(odohReq_.Marshal()))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	httpReq_.Header.Set("Content-Type", MimeTypeODoHMsg)
+	httpReq_.Header.Set("Accept", MimeTypeODoHMsg)
+	httpRsp_, err := rsv.httpClient.Do(httpReq_)
+	defer func() {
+		if httpRsp_ != nil && httpRsp_.Body != nil {
+			_ = httpRsp_.Body.Close()
+		}
+	}()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if httpRsp_.StatusCode >= 400 {
+		// Target replies 401 when it can't decrypt the query with its current keys.
+		if httpRsp_.StatusCode == http.StatusUnauthorized {
+			rsv.dropTargetConfig(endpoint_.configsURL)
+		}
+		err = fmt.Errorf("got status code: %d", httpRsp_.StatusCode)
+		log.Error(err)
+		return nil, err
+	}
+	buf_, err := io.ReadAll(httpRsp_.Body)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	odohRsp_, err := ParseODoHMessage(buf_)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	rspBytes_, err := queryCtx_.DecryptResponse(odohRsp_)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	msgRsp_ := new(dns.Msg)
+	if err = msgRsp_.Unpack(rspBytes_); err != nil {
+		log.Error(err)
+		return
+	}
+	if len(msgRsp_.Question) > 0 {
+		log.Infof("got oblivious reply to question: %s, %s", msgRsp_.Question[0].Name,
+			dns.TypeToString[msgRsp_.Question[0].Qtype])
+	}
+	log.Tracef("got reply from upstream: %v", msgRsp_.String())
+	return NewDnsMsgResolverRsp(msgRsp_), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeODoHTarget decrypts queries with its key pair and answers them with answer.
+type fakeODoHTarget struct {
+	mu      sync.Mutex
+	keyPair *ODoHKeyPair
+	answer  func(*dns.Msg) *dns.Msg
+}
+
+func (target *fakeODoHTarget) KeyPair() *ODoHKeyPair {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	return target.keyPair
+}
+
+func (target *fakeODoHTarget) RotateKey(t *testing.T) {
+	keyPair_, err := NewODoHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.mu.Lock()
+	target.keyPair = keyPair_
+	target.mu.Unlock()
+}
+
+func (target *fakeODoHTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyPair_ := target.KeyPair()
+	if r.URL.Path == ODoHConfigsPath {
+		_, _ = w.Write(MarshalODoHConfigs(keyPair_.Config))
+		return
+	}
+	body_, _ := io.ReadAll(r.Body)
+	odohReq_, err := ParseODoHMessage(body_)
+	if err != nil || r.Header.Get("Content-Type") != MimeTypeODoHMsg {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msgReqBytes_, rspCtx_, err := keyPair_.DecryptQuery(odohReq_)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	msgReq_ := new(dns.Msg)
+	if err = msgReq_.Unpack(msgReqBytes_); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msgRspBytes_, _ := target.answer(msgReq_).Pack()
+	odohRsp_, err := rspCtx_.EncryptResponse(msgRspBytes_)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", MimeTypeODoHMsg)
+	_, _ = w.Write(odohRsp_.Marshal())
+}
+
+// newFakeODoHProxy forwards queries to the target named by targethost and targetpath params.
+func newFakeODoHProxy(t *testing.T, client *http.Client) (srv *httptest.Server, forwarded *int32) {
+	forwarded = new(int32)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetURL_ := url.URL{Scheme: "https", Host: r.URL.Query().Get("targethost"),
+			Path: r.URL.Query().Get("targetpath")}
+		body_, _ := io.ReadAll(r.Body)
+		targetRsp_, err := client.Post(targetURL_.String(), r.Header.Get("Content-Type"), bytes.NewReader(body_))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer func() { _ = targetRsp_.Body.Close() }()
+		atomic.AddInt32(forwarded, 1)
+		w.Header().Set("Content-Type", targetRsp_.Header.Get("Content-Type"))
+		w.WriteHeader(targetRsp_.StatusCode)
+		_, _ = io.Copy(w, targetRsp_.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return
+}
+
+func TestODoHResolver(t *testing.T) {
+	pki_ := newTestPKI(t)
+	var ecsQueried_ int32
+	target_ := &fakeODoHTarget{answer: func(msgReq *dns.Msg) *dns.Msg {
+		if opt_ := msgReq.IsEdns0(); opt_ != nil {
+			for _, o := range opt_.Option {
+				if o.Option() == dns.EDNS0SUBNET {
+					atomic.AddInt32(&ecsQueried_, 1)
+				}
+			}
+		}
+		return fakeAnswer(msgReq)
+	}}
+	target_.RotateKey(t)
+	targetSrv_ := httptest.NewUnstartedServer(target_)
+	targetSrv_.TLS = &tls.Config{Certificates: []tls.Certificate{pki_.serverCert}}
+	targetSrv_.StartTLS()
+	defer targetSrv_.Close()
+	proxySrv_, forwarded_ := newFakeODoHProxy(t, targetSrv_.Client())
+	// The client of httptest server trusts its own certificate only.
+	targetSrv_.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs = pki_.caPool
+
+	endpoint_ := proxySrv_.URL + "/proxy?" + url.Values{
+		"targethost": {targetSrv_.Listener.Addr().String()},
+		"targetpath": {"/dns-query"},
+	}.Encode()
+	rsv_ := NewODoHResolver([]string{endpoint_}, false, &CacheOptions{cacheType: CacheTypeInternal},
+		NewUpstreamOptions("", &UpstreamTLSConfigModel{CAFile: pki_.caFile}))
+
+	rsp_, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip_ := GetIPAnswerFromResolverRsp(rsp_); ip_ != "192.0.2.1" {
+		t.Errorf("answer = %q, want 192.0.2.1", ip_)
+	}
+	if n_ := atomic.LoadInt32(forwarded_); n_ != 1 {
+		t.Errorf("proxy forwarded %d queries, want 1", n_)
+	}
+
+	// Queries encrypted with the old key are rejected, and the next query uses the refreshed config.
+	target_.RotateKey(t)
+	if _, err = rsv_.Resolve("example.com", dns.TypeA, nil, nil); err == nil {
+		t.Errorf("Resolve() with rotated key succeeded, want error")
+	}
+	if _, err = rsv_.Resolve("example.com", dns.TypeA, nil, nil); err != nil {
+		t.Errorf("Resolve() after config refreshed error = %v", err)
+	}
+
+	// Client subnets are not sent to target.
+	ecs_ := ECSSubnetOfIP(net.ParseIP("203.0.113.9"))
+	if _, err = rsv_.Resolve("example.com", dns.TypeA, ecs_, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rsv_.Query("example.org", dns.TypeA, "203.0.113.9", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n_ := atomic.LoadInt32(&ecsQueried_); n_ != 0 {
+		t.Errorf("target got %d queries with ecs, want 0", n_)
+	}
+}
+
+func TestParseODoHEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint       string
+		wantConfigsURL string
+		wantErr        bool
+	}{
+		{
+			endpoint:       "https://proxy.example/proxy?targethost=odoh.example&targetpath=/dns-query",
+			wantConfigsURL: "https://odoh.example/.well-known/odohconfigs",
+		},
+		{
+			endpoint:       "https://odoh.example/dns-query",
+			wantConfigsURL: "https://odoh.example/.well-known/odohconfigs",
+		},
+		{endpoint: "/dns-query", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			e_, err := parseODoHEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseODoHEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if e_.configsURL != tt.wantConfigsURL {
+				t.Errorf("configsURL = %s, want %s", e_.configsURL, tt.wantConfigsURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRootHints are addresses of the root servers, a.root-servers.net to m.root-servers.net.
+var DefaultRootHints = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// RecursiveMaxDepth limits nested resolutions of CNAME targets and nameserver addresses.
+	RecursiveMaxDepth = 8
+	// RecursiveMaxCNAMEChain limits aliases followed in an answer.
+	RecursiveMaxCNAMEChain = 16
+	// RecursiveMaxQueries limits queries sent to authoritative servers for resolving a name.
+	RecursiveMaxQueries = 32
+	RecursiveTimeout    = 2 * time.Second
+	// RecursiveMaxDelegationTTL caps how long delegations and nameserver addresses are cached.
+	RecursiveMaxDelegationTTL = 86400
+)
+
+type recursiveDelegation struct {
+	addrs    []string
+	expireAt time.Time
+}
+
+// RecursiveResolver resolves names iteratively from root hints without any upstream recursive resolver.
+type RecursiveResolver struct {
+	udpClient *dns.Client
+	tcpClient *dns.Client
+	cache     Cache
+	cacheType string
+	useCache  bool
+	rootHints []string
+	// nsPort is the port of authoritative servers.
+	nsPort        string
+	delegationsMu sync.Mutex
+	delegations   map[string]*recursiveDelegation
+	ecsSupportMu  sync.Mutex
+	ecsSupport    map[string]bool
+}
+
+func NewRecursiveResolver(rootHints []string, useCache bool, cacheOptions *CacheOptions,
+	upstreamOptions *UpstreamOptions) (rsv *RecursiveResolver) {
+	if upstreamOptions != nil && upstreamOptions.proxyURL != "" {
+		log.Warnf("proxy is not supported in recursive resolution, connecting directly")
+	}
+	if len(rootHints) == 0 {
+		rootHints = DefaultRootHints
+	}
+	rsv = &RecursiveResolver{
+		udpClient:   &dns.Client{Net: "udp", Timeout: RecursiveTimeout, UDPSize: DefaultReplyUDPSize},
+		tcpClient:   &dns.Client{Net: "tcp", Timeout: RecursiveTimeout},
+		useCache:    useCache,
+		nsPort:      "53",
+		delegations: make(map[string]*recursiveDelegation),
+		ecsSupport:  make(map[string]bool),
+	}
+	for _, h := range rootHints {
+		if ip_ := net.ParseIP(strings.TrimSpace(h)); ip_ != nil {
+			rsv.rootHints = append(rsv.rootHints, ip_.String())
+		} else {
+			panic(fmt.Sprintf("root hint not usable, should be an ip address: %s", h))
+		}
+	}
+	// If using cache
+	if rsv.useCache {
+		if cacheOptions.cacheType == CacheTypeInternal {
+			rsv.cache = NewCacheInternal()
+			rsv.cacheType = CacheTypeInternal
+		}
+		// TODO: redis cache type
+	}
+	return
+}
+
+func (rsv *RecursiveResolver) IsUsingCache() bool {
+	return rsv.useCache
+}
+
+func (rsv *RecursiveResolver) Close() {
+	closeCache(rsv.cache)
+}
+
+func (rsv *RecursiveResolver) GetCache(key string) (rsp ResolverRsp, ok bool) {
+	cacheItem_, ok := rsv.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if rsv.cacheType == CacheTypeInternal {
+		return cacheItem_.(*RspCacheItem).ResolverResponse, true
+	} else {
+		// TODO: redis cache type
+		return nil, false
+	}
+}
+
+func (rsv *RecursiveResolver) SetCache(key string, value *RspCacheItem, ttl uint32) {
+	rsv.cache.Set(key, value, ttl)
+}
+
+// Query resolves recursively from root hints.
+func (rsv *RecursiveResolver) Query(qName string, qType uint16, ecsIPs string, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	return CommonResolverQuery(rsv, qName, qType, ecsIPs, opts)
+}
+
+func (rsv *RecursiveResolver) Resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions) (
+	rsp ResolverRsp, err error) {
+
+	qName = dns.Fqdn(qName)
+	msgRsp_, err := rsv.resolve(qName, qType, ecs, opts, 0)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	msgRsp_.Question = []dns.Question{{Name: qName, Qtype: qType, Qclass: dns.ClassINET}}
+	msgRsp_.Authoritative = false
+	msgRsp_.RecursionDesired = true
+	msgRsp_.RecursionAvailable = true
+	// Answers are not validated.
+	msgRsp_.AuthenticatedData = false
+	log.Infof("got recursive reply to question: %s, %s", qName, dns.TypeToString[qType])
+	log.Tracef("got reply from authoritative: %v", msgRsp_.String())
+	return NewDnsMsgResolverRsp(msgRsp_), nil
+}
+
+// resolve walks down from the closest known delegation, minimising query names sent to ancestors of the
+// zone of qName (RFC 9156).
+func (rsv *RecursiveResolver) resolve(qName string, qType uint16, ecs *net.IPNet, opts *QueryOptions, depth int) (
+	msgRsp *dns.Msg, err error) {
+
+	if depth > RecursiveMaxDepth {
+		return nil, fmt.Errorf("max recursion depth exceeded resolving %s", qName)
+	}
+	zone_, servers_ := rsv.closestDelegation(qName)
+	probe_ := childName(zone_, qName)
+	for i := 0; i < RecursiveMaxQueries; i++ {
+		isFinal_ := probe_ == qName
+		probeType_, probeECS_ := dns.TypeA, (*net.IPNet)(nil)
+		if isFinal_ {
+			probeType_, probeECS_ = qType, ecs
+		}
+		msgRsp, err = rsv.exchange(servers_, probe_, probeType_, probeECS_, opts)
+		if err != nil {
+			return nil, err
+		}
+		if cut_, nsRRs_ := referral(msgRsp, zone_); cut_ != "" {
+			if !dns.IsSubDomain(cut_, qName) {
+				return nil, fmt.Errorf("bogus referral to %s resolving %s", cut_, qName)
+			}
+			if servers_, err = rsv.delegate(zone_, cut_, nsRRs_, msgRsp.Extra, depth); err != nil {
+				return nil, err
+			}
+			zone_ = cut_
+			probe_ = childName(zone_, qName)
+			continue
+		}
+		if !isFinal_ {
+			switch msgRsp.Rcode {
+			case dns.RcodeSuccess:
+				// No zone cut at probe, reveal one more label.
+				probe_ = childName(probe_, qName)
+			case dns.RcodeNameError:
+				// Nothing exists under a nonexistent name (RFC 8020).
+				return msgRsp, nil
+			default:
+				// Some servers mishandle minimised queries, fall back to the full name.
+				probe_ = qName
+			}
+			continue
+		}
+		return rsv.followCNAME(msgRsp, qName, qType, ecs, opts, depth)
+	}
+	return nil, fmt.Errorf("max queries exceeded resolving %s", qName)
+}
+
+// followCNAME resolves the target when the answer is an alias only, prepending the alias chain. Answers of
+// looping or too long chains are replaced by SERVFAIL.
+func (rsv *RecursiveResolver) followCNAME(msgRsp *dns.Msg, qName string, qType uint16, ecs *net.IPNet,
+	opts *QueryOptions, depth int) (*dns.Msg, error) {
+
+	if msgRsp.Rcode != dns.RcodeSuccess || qType == dns.TypeCNAME {
+		return msgRsp, nil
+	}
+	target_, chain_ := qName, []dns.RR(nil)
+	seen_ := map[string]bool{strings.ToLower(qName): true}
+	for {
+		var next_ string
+		for _, rr := range msgRsp.Answer {
+			if rr.Header().Rrtype == qType && strings.EqualFold(rr.Header().Name, target_) {
+				return msgRsp, nil
+			}
+			if cname_, ok := rr.(*dns.CNAME); ok && next_ == "" && strings.EqualFold(cname_.Hdr.Name, target_) {
+				next_ = cname_.Target
+				chain_ = append(chain_, cname_)
+			}
+		}
+		if next_ == "" {
+			break
+		}
+		if seen_[strings.ToLower(next_)] || len(chain_) > RecursiveMaxCNAMEChain {
+			log.Debugf("cname chain of %s loops or exceeds %d aliases", qName, RecursiveMaxCNAMEChain)
+			servfail_ := new(dns.Msg)
+			servfail_.SetRcode(msgRsp, dns.RcodeServerFailure)
+			return servfail_, nil
+		}
+		seen_[strings.ToLower(next_)] = true
+		target_ = next_
+	}
+	if target_ == qName {
+		return msgRsp, nil
+	}
+	targetRsp_, err := rsv.resolve(target_, qType, ecs, opts, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	targetRsp_.Answer = append(chain_, targetRsp_.Answer...)
+	return targetRsp_, nil
+}
+
+// exchange sends the query to servers in turn until one answers, retrying over tcp on truncation.
+func (rsv *RecursiveResolver) exchange(servers []string, qName string, qType uint16, ecs *net.IPNet,
+	opts *QueryOptions) (msgRsp *dns.Msg, err error) {
+
+	for _, server := range servers {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion(qName, qType)
+		msgReq_.RecursionDesired = false
+		msgReq_.SetEdns0(DefaultReplyUDPSize, opts != nil && opts.DnssecOK)
+		msgReq_.CheckingDisabled = opts != nil && opts.CheckingDisabled
+		sendECS_ := ecs != nil && rsv.ecsAllowed(server)
+		if sendECS_ {
+			ChangeECSInDnsMsg(msgReq_, ecs)
+		}
+		addr_ := net.JoinHostPort(server, rsv.nsPort)
+		msgRsp, _, err = rsv.udpClient.Exchange(msgReq_, addr_)
+		if err == nil && msgRsp.Truncated {
+			msgRsp, _, err = rsv.tcpClient.Exchange(msgReq_, addr_)
+		}
+		if err != nil {
+			log.Debugf("query %s %s to %s error: %v", qName, dns.TypeToString[qType], server, err)
+			continue
+		}
+		if msgRsp.Rcode == dns.RcodeServerFailure || msgRsp.Rcode == dns.RcodeRefused {
+			log.Debugf("query %s %s to %s got %s", qName, dns.TypeToString[qType], server,
+				dns.RcodeToString[msgRsp.Rcode])
+			err = fmt.Errorf("%s from %s", dns.RcodeToString[msgRsp.Rcode], server)
+			continue
+		}
+		if sendECS_ {
+			rsv.setECSSupport(server, hasECS(msgRsp))
+		}
+		return msgRsp, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no server to query %s", qName)
+	}
+	return nil, err
+}
+
+// ecsAllowed reports if ECS is sent to server, servers not known to ignore ECS are probed with it.
+func (rsv *RecursiveResolver) ecsAllowed(server string) bool {
+	rsv.ecsSupportMu.Lock()
+	defer rsv.ecsSupportMu.Unlock()
+	supported_, known_ := rsv.ecsSupport[server]
+	return !known_ || supported_
+}
+
+func (rsv *RecursiveResolver) setECSSupport(server string, supported bool) {
+	rsv.ecsSupportMu.Lock()
+	rsv.ecsSupport[server] = supported
+	rsv.ecsSupportMu.Unlock()
+}
+
+// closestDelegation finds the deepest cached zone cut of name, the root if none.
+func (rsv *RecursiveResolver) closestDelegation(name string) (zone string, servers []string) {
+	rsv.delegationsMu.Lock()
+	defer rsv.delegationsMu.Unlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone_ := name[off:]
+		if d_, ok := rsv.delegations[zone_]; ok {
+			if time.Now().Before(d_.expireAt) {
+				return zone_, d_.addrs
+			}
+			delete(rsv.delegations, zone_)
+		}
+	}
+	return ".", rsv.rootHints
+}
+
+// delegate caches the delegation of cut from zone, nameserver addresses are taken from in-bailiwick glue or
+// resolved when no glue is given.
+func (rsv *RecursiveResolver) delegate(zone, cut string, nsRRs []*dns.NS, extra []dns.RR, depth int) (
+	servers []string, err error) {
+
+	ttl_ := uint32(RecursiveMaxDelegationTTL)
+	var v6Servers_ []string
+	for _, ns := range nsRRs {
+		ttl_ = minUint32(ttl_, ns.Hdr.Ttl)
+		if !dns.IsSubDomain(zone, ns.Ns) {
+			continue
+		}
+		for _, rr := range extra {
+			if !strings.EqualFold(rr.Header().Name, ns.Ns) {
+				continue
+			}
+			switch rr_ := rr.(type) {
+			case *dns.A:
+				servers = append(servers, rr_.A.String())
+			case *dns.AAAA:
+				v6Servers_ = append(v6Servers_, rr_.AAAA.String())
+			}
+		}
+	}
+	servers = append(servers, v6Servers_...)
+	if len(servers) == 0 {
+		for _, ns := range nsRRs {
+			// Resolving a nameserver under the cut without glue would never end.
+			if dns.IsSubDomain(cut, ns.Ns) {
+				continue
+			}
+			nsRsp_, err := rsv.resolve(ns.Ns, dns.TypeA, nil, nil, depth+1)
+			if err != nil {
+				log.Debugf("resolve nameserver %s of %s error: %v", ns.Ns, cut, err)
+				continue
+			}
+			for _, rr := range nsRsp_.Answer {
+				if a_, ok := rr.(*dns.A); ok {
+					servers = append(servers, a_.A.String())
+				}
+			}
+			if len(servers) != 0 {
+				break
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no address of nameservers for %s", cut)
+	}
+	rsv.delegationsMu.Lock()
+	rsv.delegations[cut] = &recursiveDelegation{
+		addrs:    servers,
+		expireAt: time.Now().Add(time.Duration(ttl_) * time.Second),
+	}
+	rsv.delegationsMu.Unlock()
+	return
+}
+
+// referral returns the zone cut below zone and its NS records if the response is a referral.
+func referral(msgRsp *dns.Msg, zone string) (cut string, nsRRs []*dns.NS) {
+	if msgRsp.Rcode != dns.RcodeSuccess || len(msgRsp.Answer) != 0 {
+		return "", nil
+	}
+	for _, rr := range msgRsp.Ns {
+		ns_, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		if cut == "" {
+			if strings.EqualFold(ns_.Hdr.Name, zone) || !dns.IsSubDomain(zone, ns_.Hdr.Name) {
+				continue
+			}
+			cut = strings.ToLower(ns_.Hdr.Name)
+		}
+		if strings.EqualFold(ns_.Hdr.Name, cut) {
+			nsRRs = append(nsRRs, ns_)
+		}
+	}
+	return
+}
+
+// childName returns the ancestor of name (or name itself) which has one more label than parent.
+func childName(parent, name string) string {
+	labels_ := dns.Split(name)
+	n_ := dns.CountLabel(parent) + 1
+	if n_ >= len(labels_) {
+		return name
+	}
+	return name[labels_[len(labels_)-n_]:]
+}
+
+func hasECS(msg *dns.Msg) bool {
+	if opt_ := msg.IsEdns0(); opt_ != nil {
+		for _, o := range opt_.Option {
+			if o.Option() == dns.EDNS0SUBNET {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
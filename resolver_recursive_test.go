@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuthServer is an authoritative server of zones with records, delegations included.
+type fakeAuthServer struct {
+	zones   []string
+	records []dns.RR
+	echoECS bool
+
+	mu         sync.Mutex
+	queries    []string
+	ecsQueries []string
+}
+
+func (s *fakeAuthServer) Queries() (queries, ecsQueries []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.queries...), append([]string{}, s.ecsQueries...)
+}
+
+func (s *fakeAuthServer) ServeDNS(w dns.ResponseWriter, msgReq *dns.Msg) {
+	q_ := msgReq.Question[0]
+	s.mu.Lock()
+	s.queries = append(s.queries, q_.Name)
+	if hasECS(msgReq) {
+		s.ecsQueries = append(s.ecsQueries, q_.Name)
+	}
+	s.mu.Unlock()
+
+	msgRsp_ := new(dns.Msg)
+	msgRsp_.SetReply(msgReq)
+	if opt_ := msgReq.IsEdns0(); opt_ != nil {
+		msgRsp_.SetEdns0(DefaultReplyUDPSize, false)
+		for _, o := range opt_.Option {
+			if ecs_, ok := o.(*dns.EDNS0_SUBNET); ok && s.echoECS {
+				ecs_.SourceScope = ecs_.SourceNetmask
+				msgRsp_.IsEdns0().Option = append(msgRsp_.IsEdns0().Option, ecs_)
+			}
+		}
+	}
+	zone_ := ""
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z, q_.Name) && len(z) > len(zone_) {
+			zone_ = z
+		}
+	}
+	if zone_ == "" {
+		msgRsp_.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(msgRsp_)
+		return
+	}
+	// Referral to the delegation between zone and the query name.
+	for _, rr := range s.records {
+		if ns_, ok := rr.(*dns.NS); ok && ns_.Hdr.Name != zone_ && dns.IsSubDomain(ns_.Hdr.Name, q_.Name) {
+			msgRsp_.Ns = append(msgRsp_.Ns, ns_)
+			for _, glue := range s.records {
+				if a_, ok := glue.(*dns.A); ok && a_.Hdr.Name == ns_.Ns {
+					msgRsp_.Extra = append(msgRsp_.Extra, a_)
+				}
+			}
+		}
+	}
+	if len(msgRsp_.Ns) != 0 {
+		_ = w.WriteMsg(msgRsp_)
+		return
+	}
+	msgRsp_.Authoritative = true
+	exists_ := false
+	for _, rr := range s.records {
+		if dns.IsSubDomain(q_.Name, rr.Header().Name) {
+			exists_ = true
+		}
+		if rr.Header().Name != q_.Name {
+			continue
+		}
+		if rr.Header().Rrtype == q_.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			msgRsp_.Answer = append(msgRsp_.Answer, rr)
+		}
+	}
+	if len(msgRsp_.Answer) == 0 {
+		if !exists_ {
+			msgRsp_.Rcode = dns.RcodeNameError
+		}
+		soa_, _ := dns.NewRR(zone_ + " 300 IN SOA ns." + zone_ + " admin." + zone_ + " 1 3600 600 86400 60")
+		msgRsp_.Ns = append(msgRsp_.Ns, soa_)
+	}
+	_ = w.WriteMsg(msgRsp_)
+}
+
+func mustRRs(t *testing.T, records ...string) (rrs []dns.RR) {
+	for _, r := range records {
+		rr_, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr_)
+	}
+	return
+}
+
+// startFakeAuthServers serves each server on udp of its own loopback address with the same port.
+func startFakeAuthServers(t *testing.T, servers map[string]*fakeAuthServer) (port string) {
+	for ip, s := range servers {
+		conn_, err := net.ListenPacket("udp", net.JoinHostPort(ip, FirstNonZero(port, "0")))
+		if err != nil {
+			t.Skipf("listen on %s: %v", ip, err)
+		}
+		_, port, _ = net.SplitHostPort(conn_.LocalAddr().String())
+		server_ := &dns.Server{PacketConn: conn_, Handler: s}
+		go func() { _ = server_.ActivateAndServe() }()
+		t.Cleanup(func() { _ = server_.Shutdown() })
+	}
+	return
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	root_ := &fakeAuthServer{zones: []string{"."}, records: mustRRs(t,
+		"test. 86400 IN NS ns.test.",
+		"ns.test. 86400 IN A 127.0.0.2",
+	)}
+	tld_ := &fakeAuthServer{zones: []string{"test."}, records: mustRRs(t,
+		"example.test. 3600 IN NS ns1.example.test.",
+		"ns1.example.test. 3600 IN A 127.0.0.3",
+		"glueless.test. 3600 IN NS ns1.example.test.",
+		"host.test. 300 IN A 192.0.2.2",
+	)}
+	leaf_ := &fakeAuthServer{zones: []string{"example.test.", "glueless.test."}, echoECS: true, records: mustRRs(t,
+		"ns1.example.test. 3600 IN A 127.0.0.3",
+		"www.example.test. 300 IN A 192.0.2.1",
+		"alias.example.test. 300 IN CNAME www.glueless.test.",
+		"www.glueless.test. 300 IN A 192.0.2.3",
+	)}
+	servers_ := map[string]*fakeAuthServer{"127.0.0.1": root_, "127.0.0.2": tld_, "127.0.0.3": leaf_}
+	port_ := startFakeAuthServers(t, servers_)
+
+	rsv_ := NewRecursiveResolver([]string{"127.0.0.1"}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+	rsv_.nsPort = port_
+	ecs_ := ECSSubnetOfIP(net.ParseIP("198.51.100.7"))
+
+	resolve_ := func(name string, qType uint16) ResolverRsp {
+		t.Helper()
+		rsp_, err := rsv_.Resolve(name, qType, ecs_, nil)
+		if err != nil {
+			t.Fatalf("Resolve(%s) error: %v", name, err)
+		}
+		return rsp_
+	}
+	answerOf_ := func(rsp ResolverRsp) (answer []string) {
+		for _, rr := range rsp.AnswerV() {
+			answer = append(answer, strings.Join(strings.Fields(rr.String()), " "))
+		}
+		return
+	}
+
+	if got_ := GetIPAnswerFromResolverRsp(resolve_("www.example.test.", dns.TypeA)); got_ != "192.0.2.1" {
+		t.Errorf("www.example.test. = %q, want 192.0.2.1", got_)
+	}
+	rootQueries_, rootECSQueries_ := root_.Queries()
+	if len(rootQueries_) != 1 || rootQueries_[0] != "test." {
+		t.Errorf("root queries = %v, want only minimised test.", rootQueries_)
+	}
+	if tldQueries_, tldECSQueries_ := tld_.Queries(); SliceContains(tldQueries_, "www.example.test.") ||
+		len(rootECSQueries_)+len(tldECSQueries_) != 0 {
+
+		t.Errorf("full name or ECS sent to ancestors: %v", tldQueries_)
+	}
+	if _, leafECSQueries_ := leaf_.Queries(); !SliceContains(leafECSQueries_, "www.example.test.") {
+		t.Errorf("ECS not sent to authoritative supporting it: %v", leafECSQueries_)
+	}
+
+	// Cached delegations skip the root and tld, CNAME chain leads to a glueless zone.
+	rsp_ := resolve_("alias.example.test.", dns.TypeA)
+	if got_, want_ := answerOf_(rsp_), []string{
+		"alias.example.test. 300 IN CNAME www.glueless.test.",
+		"www.glueless.test. 300 IN A 192.0.2.3",
+	}; strings.Join(got_, "|") != strings.Join(want_, "|") {
+		t.Errorf("alias.example.test. answer = %v, want %v", got_, want_)
+	}
+	if rootQueries_, _ = root_.Queries(); len(rootQueries_) != 1 {
+		t.Errorf("root queried again: %v", rootQueries_)
+	}
+
+	if rsp_ = resolve_("nonexistent.example.test.", dns.TypeA); rsp_.StatusV() != dns.RcodeNameError {
+		t.Errorf("nonexistent.example.test. rcode = %s, want NXDOMAIN", dns.RcodeToString[rsp_.StatusV()])
+	}
+	if rsp_ = resolve_("www.example.test.", dns.TypeAAAA); rsp_.StatusV() != dns.RcodeSuccess || len(rsp_.AnswerV()) != 0 {
+		t.Errorf("www.example.test. AAAA = %v, want NODATA", answerOf_(rsp_))
+	}
+
+	// ECS is no longer sent to the tld which ignored it.
+	for i := 0; i < 2; i++ {
+		if got_ := GetIPAnswerFromResolverRsp(resolve_("host.test.", dns.TypeA)); got_ != "192.0.2.2" {
+			t.Errorf("host.test. = %q, want 192.0.2.2", got_)
+		}
+	}
+	if _, tldECSQueries_ := tld_.Queries(); len(tldECSQueries_) != 1 {
+		t.Errorf("tld ECS queries = %v, want only the probing one", tldECSQueries_)
+	}
+}
+
+func TestChildName(t *testing.T) {
+	tests := []struct {
+		parent, name, want string
+	}{
+		{parent: ".", name: "www.example.test.", want: "test."},
+		{parent: "test.", name: "www.example.test.", want: "example.test."},
+		{parent: "example.test.", name: "www.example.test.", want: "www.example.test."},
+		{parent: "www.example.test.", name: "www.example.test.", want: "www.example.test."},
+	}
+	for _, tt := range tests {
+		if got_ := childName(tt.parent, tt.name); got_ != tt.want {
+			t.Errorf("childName(%s, %s) = %s, want %s", tt.parent, tt.name, got_, tt.want)
+		}
+	}
+}
+
+func TestRecursiveResolver_CNAMELoop(t *testing.T) {
+	rsv_ := NewRecursiveResolver([]string{"127.0.0.1"}, false, &CacheOptions{cacheType: CacheTypeInternal}, nil)
+	var longChain_ []string
+	for i := 0; i <= RecursiveMaxCNAMEChain; i++ {
+		longChain_ = append(longChain_, fmt.Sprintf("a%d.example.test. 300 IN CNAME a%d.example.test.", i, i+1))
+	}
+	for name, records := range map[string][]string{
+		"loop": {
+			"a0.example.test. 300 IN CNAME b.example.test.",
+			"b.example.test. 300 IN CNAME a0.example.test.",
+		},
+		"long chain": longChain_,
+	} {
+		msgReq_ := new(dns.Msg)
+		msgReq_.SetQuestion("a0.example.test.", dns.TypeA)
+		msgRsp_ := new(dns.Msg)
+		msgRsp_.SetReply(msgReq_)
+		msgRsp_.Answer = mustRRs(t, records...)
+		done_ := make(chan *dns.Msg, 1)
+		go func() {
+			rsp_, _ := rsv_.followCNAME(msgRsp_, "a0.example.test.", dns.TypeA, nil, nil, 0)
+			done_ <- rsp_
+		}()
+		select {
+		case rsp_ := <-done_:
+			if rsp_ == nil || rsp_.Rcode != dns.RcodeServerFailure {
+				t.Errorf("%s: answer = %v, want SERVFAIL", name, rsp_)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: following cname chain does not end", name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/miekg/dns"
 	"math"
+	"time"
 )
 
 type DohDnsMsgResolverQ struct {
@@ -24,6 +25,30 @@ type DnsMsgResolverRsp struct {
 	UnixTSOfArrival_   int64
 }
 
+// NewDnsMsgResolverRsp creates resolver response from upstream's reply message.
+func NewDnsMsgResolverRsp(msgRsp *dns.Msg) (rsp *DnsMsgResolverRsp) {
+	rsp = &DnsMsgResolverRsp{
+		Status:             msgRsp.Rcode,
+		Truncated:          msgRsp.Truncated,
+		RecursionDesired:   msgRsp.RecursionDesired,
+		RecursionAvailable: msgRsp.RecursionAvailable,
+		AuthenticData:      msgRsp.AuthenticatedData,
+		CheckingDisabled:   msgRsp.CheckingDisabled,
+	}
+	rsp.Question = make([]DohDnsMsgResolverQ, len(msgRsp.Question))
+	for i, q := range msgRsp.Question {
+		rsp.Question[i] = DohDnsMsgResolverQ{
+			Name: q.Name,
+			Type: q.Qtype,
+		}
+	}
+	rsp.Answer = msgRsp.Answer
+	rsp.Authority = msgRsp.Ns
+	rsp.Additional = msgRsp.Extra
+	rsp.UnixTSOfArrival_ = time.Now().Unix()
+	return
+}
+
 func (rsp *DnsMsgResolverRsp) StatusV() int {
 	return rsp.Status
 }
@@ -52,6 +77,15 @@ func (rsp *DnsMsgResolverRsp) ExtraV() (extra []dns.RR) {
 	return rsp.Additional
 }
 
+func (rsp *DnsMsgResolverRsp) OptV() (opt *dns.OPT) {
+	for _, r_ := range rsp.Additional {
+		if opt_, ok := r_.(*dns.OPT); ok {
+			return opt_
+		}
+	}
+	return
+}
+
 func (rsp *DnsMsgResolverRsp) UnixTSOfArrival() int64 {
 	return rsp.UnixTSOfArrival_
 }
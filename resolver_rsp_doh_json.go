@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"github.com/miekg/dns"
 	"math"
+	"strings"
 )
 
 type DohJsonResolverQ struct {
@@ -30,7 +32,51 @@ type DohJsonResolverRsp struct {
 	Additional         []DohJsonResolverRR `json:"Additional,omitempty"`
 	EDNSClientSubnet   string              `json:"edns_client_subnet,omitempty"`
 	Comment            string              `json:"Comment,omitempty"`
-	UnixTSOfArrival_   int64
+	UnixTSOfArrival_   int64               `json:"-"`
+	// Records parsed once by parseRRs, so that they are not parsed again on every use.
+	rrsParsed bool
+	answerRRs []dns.RR
+	nsRRs     []dns.RR
+	extraRRs  []dns.RR
+}
+
+// NewDohJsonResolverRspFromMsg transforms a dns message to json format, which is served to json api clients.
+func NewDohJsonResolverRspFromMsg(msg *dns.Msg) (rsp *DohJsonResolverRsp) {
+	rsp = &DohJsonResolverRsp{
+		Status:             msg.Rcode,
+		Truncated:          msg.Truncated,
+		RecursionDesired:   msg.RecursionDesired,
+		RecursionAvailable: msg.RecursionAvailable,
+		AuthenticData:      msg.AuthenticatedData,
+		CheckingDisabled:   msg.CheckingDisabled,
+		Answer:             rrsToJsonRRs(msg.Answer),
+		Authority:          rrsToJsonRRs(msg.Ns),
+		Additional:         rrsToJsonRRs(msg.Extra),
+	}
+	for _, q := range msg.Question {
+		rsp.Question = append(rsp.Question, DohJsonResolverQ{Name: q.Name, Type: q.Qtype})
+	}
+	if ecs_ := ObtainECS(msg); ecs_ != nil {
+		rsp.EDNSClientSubnet = fmt.Sprintf("%s/%d/%d", ecs_.Address, ecs_.SourceNetmask, ecs_.SourceScope)
+	}
+	return
+}
+
+// rrsToJsonRRs transforms records to json format, OPT pseudo records are left out.
+func rrsToJsonRRs(rrs []dns.RR) (jsonRRs []DohJsonResolverRR) {
+	for _, rr := range rrs {
+		hdr_ := rr.Header()
+		if hdr_.Rrtype == dns.TypeOPT {
+			continue
+		}
+		jsonRRs = append(jsonRRs, DohJsonResolverRR{
+			Name: hdr_.Name,
+			Type: hdr_.Rrtype,
+			TTL:  hdr_.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr_.String()),
+		})
+	}
+	return
 }
 
 func (rsp *DohJsonResolverRsp) StatusV() int {
@@ -49,40 +95,61 @@ func (rsp *DohJsonResolverRsp) AuthenticDataV() bool {
 	return rsp.AuthenticData
 }
 
-func (rsp *DohJsonResolverRsp) AnswerV() (answer []dns.RR) {
-	for _, r_ := range rsp.Answer {
-		rr, err := r_.RR()
-		if err != nil {
-			log.Warnf("Failed to parse RR: %s", err)
-			return nil
-		}
-		answer = append(answer, rr)
+// parseRRs parses records in json format once, before rsp is shared.
+func (rsp *DohJsonResolverRsp) parseRRs() {
+	rsp.answerRRs = jsonRRsToRRs(rsp.Answer)
+	rsp.nsRRs = jsonRRsToRRs(rsp.Authority)
+	rsp.extraRRs = jsonRRsToRRs(rsp.Additional)
+	rsp.rrsParsed = true
+}
+
+func (rsp *DohJsonResolverRsp) AnswerV() []dns.RR {
+	if rsp.rrsParsed {
+		return rsp.answerRRs
 	}
-	return
+	return jsonRRsToRRs(rsp.Answer)
 }
 
-func (rsp *DohJsonResolverRsp) NsV() (ns []dns.RR) {
-	ns = make([]dns.RR, len(rsp.Authority))
-	for i_, r_ := range rsp.Authority {
-		rr, err := r_.RR()
-		if err != nil {
-			log.Warnf("Failed to parse RR: %s", err)
-			return nil
-		}
-		ns[i_] = rr
+func (rsp *DohJsonResolverRsp) NsV() []dns.RR {
+	if rsp.rrsParsed {
+		return rsp.nsRRs
 	}
-	return
+	return jsonRRsToRRs(rsp.Authority)
+}
+
+func (rsp *DohJsonResolverRsp) ExtraV() []dns.RR {
+	if rsp.rrsParsed {
+		return rsp.extraRRs
+	}
+	return jsonRRsToRRs(rsp.Additional)
 }
 
-func (rsp *DohJsonResolverRsp) ExtraV() (extra []dns.RR) {
-	extra = make([]dns.RR, len(rsp.Additional))
-	for i_, r_ := range rsp.Additional {
+// OptV returns an OPT record carrying the ECS returned in edns_client_subnet, other EDNS0 options
+// are not transferred in json format.
+func (rsp *DohJsonResolverRsp) OptV() *dns.OPT {
+	if rsp.EDNSClientSubnet == "" {
+		return nil
+	}
+	ecs_, err := ParseJsonECS(rsp.EDNSClientSubnet)
+	if err != nil {
+		log.Warnf("Failed to parse edns_client_subnet: %s", err)
+		return nil
+	}
+	opt_ := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt_.SetUDPSize(DefaultReplyUDPSize)
+	opt_.Option = append(opt_.Option, ecs_)
+	return opt_
+}
+
+// jsonRRsToRRs transforms records in json format, records failed to parse are skipped.
+func jsonRRsToRRs(jsonRRs []DohJsonResolverRR) (rrs []dns.RR) {
+	for _, r_ := range jsonRRs {
 		rr, err := r_.RR()
 		if err != nil {
 			log.Warnf("Failed to parse RR: %s", err)
-			return nil
+			continue
 		}
-		extra[i_] = rr
+		rrs = append(rrs, rr)
 	}
 	return
 }
@@ -106,9 +173,23 @@ func (rsp *DohJsonResolverRsp) ObtainMinimalTTL() (ttl uint32) {
 	return
 }
 
-// RR transforms a DohJsonResolverRR to a dns.RR
+// RR transforms a DohJsonResolverRR to a dns.RR, types unknown to dns package are in RFC 3597 generic
+// encoding, and data in RFC 3597 generic encoding is also accepted.
 func (r DohJsonResolverRR) RR() (dns.RR, error) {
-	hdr := dns.RR_Header{Name: r.Name, Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
+	hdr := dns.RR_Header{Name: dns.Fqdn(r.Name), Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
+	if _, ok := dns.TypeToRR[r.Type]; !ok || strings.HasPrefix(r.Data, `\# `) {
+		return dns.NewRR(fmt.Sprintf("%s %d IN TYPE%d %s", hdr.Name, r.TTL, r.Type, genericRData(r.Data)))
+	}
 	str := hdr.String() + r.Data
 	return dns.NewRR(str)
 }
+
+// genericRData returns the RFC 3597 generic form of data, data not already in that form is taken as
+// hex string, which some upstreams reply for unknown types.
+func genericRData(data string) string {
+	if strings.HasPrefix(data, `\# `) {
+		return data
+	}
+	hex_ := strings.Join(strings.Fields(data), "")
+	return fmt.Sprintf(`\# %d %s`, len(hex_)/2, hex_)
+}
@@ -12,6 +12,7 @@ type ResolverRsp interface {
 	AnswerV() []dns.RR
 	NsV() []dns.RR
 	ExtraV() []dns.RR
+	OptV() *dns.OPT
 	ObtainMinimalTTL() uint32
 	UnixTSOfArrival() int64
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DoTALPN is the ALPN protocol identifier of DNS-over-TLS (RFC 7858).
+	DoTALPN = "dot"
+	// DefaultDns53IdleTimeout is how long an idle dns53 tcp, tls or quic connection is kept open.
+	DefaultDns53IdleTimeout = 10 * time.Second
+	// CertReloadCheckInterval is how often certificate files are checked for changes during handshakes.
+	CertReloadCheckInterval = 10 * time.Second
+)
+
+// NewServerTLSConfig loads the certificate and key for a listener, they are reloaded once the files change.
+// Session tickets are left enabled, so clients are able to resume TLS sessions, and ticket keys are rotated by
+// crypto/tls.
+func NewServerTLSConfig(certFile, keyFile string, nextProtos ...string) (tlsConfig *tls.Config, err error) {
+	reloader_, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	tlsConfig = &tls.Config{
+		GetCertificate: reloader_.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+	}
+	return
+}
+
+// CertReloader serves certificate loaded from files, and reloads it when either file is modified, so renewed
+// certificates are picked up without restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	// fileWatcher checks files on handshakes.
+	fileWatcher
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func NewCertReloader(certFile, keyFile string) (r *CertReloader, err error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls cert file and key file must be specified")
+	}
+	r = &CertReloader{certFile: certFile, keyFile: keyFile,
+		fileWatcher: fileWatcher{files: []string{certFile, keyFile}, CheckInterval: CertReloadCheckInterval}}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload loads certificate from files, the current one is kept if loading fails.
+func (r *CertReloader) Reload() error {
+	if err := r.load(func() error {
+		cert_, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.cert = &cert_
+		r.mu.Unlock()
+		return nil
+	}); err != nil {
+		return fmt.Errorf("load tls certificate error: %v", err)
+	}
+	return nil
+}
+
+// GetCertificate is for tls.Config, it reloads certificate first if files are modified.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r.modified() {
+		if err := r.Reload(); err != nil {
+			log.Errorf("tls certificate reloading error: %v", err)
+		} else {
+			log.Infof("tls certificate reloaded from %s", r.certFile)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDns53TLSServer(t *testing.T) {
+	pki_ := newTestPKI(t)
+	dohSrv_ := newFakeDohUpstream(t, fakeAnswer)
+	Dns53Answerer = NewDnsMsgAnswerer(NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, nil), nil, nil)
+
+	tlsConfig_, err := NewServerTLSConfig(pki_.serverCertFile, pki_.serverKeyFile, DoTALPN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ := newDns53TLSServer("127.0.0.1:0", tlsConfig_)
+	server_.Handler = dns.HandlerFunc(NewDns53Handler().ServeDNS)
+	started_ := make(chan struct{})
+	server_.NotifyStartedFunc = func() { close(started_) }
+	go func() { _ = server_.ListenAndServe() }()
+	<-started_
+	t.Cleanup(func() { _ = server_.Shutdown() })
+	addr_ := server_.Listener.Addr().String()
+
+	clientConfig_ := &tls.Config{
+		RootCAs:            pki_.caPool,
+		NextProtos:         []string{DoTALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	exchangePipelined_ := func() (state tls.ConnectionState) {
+		tlsConn_, err := tls.Dial("tcp", addr_, clientConfig_)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = tlsConn_.Close() }()
+		conn_ := &dns.Conn{Conn: tlsConn_}
+		names_ := map[uint16]string{}
+		// Send all queries before reading any reply.
+		for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			names_[msgReq_.Id] = name
+			if err = conn_.WriteMsg(msgReq_); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for range names_ {
+			msgRsp_, err := conn_.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgRsp_.Question[0].Name != names_[msgRsp_.Id] {
+				t.Errorf("reply %d to %s, want %s", msgRsp_.Id, msgRsp_.Question[0].Name, names_[msgRsp_.Id])
+			}
+			if len(msgRsp_.Answer) != 1 {
+				t.Errorf("answer of %s = %v, want one A record", msgRsp_.Question[0].Name, msgRsp_.Answer)
+			}
+		}
+		return tlsConn_.ConnectionState()
+	}
+
+	state_ := exchangePipelined_()
+	if state_.NegotiatedProtocol != DoTALPN {
+		t.Errorf("negotiated protocol = %q, want %q", state_.NegotiatedProtocol, DoTALPN)
+	}
+	if state_ = exchangePipelined_(); !state_.DidResume {
+		t.Error("tls session not resumed")
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	if _, err := NewServerTLSConfig("", ""); err == nil {
+		t.Error("expected error without cert and key files")
+	}
+	if _, err := NewServerTLSConfig("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Error("expected error with nonexistent cert and key files")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	pki1_, pki2_ := newTestPKI(t), newTestPKI(t)
+	dir_ := t.TempDir()
+	certFile_, keyFile_ := filepath.Join(dir_, "cert.pem"), filepath.Join(dir_, "key.pem")
+	install_ := func(pki *testPKI, modTime time.Time) {
+		for src, dst := range map[string]string{pki.serverCertFile: certFile_, pki.serverKeyFile: keyFile_} {
+			buf_, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(dst, buf_, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Chtimes(dst, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	leafOf_ := func(r *CertReloader) []byte {
+		cert_, err := r.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert_.Certificate[0]
+	}
+
+	install_(pki1_, time.Now().Add(-time.Hour))
+	reloader_, err := NewCertReloader(certFile_, keyFile_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader_.CheckInterval = 0
+	if !bytes.Equal(leafOf_(reloader_), pki1_.serverCert.Certificate[0]) {
+		t.Fatal("certificate not loaded from files")
+	}
+
+	install_(pki2_, time.Now())
+	if !bytes.Equal(leafOf_(reloader_), pki2_.serverCert.Certificate[0]) {
+		t.Fatal("certificate not reloaded after files modified")
+	}
+
+	// Broken files keep the current certificate.
+	if err = os.WriteFile(keyFile_, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(keyFile_, time.Now().Add(time.Hour), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leafOf_(reloader_), pki2_.serverCert.Certificate[0]) {
+		t.Fatal("certificate changed after loading broken files")
+	}
+}
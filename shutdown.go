@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeout = 10 * time.Second
+)
+
+// Exit codes of the process.
+const (
+	ExitCodeOK = 0
+	// ExitCodeServiceError is returned when services exit on errors rather than signals.
+	ExitCodeServiceError = 1
+	// ExitCodeShutdownError is returned when servers are not drained before the deadline, or on a second signal.
+	ExitCodeShutdownError = 2
+)
+
+// Shutdowns holds what to stop on graceful shutdown of the process.
+var Shutdowns = &ShutdownHooks{}
+
+type shutdownHook struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// ShutdownHooks stops servers first, so that queries in flight are answered, then releases resources like
+// upstream connections and caches.
+type ShutdownHooks struct {
+	mu       sync.Mutex
+	servers  []shutdownHook
+	releases []shutdownHook
+}
+
+// OnShutdown registers f to stop server name, f should stop accepting and wait for queries in flight until
+// ctx is done.
+func (h *ShutdownHooks) OnShutdown(name string, f func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.servers = append(h.servers, shutdownHook{name: name, f: f})
+}
+
+// OnRelease registers f to release resource name once servers are stopped.
+func (h *ShutdownHooks) OnRelease(name string, f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releases = append(h.releases, shutdownHook{name: name, f: func(context.Context) error {
+		f()
+		return nil
+	}})
+}
+
+// Shutdown stops servers concurrently and releases resources after, errors are returned together.
+func (h *ShutdownHooks) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	servers_, releases_ := h.servers, h.releases
+	h.servers, h.releases = nil, nil
+	h.mu.Unlock()
+
+	errs_ := runShutdownHooks(ctx, servers_)
+	errs_ = append(errs_, runShutdownHooks(ctx, releases_)...)
+	if len(errs_) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs_, "; "))
+	}
+	return nil
+}
+
+func runShutdownHooks(ctx context.Context, hooks []shutdownHook) (errs []string) {
+	var mu_ sync.Mutex
+	var wg_ sync.WaitGroup
+	for _, hook := range hooks {
+		wg_.Add(1)
+		go func(hook shutdownHook) {
+			defer wg_.Done()
+			if err := hook.f(ctx); err != nil {
+				mu_.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", hook.name, err))
+				mu_.Unlock()
+				return
+			}
+			log.Debugf("%s stopped", hook.name)
+		}(hook)
+	}
+	wg_.Wait()
+	return
+}
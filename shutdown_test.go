@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	hooks_ := &ShutdownHooks{}
+	var mu_ sync.Mutex
+	var stopped_ []string
+	record_ := func(name string) {
+		mu_.Lock()
+		defer mu_.Unlock()
+		stopped_ = append(stopped_, name)
+	}
+	hooks_.OnRelease("cache", func() { record_("cache") })
+	hooks_.OnShutdown("udp", func(context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		record_("udp")
+		return nil
+	})
+	hooks_.OnShutdown("tcp", func(ctx context.Context) error {
+		// Queries in flight are not answered before the deadline.
+		<-ctx.Done()
+		record_("tcp")
+		return ctx.Err()
+	})
+
+	ctx_, cancel_ := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel_()
+	err := hooks_.Shutdown(ctx_)
+	if err == nil || !strings.Contains(err.Error(), "tcp: "+context.DeadlineExceeded.Error()) {
+		t.Fatalf("shutdown error = %v", err)
+	}
+	if len(stopped_) != 3 || stopped_[2] != "cache" {
+		t.Fatalf("stopped in order %v, want resources released after servers", stopped_)
+	}
+	// Hooks run once.
+	if err = hooks_.Shutdown(context.Background()); err != nil || len(stopped_) != 3 {
+		t.Fatalf("second shutdown: %v, %v", err, stopped_)
+	}
+}
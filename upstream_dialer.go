@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	UpstreamProxySchemeSocks5  = "socks5"
+	UpstreamProxySchemeSocks5h = "socks5h"
+	UpstreamProxySchemeHttp    = "http"
+)
+
+// UpstreamOptions holds the options used when connecting to upstream endpoints.
+type UpstreamOptions struct {
+	proxyURL  string
+	tlsConfig *UpstreamTLSConfigModel
+}
+
+func NewUpstreamOptions(proxyURL string, tlsConfig *UpstreamTLSConfigModel) (options *UpstreamOptions) {
+	return &UpstreamOptions{
+		proxyURL:  strings.TrimSpace(proxyURL),
+		tlsConfig: tlsConfig,
+	}
+}
+
+// TLSConfig builds the tls config for upstream connections.
+func (options *UpstreamOptions) TLSConfig() (*tls.Config, error) {
+	if options == nil {
+		return NewUpstreamTLSConfig(nil)
+	}
+	return NewUpstreamTLSConfig(options.tlsConfig)
+}
+
+type DialContextFun func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewUpstreamNetDialer returns the dialer for direct upstream connections, resolving upstream
+// host names with upstream_host_resolver if configured.
+func NewUpstreamNetDialer() (dialer *net.Dialer) {
+	dialer = &net.Dialer{}
+	if ExecConfig.UpstreamHostResolver == "" {
+		return
+	}
+	url_, err := url.Parse(strings.TrimSpace(ExecConfig.UpstreamHostResolver))
+	if err != nil || !ListenAddrPortAvailable(url_.Host) {
+		return
+	}
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Duration(5000) * time.Millisecond,
+			}
+			return d.DialContext(ctx, url_.Scheme, url_.Host)
+		},
+	}
+	return
+}
+
+// NewUpstreamDialContext returns the dial function for upstream connections, going through
+// the proxy in options if there is one.
+func NewUpstreamDialContext(options *UpstreamOptions) (dialContext DialContextFun, err error) {
+	forward_ := NewUpstreamNetDialer()
+	if options == nil || strings.TrimSpace(options.proxyURL) == "" {
+		return forward_.DialContext, nil
+	}
+	proxyURL_, err := url.Parse(strings.TrimSpace(options.proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy invalid: %v", err)
+	}
+	if proxyURL_.Host == "" {
+		return nil, fmt.Errorf("upstream proxy invalid, missing host: %s", options.proxyURL)
+	}
+	switch strings.ToLower(proxyURL_.Scheme) {
+	case UpstreamProxySchemeSocks5, UpstreamProxySchemeSocks5h:
+		if proxyURL_.Port() == "" {
+			proxyURL_.Host = net.JoinHostPort(proxyURL_.Hostname(), "1080")
+		}
+		dialer_, err := proxy.FromURL(proxyURL_, forward_)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy invalid: %v", err)
+		}
+		contextDialer_, ok := dialer_.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("upstream proxy dialer does not support context: %s", proxyURL_.Redacted())
+		}
+		return contextDialer_.DialContext, nil
+	case UpstreamProxySchemeHttp:
+		if proxyURL_.Port() == "" {
+			proxyURL_.Host = net.JoinHostPort(proxyURL_.Hostname(), "80")
+		}
+		dialer_ := &HttpConnectDialer{proxyURL: proxyURL_, forward: forward_}
+		return dialer_.DialContext, nil
+	default:
+		return nil, fmt.Errorf("upstream proxy scheme not supported: %s", proxyURL_.Scheme)
+	}
+}
+
+// HttpConnectDialer dials through an HTTP proxy with the CONNECT method.
+type HttpConnectDialer struct {
+	proxyURL *url.URL
+	forward  *net.Dialer
+}
+
+func (d *HttpConnectDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("network not supported by http proxy: %s", network)
+	}
+	conn_, err := d.forward.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = conn_.Close()
+		}
+	}()
+	if deadline_, ok := ctx.Deadline(); ok {
+		if err = conn_.SetDeadline(deadline_); err != nil {
+			return nil, err
+		}
+		defer func() { _ = conn_.SetDeadline(time.Time{}) }()
+	}
+
+	connectReq_ := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user_ := d.proxyURL.User; user_ != nil {
+		password_, _ := user_.Password()
+		credential_ := base64.StdEncoding.EncodeToString([]byte(user_.Username() + ":" + password_))
+		connectReq_.Header.Set("Proxy-Authorization", "Basic "+credential_)
+	}
+	if err = connectReq_.Write(conn_); err != nil {
+		return nil, err
+	}
+	reader_ := bufio.NewReader(conn_)
+	connectRsp_, err := http.ReadResponse(reader_, connectReq_)
+	if err != nil {
+		return nil, err
+	}
+	_ = connectRsp_.Body.Close()
+	if connectRsp_.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http proxy %s refused CONNECT to %s: %s", d.proxyURL.Host, addr, connectRsp_.Status)
+		return nil, err
+	}
+	if reader_.Buffered() > 0 {
+		return &bufferedConn{Conn: conn_, reader: reader_}, nil
+	}
+	return conn_, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
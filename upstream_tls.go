@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewUpstreamTLSConfig builds the tls config for upstream connections, nil model means default settings.
+func NewUpstreamTLSConfig(conf *UpstreamTLSConfigModel) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf == nil {
+		return
+	}
+	tlsConfig.ServerName = strings.TrimSpace(conf.ServerName)
+
+	if v_ := strings.TrimSpace(conf.MinVersion); v_ != "" {
+		minVersion_, ok := tlsVersions[v_]
+		if !ok {
+			return nil, fmt.Errorf("upstream tls min_version invalid: %s", conf.MinVersion)
+		}
+		tlsConfig.MinVersion = minVersion_
+	}
+
+	if conf.CAFile != "" {
+		caPEM_, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream tls ca_file error: %v", err)
+		}
+		rootCAs_ := x509.NewCertPool()
+		if !rootCAs_.AppendCertsFromPEM(caPEM_) {
+			return nil, fmt.Errorf("no certificate found in upstream tls ca_file: %s", conf.CAFile)
+		}
+		tlsConfig.RootCAs = rootCAs_
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, fmt.Errorf("upstream tls cert_file and key_file should be specified together")
+		}
+		cert_, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream tls client certificate error: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert_}
+	}
+
+	if len(conf.SPKIPins) > 0 {
+		pins_ := make([][]byte, 0, len(conf.SPKIPins))
+		for _, p := range conf.SPKIPins {
+			pin_, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(p), "sha256/"))
+			if err != nil || len(pin_) != sha256.Size {
+				return nil, fmt.Errorf("upstream tls spki pin invalid: %s", p)
+			}
+			pins_ = append(pins_, pin_)
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs.PeerCertificates, pins_)
+		}
+	}
+	return
+}
+
+// verifySPKIPins checks that any certificate in the chain matches any of the SPKI SHA-256 pins.
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		digest_ := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if string(digest_[:]) == string(pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate matches the spki pins")
+}
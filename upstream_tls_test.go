@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testPKI struct {
+	caFile         string
+	caPool         *x509.CertPool
+	serverCert     tls.Certificate
+	serverSPKIPin  string
+	serverCertFile string
+	serverKeyFile  string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+// newTestPKI creates a CA, a server certificate for 127.0.0.1 and a client certificate.
+func newTestPKI(t *testing.T) (pki *testPKI) {
+	dir_ := t.TempDir()
+	writePEM_ := func(name, typ string, der []byte) string {
+		path_ := filepath.Join(dir_, name)
+		if err := os.WriteFile(path_, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path_
+	}
+	newKey_ := func() *ecdsa.PrivateKey {
+		key_, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key_
+	}
+
+	caKey_ := newKey_()
+	caTmpl_ := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "doh-relay test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer_, err := x509.CreateCertificate(rand.Reader, caTmpl_, caTmpl_, &caKey_.PublicKey, caKey_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert_, _ := x509.ParseCertificate(caDer_)
+	pki = &testPKI{caFile: writePEM_("ca.pem", "CERTIFICATE", caDer_), caPool: x509.NewCertPool()}
+	pki.caPool.AddCert(caCert_)
+
+	issue_ := func(serial int64, extKeyUsage x509.ExtKeyUsage) (der []byte, key *ecdsa.PrivateKey) {
+		key = newKey_()
+		tmpl_ := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{extKeyUsage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl_, caCert_, &key.PublicKey, caKey_)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	serverDer_, serverKey_ := issue_(2, x509.ExtKeyUsageServerAuth)
+	pki.serverCert = tls.Certificate{Certificate: [][]byte{serverDer_}, PrivateKey: serverKey_}
+	serverCert_, _ := x509.ParseCertificate(serverDer_)
+	digest_ := sha256.Sum256(serverCert_.RawSubjectPublicKeyInfo)
+	pki.serverSPKIPin = base64.StdEncoding.EncodeToString(digest_[:])
+	serverKeyDer_, err := x509.MarshalECPrivateKey(serverKey_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.serverCertFile = writePEM_("server.pem", "CERTIFICATE", serverDer_)
+	pki.serverKeyFile = writePEM_("server-key.pem", "EC PRIVATE KEY", serverKeyDer_)
+
+	clientDer_, clientKey_ := issue_(3, x509.ExtKeyUsageClientAuth)
+	clientKeyDer_, err := x509.MarshalECPrivateKey(clientKey_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.clientCertFile = writePEM_("client.pem", "CERTIFICATE", clientDer_)
+	pki.clientKeyFile = writePEM_("client-key.pem", "EC PRIVATE KEY", clientKeyDer_)
+	return
+}
+
+// serverTLSConfig requires clients to present certificates issued by the test CA.
+func (pki *testPKI) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.caPool,
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	pki_ := newTestPKI(t)
+	dohSrv_ := httptest.NewUnstartedServer(fakeDohHandler(fakeAnswer))
+	dohSrv_.TLS = pki_.serverTLSConfig()
+	dohSrv_.StartTLS()
+	defer dohSrv_.Close()
+
+	wrongPin_ := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		name    string
+		conf    *UpstreamTLSConfigModel
+		wantErr bool
+	}{
+		{
+			name:    "untrusted ca",
+			conf:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "missing client certificate",
+			conf:    &UpstreamTLSConfigModel{CAFile: pki_.caFile},
+			wantErr: true,
+		},
+		{
+			name: "mutual tls",
+			conf: &UpstreamTLSConfigModel{CAFile: pki_.caFile, CertFile: pki_.clientCertFile,
+				KeyFile: pki_.clientKeyFile, MinVersion: "1.3"},
+		},
+		{
+			name: "spki pin matched",
+			conf: &UpstreamTLSConfigModel{CAFile: pki_.caFile, CertFile: pki_.clientCertFile,
+				KeyFile: pki_.clientKeyFile, SPKIPins: []string{wrongPin_, "sha256/" + pki_.serverSPKIPin}},
+		},
+		{
+			name: "spki pin mismatched",
+			conf: &UpstreamTLSConfigModel{CAFile: pki_.caFile, CertFile: pki_.clientCertFile,
+				KeyFile: pki_.clientKeyFile, SPKIPins: []string{wrongPin_}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options_ := NewUpstreamOptions("", tt.conf)
+			cacheOptions_ := &CacheOptions{cacheType: CacheTypeInternal}
+			resolvers_ := map[string]Resolver{
+				"doh":      NewDohDnsMsgResolver([]string{dohSrv_.URL + "/dns-query"}, false, cacheOptions_, options_),
+				"doh_json": NewDohJsonResolver([]string{dohSrv_.URL + "/resolve"}, false, cacheOptions_, options_),
+			}
+			for proto, rsv := range resolvers_ {
+				_, err := rsv.Resolve("example.com", dns.TypeA, nil, nil)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("%s Resolve() error = %v, wantErr %v", proto, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSDns53(t *testing.T) {
+	pki_ := newTestPKI(t)
+	listener_, err := tls.Listen("tcp", "127.0.0.1:0", pki_.serverTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_ := &dns.Server{
+		Listener: listener_,
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msgReq *dns.Msg) {
+			_ = w.WriteMsg(fakeAnswer(msgReq))
+		}),
+	}
+	go func() { _ = server_.ActivateAndServe() }()
+	defer func() { _ = server_.Shutdown() }()
+
+	options_ := NewUpstreamOptions("", &UpstreamTLSConfigModel{CAFile: pki_.caFile, CertFile: pki_.clientCertFile,
+		KeyFile: pki_.clientKeyFile, SPKIPins: []string{pki_.serverSPKIPin}})
+	rsv_ := NewDns53DnsMsgResolver([]string{"tls://" + listener_.Addr().String()}, false,
+		&CacheOptions{cacheType: CacheTypeInternal}, options_)
+	rsp_, err := rsv_.Resolve("example.com", dns.TypeA, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip_ := GetIPAnswerFromResolverRsp(rsp_); ip_ != "192.0.2.1" {
+		t.Errorf("answer = %q, want 192.0.2.1", ip_)
+	}
+}
+
+func TestUpstreamTLSDns53_HandshakeTimeout(t *testing.T) {
+	// Upstream accepting connections but never answering handshakes.
+	listener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener_.Close() }()
+	go func() {
+		for {
+			conn_, err := listener_.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn_.Close() }()
+		}
+	}()
+
+	chErr_ := make(chan interface{}, 1)
+	go func() {
+		defer func() { chErr_ <- recover() }()
+		NewDns53DnsMsgResolver([]string{"tls://" + listener_.Addr().String()}, false, nil, nil).Close()
+	}()
+	select {
+	case err_ := <-chErr_:
+		if err_ == nil {
+			t.Error("resolver of upstream never answering handshakes created")
+		}
+	case <-time.After(Dns53TLSHandshakeTimeout + 2*time.Second):
+		t.Fatal("handshake with upstream not timed out")
+	}
+}
+
+func TestNewUpstreamTLSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *UpstreamTLSConfigModel
+		wantErr bool
+	}{
+		{name: "default", conf: nil},
+		{name: "server name and min version", conf: &UpstreamTLSConfigModel{ServerName: "dns.example", MinVersion: "1.3"}},
+		{name: "invalid min version", conf: &UpstreamTLSConfigModel{MinVersion: "2.0"}, wantErr: true},
+		{name: "missing ca file", conf: &UpstreamTLSConfigModel{CAFile: "/nonexistent/ca.pem"}, wantErr: true},
+		{name: "cert without key", conf: &UpstreamTLSConfigModel{CertFile: "/path/to/cert.pem"}, wantErr: true},
+		{name: "invalid pin", conf: &UpstreamTLSConfigModel{SPKIPins: []string{"not-a-pin"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewUpstreamTLSConfig(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewUpstreamTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
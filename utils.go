@@ -19,6 +19,18 @@ import (
 	"github.com/miekg/dns"
 )
 
+const (
+	MimeTypeDnsMsg  = "application/dns-message"
+	MimeTypeDnsJson = "application/dns-json"
+	MimeTypeJson    = "application/json"
+	MimeTypeODoHMsg = "application/oblivious-dns-message"
+)
+
+const (
+	ECSIPv4Mask = 24
+	ECSIPv6Mask = 56
+)
+
 func SliceContains[T string | int | uint | int8 | int16 | int32 | int64 | uint8 | uint16 | uint32 | uint64 |
 	float32 | float64](s []T, e T) bool {
 
@@ -35,6 +47,17 @@ func ConcatSlices[T any](first []T, second []T) []T {
 	return append(first[:n:n], second...)
 }
 
+// FirstNonZero returns the first value which is not the zero value of its type.
+func FirstNonZero[T comparable](values ...T) (v T) {
+	var zero_ T
+	for _, v = range values {
+		if v != zero_ {
+			return
+		}
+	}
+	return zero_
+}
+
 func RemoveSliceDuplicate[T comparable](sliceList []T) (list []T) {
 	allKeys_ := make(map[T]bool)
 	defer func() { allKeys_ = nil }()
@@ -70,6 +93,34 @@ func ListenAddrPortAvailable(addrPort string) bool {
 	return false
 }
 
+// ParseIPNets parses ips and CIDRs, ips are taken as single address networks.
+func ParseIPNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip_ := net.ParseIP(s)
+			if ip_ == nil {
+				return nil, fmt.Errorf("ip or CIDR invalid: %s", s)
+			}
+			bits_ := 8 * net.IPv6len
+			if ip4_ := ip_.To4(); ip4_ != nil {
+				ip_, bits_ = ip4_, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip_, Mask: net.CIDRMask(bits_, bits_)})
+			continue
+		}
+		_, net_, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("ip or CIDR invalid: %s", s)
+		}
+		nets = append(nets, net_)
+	}
+	return
+}
+
 func ObtainIPFromString(ipStr string) net.IP {
 	trimmedIPStr_ := strings.TrimSpace(ipStr)
 	if ip, _, err := net.ParseCIDR(trimmedIPStr_); err == nil {
@@ -114,24 +165,24 @@ func AdjustDnsMsgTtl(msg *dns.Msg, unixTSOfArrival int64) {
 	}
 }
 
-func CommonResolverQuery(rsv Resolver, qName string, qType uint16, ecsIPsStr string) (
+func CommonResolverQuery(rsv Resolver, qName string, qType uint16, ecsIPsStr string, opts *QueryOptions) (
 	rsp ResolverRsp, err error) {
 
-	cacheKey_ := fmt.Sprintf("NAME[%s]TYPE[%d]", qName, qType)
+	cacheKey_ := fmt.Sprintf("NAME[%s]TYPE[%d]%s", qName, qType, opts.CacheKey())
 
 	var (
-		ips_             []net.IP
+		ecs_             []*net.IPNet
 		countryCodes_    []string
 		countryStateArr_ []string
 	)
 	ecsIPStrArr_ := strings.Split(ecsIPsStr, ",")
 	for _, s := range ecsIPStrArr_ {
-		if ip_ := ObtainIPFromString(s); ip_ != nil {
-			country_, state_, _ := GeoIPCountryStateCity(ip_)
+		if subnet_ := ObtainECSFromString(s); subnet_ != nil {
+			country_, state_, _ := GeoIPCountryStateCity(subnet_.IP)
 			if SliceContains(countryCodes_, country_) {
 				continue
 			}
-			ips_ = append(ips_, ip_)
+			ecs_ = append(ecs_, subnet_)
 			countryCodes_ = append(countryCodes_, country_)
 			countryStateArr_ = append(countryStateArr_, fmt.Sprintf("%s,%s", country_, state_))
 		}
@@ -148,22 +199,17 @@ func CommonResolverQuery(rsv Resolver, qName string, qType uint16, ecsIPsStr str
 	// Check names in jail of countries
 	for i := 0; i < len(countryCodes_); i++ {
 		if IsNameInJailOfCountry(qName, countryCodes_[i]) {
-			ips_ = append(ips_[:i], ips_[i+1:]...)
+			ecs_ = append(ecs_[:i], ecs_[i+1:]...)
 			countryCodes_ = append(countryCodes_[:i], countryCodes_[i+1:]...)
 		}
 	}
-	rsp, err = resolveWithECSIPs(rsv, qName, qType, ips_, countryCodes_)
+	rsp, err = resolveWithECSIPs(rsv, qName, qType, ecs_, countryCodes_, opts)
 	if rsv.IsUsingCache() {
 		if err != nil || rsp == nil {
 			log.Errorf("err: %v, reply: %v", err, rsp)
 		} else {
 			ttl_ := rsp.ObtainMinimalTTL()
-			if ttl_ > 1 {
-				cacheTtl := ttl_
-				// max cache ttl
-				if cacheTtl > 3600 {
-					cacheTtl = 3600
-				}
+			if cacheTtl := CacheTtlOfRsp(rsp); cacheTtl > 1 {
 				rsv.SetCache(cacheKey_,
 					&RspCacheItem{
 						ResolverResponse: rsp,
@@ -178,11 +224,40 @@ func CommonResolverQuery(rsv Resolver, qName string, qType uint16, ecsIPsStr str
 	return
 }
 
-func resolveWithECSIPs(rsv Resolver, qName string, qType uint16, ecsIPs []net.IP, ecsCountryCodes []string) (
-	rsp ResolverRsp, err error) {
+const (
+	MaxCacheTtl      = 3600
+	ServFailCacheTtl = 5
+)
+
+// CacheTtlOfRsp decides how long a response is cached according to its RCODE, negative answers are cached
+// no longer than SOA minimum (RFC 2308), server failures are cached shortly and other errors are not cached.
+func CacheTtlOfRsp(rsp ResolverRsp) (ttl uint32) {
+	switch rsp.StatusV() {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		ttl = rsp.ObtainMinimalTTL()
+		if len(rsp.AnswerV()) == 0 {
+			for _, rr := range rsp.NsV() {
+				if soa_, ok := rr.(*dns.SOA); ok && soa_.Minttl < ttl {
+					ttl = soa_.Minttl
+				}
+			}
+		}
+	case dns.RcodeServerFailure:
+		ttl = ServFailCacheTtl
+	default:
+		ttl = 0
+	}
+	if ttl > MaxCacheTtl {
+		ttl = MaxCacheTtl
+	}
+	return
+}
 
-	if len(ecsIPs) == 0 || (qType != dns.TypeA && qType != dns.TypeAAAA) {
-		return rsv.Resolve(qName, qType, nil)
+func resolveWithECSIPs(rsv Resolver, qName string, qType uint16, ecs []*net.IPNet, ecsCountryCodes []string,
+	opts *QueryOptions) (rsp ResolverRsp, err error) {
+
+	if len(ecs) == 0 || (qType != dns.TypeA && qType != dns.TypeAAAA) {
+		return rsv.Resolve(qName, qType, nil, opts)
 	}
 
 	type Result struct {
@@ -192,15 +267,15 @@ func resolveWithECSIPs(rsv Resolver, qName string, qType uint16, ecsIPs []net.IP
 	}
 
 	// Create a channel to receive the results of each goroutine.
-	resultChanArr_, resultChanArrClosed_ := make([]chan *Result, len(ecsIPs)), false
+	resultChanArr_, resultChanArrClosed_ := make([]chan *Result, len(ecs)), false
 	for i := range resultChanArr_ {
 		resultChanArr_[i] = make(chan *Result)
 	}
 
 	// Launch a goroutine for each IP address for A, AAAA query.
-	for i, ip := range ecsIPs {
-		go func(ip net.IP, countryCode string, resultChan chan *Result) {
-			r, err := rsv.Resolve(qName, qType, &ip)
+	for i, subnet := range ecs {
+		go func(subnet *net.IPNet, countryCode string, resultChan chan *Result) {
+			r, err := rsv.Resolve(qName, qType, subnet, opts)
 			if err == nil {
 				// Check if the response matches the expected country code.
 				switch qType {
@@ -238,12 +313,12 @@ func resolveWithECSIPs(rsv Resolver, qName string, qType uint16, ecsIPs []net.IP
 					resultChan <- &Result{Ok: false, Err: err}
 				}
 			}
-		}(ip, ecsCountryCodes[i], resultChanArr_[i])
+		}(subnet, ecsCountryCodes[i], resultChanArr_[i])
 	}
 
 	// Wait for all the results to come in.
 	var lastResult_ ResolverRsp
-	for i := 0; i < len(ecsIPs); i++ {
+	for i := 0; i < len(ecs); i++ {
 		r := <-resultChanArr_[i]
 		rsp, ok, err := r.Rsp, r.Ok, r.Err
 		lastResult_ = rsp
@@ -308,19 +383,20 @@ func RemoveECSInDnsMsg(msg *dns.Msg) {
 	}
 }
 
-func ChangeECSInDnsMsg(msg *dns.Msg, ip *net.IP) {
+// ChangeECSInDnsMsg sets ECS of msg to subnet, whose prefix length is the source prefix length.
+func ChangeECSInDnsMsg(msg *dns.Msg, subnet *net.IPNet) {
 	eDnsSubnetRec_ := new(dns.EDNS0_SUBNET)
 	eDnsSubnetRec_.Code = dns.EDNS0SUBNET
 	eDnsSubnetRec_.SourceScope = 0
 
-	if ip4_ := ip.To4(); ip4_ != nil {
+	prefix_, _ := subnet.Mask.Size()
+	eDnsSubnetRec_.SourceNetmask = uint8(prefix_)
+	if ip4_ := subnet.IP.To4(); ip4_ != nil {
 		eDnsSubnetRec_.Family = 1
 		eDnsSubnetRec_.Address = ip4_
-		eDnsSubnetRec_.SourceNetmask = 24 // ipv4 mask
 	} else {
 		eDnsSubnetRec_.Family = 2
-		eDnsSubnetRec_.Address = ip.To16()
-		eDnsSubnetRec_.SourceNetmask = 56 // ipv6 mask
+		eDnsSubnetRec_.Address = subnet.IP.To16()
 	}
 
 	recEdns0_ := msg.IsEdns0()
@@ -343,6 +419,76 @@ func ChangeECSInDnsMsg(msg *dns.Msg, ip *net.IP) {
 	}
 }
 
+// ECSSubnetOfIP returns the subnet of ip sent as EDNS-Client-Subnet.
+func ECSSubnetOfIP(ip net.IP) *net.IPNet {
+	if ip4_ := ip.To4(); ip4_ != nil {
+		mask_ := net.CIDRMask(ECSIPv4Mask, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4_.Mask(mask_), Mask: mask_}
+	}
+	mask_ := net.CIDRMask(ECSIPv6Mask, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.To16().Mask(mask_), Mask: mask_}
+}
+
+// ObtainECSFromString parses ECS of an ip, which is sent with the default prefix length, or of a subnet in CIDR
+// notation. Nil if invalid.
+func ObtainECSFromString(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if _, subnet_, err := net.ParseCIDR(s); err == nil {
+		return subnet_
+	}
+	if ip_ := net.ParseIP(s); ip_ != nil {
+		return ECSSubnetOfIP(ip_)
+	}
+	return nil
+}
+
+// SubnetOfECS returns the subnet of ECS option, of its source prefix length.
+func SubnetOfECS(ecs *dns.EDNS0_SUBNET) *net.IPNet {
+	bits_ := 8 * net.IPv6len
+	if ecs.Family == 1 {
+		bits_ = 8 * net.IPv4len
+	}
+	mask_ := net.CIDRMask(int(ecs.SourceNetmask), bits_)
+	if mask_ == nil {
+		return ECSSubnetOfIP(ecs.Address)
+	}
+	return &net.IPNet{IP: ecs.Address.Mask(mask_), Mask: mask_}
+}
+
+// ParseJsonECS parses edns_client_subnet in json format responses, which is like "192.0.2.0/24/0"
+// (address/source prefix/scope prefix) or "192.0.2.0/0" (address/scope prefix).
+func ParseJsonECS(s string) (ecs *dns.EDNS0_SUBNET, err error) {
+	parts_ := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts_) < 2 || len(parts_) > 3 {
+		return nil, fmt.Errorf("edns_client_subnet invalid: %s", s)
+	}
+	ip_ := net.ParseIP(parts_[0])
+	if ip_ == nil {
+		return nil, fmt.Errorf("edns_client_subnet address invalid: %s", s)
+	}
+	ecs = &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	maxPrefix_ := 8 * net.IPv6len
+	if ip4_ := ip_.To4(); ip4_ != nil {
+		ecs.Family, ecs.Address, maxPrefix_ = 1, ip4_, 8*net.IPv4len
+	} else {
+		ecs.Family, ecs.Address = 2, ip_.To16()
+	}
+	prefixes_ := make([]uint8, 0, 2)
+	for _, p := range parts_[1:] {
+		prefix_, err := strconv.Atoi(p)
+		if err != nil || prefix_ < 0 || prefix_ > maxPrefix_ {
+			return nil, fmt.Errorf("edns_client_subnet prefix invalid: %s", s)
+		}
+		prefixes_ = append(prefixes_, uint8(prefix_))
+	}
+	if len(prefixes_) == 2 {
+		ecs.SourceNetmask, ecs.SourceScope = prefixes_[0], prefixes_[1]
+	} else {
+		ecs.SourceNetmask, ecs.SourceScope = uint8(maxPrefix_), prefixes_[0]
+	}
+	return
+}
+
 type CheckIPApiRsp struct {
 	IP      string `json:"ip"`
 	Address string `json:"address"`
@@ -385,7 +531,7 @@ func GetExitIPByResolver(rsv Resolver) (ipStr string) {
 	for edp, typ := range checkIPEndpoints {
 		url_, _ := url.Parse(edp)
 		hostname_ := url_.Hostname()
-		rsvRspA_, errA_ := rsv.Resolve(hostname_, dns.TypeA, nil)
+		rsvRspA_, errA_ := rsv.Resolve(hostname_, dns.TypeA, nil, nil)
 		if errA_ != nil {
 			continue
 		}
@@ -395,7 +541,7 @@ func GetExitIPByResolver(rsv Resolver) (ipStr string) {
 			errAAAA_    error
 		)
 		if ExecConfig.IPv6Answer {
-			rsvRspAAAA_, errAAAA_ = rsv.Resolve(hostname_, dns.TypeAAAA, nil)
+			rsvRspAAAA_, errAAAA_ = rsv.Resolve(hostname_, dns.TypeAAAA, nil, nil)
 			if errAAAA_ != nil {
 				continue
 			}
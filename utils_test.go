@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
 
 func TestGetExIPByResolver(t *testing.T) {
 	type args struct {
@@ -13,13 +16,15 @@ func TestGetExIPByResolver(t *testing.T) {
 		{
 			"DNS53Resolver",
 			args{
-				rsv: NewDns53DnsMsgResolver([]string{"tcp://223.5.5.5:53"}, false, &CacheOptions{cacheType: CacheTypeInternal}),
+				rsv: NewDns53DnsMsgResolver([]string{"tcp://223.5.5.5:53"}, false,
+					&CacheOptions{cacheType: CacheTypeInternal}, nil),
 			},
 		},
 		{
 			"DohResolver",
 			args{
-				rsv: NewDohDnsMsgResolver([]string{"https://1.1.1.1/dns-query"}, false, &CacheOptions{cacheType: CacheTypeInternal}),
+				rsv: NewDohDnsMsgResolver([]string{"https://1.1.1.1/dns-query"}, false,
+					&CacheOptions{cacheType: CacheTypeInternal}, nil),
 			},
 		},
 	}
@@ -30,3 +35,24 @@ func TestGetExIPByResolver(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheTtlOfRsp(t *testing.T) {
+	tests := []string{"noerror.test.", "nxdomain.test.", "servfail.test.", "refused.test."}
+	want := map[string]uint32{
+		"noerror.test.":  300,
+		"nxdomain.test.": 60,
+		"servfail.test.": ServFailCacheTtl,
+		"refused.test.":  0,
+	}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			msgReq_ := new(dns.Msg)
+			msgReq_.SetQuestion(name, dns.TypeA)
+			msgRsp_ := rcodeAnswer(msgReq_)
+			rsp_ := &DnsMsgResolverRsp{Status: msgRsp_.Rcode, Answer: msgRsp_.Answer, Authority: msgRsp_.Ns}
+			if ttl_ := CacheTtlOfRsp(rsp_); ttl_ != want[name] {
+				t.Errorf("CacheTtlOfRsp() = %d, want %d", ttl_, want[name])
+			}
+		})
+	}
+}